@@ -0,0 +1,106 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/app"
+)
+
+const clientTimeout = 10 * time.Second
+
+// Client of local HTTP API for temporary access grants management
+type Client struct {
+	baseUrl string
+	token   string
+	client  *http.Client
+}
+
+// Create API client for the server address (host:port or URL)
+func NewClient(address, token string) *Client {
+	baseUrl := address
+	if u, err := url.Parse(address); err != nil || u.Scheme == "" || u.Host == "" {
+		baseUrl = "http://" + address
+	}
+	return &Client{
+		baseUrl: baseUrl,
+		token:   token,
+		client:  &http.Client{Timeout: clientTimeout},
+	}
+}
+
+// Add temporary access grant for the network
+func (c *Client) AddGrant(network string, ttl time.Duration, comment string) (*app.Grant, error) {
+	body, err := json.Marshal(GrantRequest{Network: network, Ttl: ttl.String(), Comment: comment})
+	if err != nil {
+		return nil, err
+	}
+	g := &app.Grant{}
+	if err := c.do(http.MethodPost, GrantsPath, body, http.StatusCreated, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// List active temporary access grants
+func (c *Client) ListGrants() ([]app.Grant, error) {
+	var grants []app.Grant
+	if err := c.do(http.MethodGet, GrantsPath, nil, http.StatusOK, &grants); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// Remove temporary access grant for the network
+func (c *Client) RemoveGrant(network string) error {
+	return c.do(http.MethodDelete, GrantsPath+"?network="+url.QueryEscape(network), nil, http.StatusNoContent, nil)
+}
+
+func (c *Client) do(method, path string, body []byte, status int, result interface{}) error {
+	req, err := http.NewRequest(method, c.baseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		e := ErrorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.New(fmt.Sprintf("unexpected API response status: %s", resp.Status))
+		}
+		return errors.New(e.Error)
+	}
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
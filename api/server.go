@@ -0,0 +1,189 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/app"
+	"github.com/golang/glog"
+)
+
+const (
+	GrantsPath = "/v1/grants"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+// Grant creation request
+type GrantRequest struct {
+	Network string `json:"network"`
+	Ttl     string `json:"ttl"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// Error response
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Local HTTP API server for temporary access grants management
+type Server struct {
+	grants *app.GrantStore
+	token  string
+	now    func() time.Time
+	server *http.Server
+	// Serve API on non-loopback addresses
+	allowRemote bool
+}
+
+// Create API server, every request must be authenticated with given bearer token
+func NewServer(grants *app.GrantStore, token string) *Server {
+	return &Server{
+		grants: grants,
+		token:  token,
+		now:    time.Now,
+	}
+}
+
+// Set API could be served on non-loopback addresses, reachable from the network
+func (s *Server) SetAllowRemote(allow bool) {
+	s.allowRemote = allow
+}
+
+// Start serving API requests on the address, which must be a loopback one unless remote access is allowed
+func (s *Server) Start(address string) error {
+	if !s.allowRemote {
+		if err := ValidateLoopbackAddress(address); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	s.server = &http.Server{Handler: s.Handler()}
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			glog.Errorf("API server error: %v", err)
+		}
+	}()
+	glog.Infof("API server listening on %s", l.Addr())
+
+	return nil
+}
+
+// Validate the address (host:port) is a loopback one
+func ValidateLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New(fmt.Sprintf("API address %s is not a loopback one", address))
+	}
+	return nil
+}
+
+// Stop serving API requests
+func (s *Server) Stop() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		glog.Errorf("API server shutdown error: %v", err)
+	}
+}
+
+// Get API requests handler
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(GrantsPath, s.authenticated(s.handleGrants))
+	return mux
+}
+
+func (s *Server) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) handleGrants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, s.grants.List(s.now()))
+	case http.MethodPost:
+		req := GrantRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("invalid request: %v", err)))
+			return
+		}
+		ttl, err := time.ParseDuration(req.Ttl)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("invalid TTL: %v", err)))
+			return
+		}
+		g, err := s.grants.Add(req.Network, ttl, req.Comment)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		glog.Infof("grant for %s added by %s", g.Network, r.RemoteAddr)
+		writeJson(w, http.StatusCreated, g)
+	case http.MethodDelete:
+		network := r.URL.Query().Get("network")
+		if network == "" {
+			writeError(w, http.StatusBadRequest, errors.New("no network defined"))
+			return
+		}
+		if !s.grants.Remove(network) {
+			writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("no grant for network %s", network)))
+			return
+		}
+		glog.Infof("grant for %s removed by %s", network, r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("method %s not allowed", r.Method)))
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("can't write API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, ErrorResponse{Error: err.Error()})
+}
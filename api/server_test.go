@@ -0,0 +1,97 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/app"
+)
+
+func TestServer(t *testing.T) {
+	grants := app.NewGrantStore("", 2*time.Hour)
+	server := httptest.NewServer(NewServer(grants, "secret").Handler())
+	defer server.Close()
+
+	client := NewClient(server.URL, "secret")
+
+	g, err := client.AddGrant("10.0.0.1", time.Hour, "on-call")
+	if err != nil {
+		t.Fatalf("Client.AddGrant() error = %v", err)
+	}
+	if g.Network != "10.0.0.1/32" || g.Comment != "on-call" {
+		t.Errorf("Client.AddGrant() = %v", g)
+	}
+
+	if _, err := client.AddGrant("10.0.0.2", 3*time.Hour, ""); err == nil {
+		t.Errorf("Client.AddGrant() error = nil for TTL exceeding maximum")
+	}
+
+	if _, err := client.AddGrant("2001:db8::/32", time.Hour, ""); err == nil {
+		t.Errorf("Client.AddGrant() error = nil for IPv6 network")
+	}
+
+	list, err := client.ListGrants()
+	if err != nil {
+		t.Fatalf("Client.ListGrants() error = %v", err)
+	}
+	if len(list) != 1 || list[0].Network != "10.0.0.1/32" {
+		t.Errorf("Client.ListGrants() = %v", list)
+	}
+
+	if err := client.RemoveGrant("10.0.0.1"); err != nil {
+		t.Errorf("Client.RemoveGrant() error = %v", err)
+	}
+	if err := client.RemoveGrant("10.0.0.1"); err == nil {
+		t.Errorf("Client.RemoveGrant() error = nil for unknown grant")
+	}
+
+	if _, err := NewClient(server.URL, "wrong").ListGrants(); err == nil || err.Error() != "unauthorized" {
+		t.Errorf("Client.ListGrants() error = %v, want unauthorized", err)
+	}
+}
+
+func TestServer_Start(t *testing.T) {
+	type args struct {
+		address     string
+		allowRemote bool
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{name: "loopback", args: args{address: "127.0.0.1:0"}},
+		{name: "localhost", args: args{address: "localhost:0"}},
+		{name: "all interfaces", args: args{address: "0.0.0.0:0"}, wantErr: true},
+		{name: "empty host", args: args{address: ":0"}, wantErr: true},
+		{name: "non-loopback", args: args{address: "192.0.2.1:0"}, wantErr: true},
+		{name: "invalid", args: args{address: "127.0.0.1"}, wantErr: true},
+		{name: "remote allowed", args: args{address: "0.0.0.0:0", allowRemote: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(app.NewGrantStore("", time.Hour), "secret")
+			s.SetAllowRemote(tt.args.allowRemote)
+			err := s.Start(tt.args.address)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Server.Start() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			s.Stop()
+		})
+	}
+}
@@ -16,6 +16,14 @@ package app
 
 import (
 	"bytes"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/3cky/kube-restrict-ip/metrics"
+	"github.com/3cky/kube-restrict-ip/pkg/build"
+	"github.com/3cky/kube-restrict-ip/state"
 	"github.com/3cky/kube-restrict-ip/util"
 	"github.com/golang/glog"
 	utildbus "k8s.io/kubernetes/pkg/util/dbus"
@@ -29,6 +37,16 @@ type AppConfig struct {
 	IpChainName         string
 	RestrictedPorts     []string
 	AllowedNetworks     []string
+	ScheduledNetworks   []ScheduledNetwork
+	DeniedNetworks      []string
+	RejectAction        util.RejectAction
+	DnsRefreshInterval  time.Duration
+	Verify              *VerifyConfig
+	SafeNetworks        []string
+	// Critical sources checked by the safety mode, empty if the check is off
+	CriticalSources []string
+	// Startup policy the config is created by due to invalid config file, empty for valid config
+	StartupPolicy string
 }
 
 func NewAppConfig(chainName string, ports, nets []string) *AppConfig {
@@ -39,9 +57,84 @@ func NewAppConfig(chainName string, ports, nets []string) *AppConfig {
 	}
 }
 
+// Create fail-open config: restricted ports are kept, but traffic from all networks is allowed
+func NewFailOpenConfig(chainName string, ports []string) *AppConfig {
+	return NewAppConfig(chainName, ports, []string{"0.0.0.0/0"})
+}
+
+// Create fail-closed config: restricted ports are kept, but no networks are allowed
+func NewFailClosedConfig(chainName string, ports []string) *AppConfig {
+	return NewAppConfig(chainName, ports, nil)
+}
+
 type App struct {
 	cfg      *AppConfig
 	iptables utiliptables.Interface
+	resolver Resolver
+	hosts    *hostCache
+	grants   *GrantStore
+	resyncCh chan struct{}
+	now      func() time.Time
+	dial     func(network, address string, timeout time.Duration) (net.Conn, error)
+
+	// Saves table rules with counters, iptables-save is used if nil
+	saveCounters func(table utiliptables.Table, buffer *bytes.Buffer) error
+	// Commands executor and protocol of the iptables interface, to save rules with counters
+	execer   utilexec.Interface
+	protocol utiliptables.Protocol
+
+	// Last applied effective config
+	applied *AppConfig
+
+	// Hash of the last applied rules, as read back from iptables
+	appliedRulesHash string
+
+	// File to persist last applied state to, if not empty
+	stateFile string
+
+	// Interval to check running rules for drift from the applied ones, disabled if zero
+	reconcileInterval time.Duration
+
+	// Remove rules on exit
+	cleanupOnExit bool
+
+	// Interval to export running rules traffic counters as metrics, disabled if zero
+	statsInterval time.Duration
+
+	// Window allowed networks config entries without hits over are reported stale, disabled if zero
+	staleWindow time.Duration
+
+	// Allowed networks config entries hits, by config entry
+	hits map[string]*state.EntryHits
+
+	// Last seen allowed network rules packet counters, by rule network, nil until first seen
+	rulePackets map[string]uint64
+
+	// App instance ID embedded in restricted ports rules comment, empty for default instance
+	instance string
+
+	// Network rules chains left by previous runs to clean up, with their restricted ports
+	staleChains map[string][]string
+
+	// Redundant networks already reported
+	redundancies map[string]bool
+
+	// Config updates channel, cancels waiting for applied rules verification
+	updates chan *AppConfig
+
+	// Config update received while waiting for applied rules verification, handled next by the run loop
+	pendingUpdate *configUpdate
+
+	// Last config applied by the run loop, guarded by the mutex since read by other goroutines
+	appliedCfg   *AppConfig
+	appliedCfgMu sync.Mutex
+}
+
+// Config update received from the config updates channel
+type configUpdate struct {
+	cfg *AppConfig
+	// Config updates channel is closed
+	closed bool
 }
 
 func NewApp(cfg *AppConfig) *App {
@@ -52,12 +145,63 @@ func NewApp(cfg *AppConfig) *App {
 	return &App{
 		cfg:      cfg,
 		iptables: iptables,
+		execer:   execer,
+		protocol: protocol,
+		resolver: net.DefaultResolver,
+		resyncCh: make(chan struct{}, 1),
 	}
 }
 
+// Set file to persist last applied state to
+func (app *App) SetStateFile(fileName string) {
+	app.stateFile = fileName
+}
+
+// Set app instance ID to manage only the rules of the instance, so multiple app instances
+// could run on the same node
+func (app *App) SetInstance(instance string) {
+	app.instance = instance
+}
+
+// Set interval to check running rules for drift from the applied ones and re-apply them,
+// zero interval disables the check
+func (app *App) SetReconcileInterval(interval time.Duration) {
+	app.reconcileInterval = interval
+}
+
+// Set interval to export running rules traffic counters as metrics, zero interval disables export
+func (app *App) SetStatsInterval(interval time.Duration) {
+	app.statsInterval = interval
+}
+
+// Set rules should be removed on exit
+func (app *App) SetCleanupOnExit(cleanup bool) {
+	app.cleanupOnExit = cleanup
+}
+
+// Set store of temporary access grants merged to allowed networks
+func (app *App) SetGrantStore(grants *GrantStore) {
+	app.grants = grants
+	grants.onChange = app.requestResync
+}
+
+// Set resolver used for allowed networks host names lookup
+func (app *App) SetResolver(resolver Resolver) {
+	app.resolver = resolver
+	app.hosts = nil
+}
+
+// Get restricted ports of the running rules, nil if rules not found
+func (app *App) RunningRestrictedPorts() []string {
+	if cfg := app.fetchRunningConfigFromTables(); cfg != nil {
+		return cfg.RestrictedPorts
+	}
+	return nil
+}
+
 func (app *App) RunOnce() {
 	// Fetch running config
-	oldCfg := app.fetchRunningConfigFromTables()
+	oldCfg := app.fetchRunningConfig()
 
 	if err := app.updateTables(oldCfg, app.cfg); err != nil {
 		glog.Fatalf("can't update iptables: %v", err)
@@ -71,111 +215,632 @@ func (app *App) Run(cfgCh chan *AppConfig, doneCh chan struct{}) {
 
 	glog.Info("starting")
 
-	// Do initial iptables rules synchronization
-	glog.Info("do initial iptables rules sync")
+	app.updates = cfgCh
 
-	oldCfg := app.fetchRunningConfigFromTables()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
 
-	if err := app.updateTables(oldCfg, app.cfg); err != nil {
-		glog.Errorf("initial iptables rules sync error: %v", err)
+	if app.resyncCh == nil {
+		app.resyncCh = make(chan struct{}, 1)
+	}
+	app.hostCache()
+	go app.refreshHosts(stopCh)
+
+	var reconcileCh <-chan time.Time
+	if app.reconcileInterval > 0 {
+		ticker := time.NewTicker(app.reconcileInterval)
+		defer ticker.Stop()
+		reconcileCh = ticker.C
+	}
+
+	var statsCh <-chan time.Time
+	if app.statsInterval > 0 {
+		ticker := time.NewTicker(app.statsInterval)
+		defer ticker.Stop()
+		statsCh = ticker.C
+	}
+
+	if app.cfg == nil {
+		// No valid config yet, keep running rules untouched
+		glog.Info("no config to apply, waiting for valid config")
 	} else {
-		glog.Info("initial iptables rules sync done")
+		// Do initial iptables rules synchronization
+		glog.Info("do initial iptables rules sync")
+
+		oldCfg := app.fetchRunningConfig()
+
+		if err := app.updateTables(oldCfg, app.cfg); err != nil {
+			glog.Errorf("initial iptables rules sync error: %v", err)
+			metrics.CountConfigUpdate(metrics.ConfigUpdateError)
+		} else {
+			glog.Info("initial iptables rules sync done")
+			reportConfigApplied(app.cfg)
+			app.setAppliedConfig(app.cfg)
+		}
 	}
 
+	schedule := &scheduleTimer{}
+	defer schedule.stop()
+
+Loop:
 	for {
-		newCfg, ok := <-cfgCh
+		// Config or grants could be updated, armed schedule timer is never postponed
+		app.armScheduleTimer(schedule)
+
+		if u := app.pendingUpdate; u != nil {
+			// Config update cancelled applied rules verification
+			app.pendingUpdate = nil
+			if u.closed {
+				break Loop
+			}
+			app.updateConfig(u.cfg)
+			continue
+		}
 
-		if !ok {
-			break
+		select {
+		case newCfg, ok := <-cfgCh:
+			if !ok {
+				break Loop
+			}
+			app.updateConfig(newCfg)
+		case <-schedule.C():
+			schedule.fired()
+			// Check scheduled allowed networks activity changed or grants expired
+			if app.applied != nil && util.Matched(app.applied.AllowedNetworks, app.effectiveConfig(app.cfg).AllowedNetworks) {
+				continue
+			}
+			glog.Info("scheduled allowed networks or grants changed")
+			if err := app.updateTables(app.cfg, app.cfg); err != nil {
+				glog.Errorf("iptables rules resync error: %v", err)
+			} else {
+				glog.Info("iptables rules resync done")
+			}
+		case <-app.resyncCh:
+			if app.cfg == nil {
+				continue
+			}
+			// Update iptables according to the changed dynamic config entries
+			if err := app.updateTables(app.cfg, app.cfg); err != nil {
+				glog.Errorf("iptables rules resync error: %v", err)
+			} else {
+				glog.Info("iptables rules resync done")
+			}
+		case <-reconcileCh:
+			app.reconcile()
+		case <-statsCh:
+			app.updateRuleStats()
 		}
+	}
 
-		// Update iptables according to the updated config
-		if err := app.updateTables(app.cfg, newCfg); err != nil {
-			glog.Errorf("iptables rules sync error: %v", err)
+	if app.cleanupOnExit {
+		if app.cfg == nil {
+			glog.Info("no config applied, running rules are kept untouched")
+		} else if err := app.Cleanup(); err != nil {
+			glog.Errorf("iptables rules cleanup error: %v", err)
 		} else {
-			glog.Info("iptables rules sync done")
-			app.cfg = newCfg
+			glog.Info("iptables rules cleaned up")
 		}
 	}
 
 	glog.Info("stopped")
 }
 
+// Update iptables according to the updated config
+func (app *App) updateConfig(newCfg *AppConfig) {
+	cfg, oldCfg := app.cfg, app.cfg
+	if cfg == nil {
+		// No config applied yet, sync from the running rules
+		app.cfg = newCfg
+		oldCfg = app.fetchRunningConfig()
+	}
+
+	if err := app.updateTables(oldCfg, newCfg); err != nil {
+		glog.Errorf("iptables rules sync error: %v", err)
+		metrics.CountConfigUpdate(metrics.ConfigUpdateError)
+		app.cfg = cfg
+	} else {
+		glog.Info("iptables rules sync done")
+		reportConfigApplied(newCfg)
+		app.cfg = newCfg
+		app.setAppliedConfig(newCfg)
+	}
+}
+
+// Get last config applied by the run loop, nil if no config is applied yet
+func (app *App) AppliedConfig() *AppConfig {
+	app.appliedCfgMu.Lock()
+	defer app.appliedCfgMu.Unlock()
+	return app.appliedCfg
+}
+
+func (app *App) setAppliedConfig(cfg *AppConfig) {
+	app.appliedCfgMu.Lock()
+	defer app.appliedCfgMu.Unlock()
+	app.appliedCfg = cfg
+}
+
+// Report applied config hash to the log and metrics
+func reportConfigApplied(cfg *AppConfig) {
+	hash := cfg.Hash()
+	glog.Infof("applied config hash: %s", hash)
+	metrics.SetConfigHash(hash)
+	metrics.CountConfigUpdate(metrics.ConfigUpdateApplied)
+}
+
+// Request iptables rules resync with the current config
+func (app *App) requestResync() {
+	select {
+	case app.resyncCh <- struct{}{}:
+	default:
+		// Resync is already pending
+	}
+}
+
+// Periodically re-resolve allowed networks host names and request resync on changes
+func (app *App) refreshHosts(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(app.hostCache().refreshInterval()):
+			if app.hostCache().refresh() {
+				glog.Info("allowed host addresses changed")
+				app.requestResync()
+			}
+		}
+	}
+}
+
+// Arm schedule timer for the next possible scheduled allowed networks activity change
+// or grant expiration, if there are scheduled networks or grants
+func (app *App) armScheduleTimer(t *scheduleTimer) {
+	if app.cfg == nil {
+		return
+	}
+	now := app.currentTime()
+	next, ok := nextScheduleChange(app.cfg.ScheduledNetworks, now)
+	if app.grants != nil {
+		if expiry, found := app.grants.NextExpiry(now); found && (!ok || expiry.Before(next)) {
+			next, ok = expiry, true
+		}
+	}
+	if ok {
+		t.arm(next, now)
+	}
+}
+
+func (app *App) currentTime() time.Time {
+	if app.now == nil {
+		return time.Now()
+	}
+	return app.now()
+}
+
+func (app *App) hostCache() *hostCache {
+	if app.hosts == nil {
+		if app.resolver == nil {
+			app.resolver = net.DefaultResolver
+		}
+		app.hosts = newHostCache(app.resolver)
+	}
+	return app.hosts
+}
+
+// Get config with dynamic allowed networks entries (active scheduled networks, grants
+// and host names) expanded and networks aggregated to the minimal set of networks
+func (app *App) effectiveConfig(cfg *AppConfig) *AppConfig {
+	hosts := app.hostCache()
+	hosts.update(cfg)
+
+	c := *cfg
+
+	now := app.currentTime()
+	nets := append(append([]string{}, cfg.AllowedNetworks...), activeScheduledNetworks(cfg.ScheduledNetworks, now)...)
+	if app.grants != nil {
+		nets = append(nets, app.grants.Networks(now)...)
+	}
+	c.ScheduledNetworks = nil
+
+	allowed, allowedRedundancies := util.AggregateNetworks(hosts.expand(nets))
+	denied, deniedRedundancies := util.AggregateNetworks(cfg.DeniedNetworks)
+	c.AllowedNetworks = allowed
+	c.DeniedNetworks = denied
+
+	var redundancies []string
+	for _, r := range allowedRedundancies {
+		redundancies = append(redundancies, "allowed "+r.String())
+	}
+	for _, r := range deniedRedundancies {
+		redundancies = append(redundancies, "denied "+r.String())
+	}
+	app.reportRedundancies(redundancies)
+
+	return &c
+}
+
+// Log redundant networks removed by aggregation, once per every redundancy
+func (app *App) reportRedundancies(redundancies []string) {
+	reported := map[string]bool{}
+	for _, r := range redundancies {
+		if !app.redundancies[r] {
+			glog.Infof("removed redundant %s", r)
+		}
+		reported[r] = true
+	}
+	app.redundancies = reported
+}
+
 func (app *App) updateTables(oldCfg, newCfg *AppConfig) error {
+	newCfg = app.effectiveConfig(newCfg)
+
+	if app.applied != nil {
+		logNetworksChanges("allowed", app.applied.AllowedNetworks, newCfg.AllowedNetworks)
+		logNetworksChanges("denied", app.applied.DeniedNetworks, newCfg.DeniedNetworks)
+	}
+
+	prevCfg := app.applied
+
+	// Rules rejecting verification source addresses are never applied
+	if err := verifySources(newCfg); err != nil {
+		return err
+	}
+
+	// Running rules are used to delete INPUT rules redirecting to the old and stale chains
+	data, err := app.saveTables()
+	if err != nil {
+		return err
+	}
+
+	if err := checkInstancesConflicts(data, app.instance, newCfg.RestrictedPorts); err != nil {
+		return err
+	}
+
 	// Create rules in iptables-restore format
-	d := app.createTablesRestoreData(oldCfg, newCfg)
+	d := app.createTablesRestoreData(data, oldCfg, newCfg)
 	glog.V(4).Infof("iptables-restore data:\n%s", d)
 
+	if app.statsInterval > 0 {
+		// Export rules traffic counters before they are reset by the chain flush
+		app.updateRuleStats()
+	}
+
 	// Update iptables rules
-	err := app.iptables.RestoreAll(d, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters)
+	err = app.iptables.RestoreAll(d, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters)
 	if err != nil {
 		return err
 	}
 
+	if app.statsInterval > 0 {
+		metrics.ResetRuleCounters()
+		app.rulePackets = map[string]uint64{}
+	}
+
+	app.staleChains = nil
+
+	app.recordApplied(newCfg, d)
+
+	if err := app.verifyTables(newCfg); err != nil {
+		return app.rollbackTables(newCfg, prevCfg, err)
+	}
+
+	// Config is applied only if its rules are verified
+	app.applied = newCfg
+
 	return nil
 }
 
-// Fetch running config from iptables rules, if present
-func (app *App) fetchRunningConfigFromTables() *AppConfig {
-	var cfg *AppConfig = nil
+// Log networks added and deleted since last applied config
+func logNetworksChanges(kind string, oldNets, newNets []string) {
+	added, deleted := util.DiffSets(util.ToSet(oldNets), util.ToSet(newNets))
+	if len(added) > 0 {
+		glog.Infof("%s networks added: %v", kind, sortedKeys(added))
+	}
+	if len(deleted) > 0 {
+		glog.Infof("%s networks deleted: %v", kind, sortedKeys(deleted))
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Read back applied rules for drift detection and persist applied config state to the state file, if defined
+func (app *App) recordApplied(cfg *AppConfig, payload []byte) {
+	d := bytes.NewBuffer(nil)
+	if err := app.iptables.SaveInto(utiliptables.TableFilter, d); err != nil {
+		glog.Errorf("can't read back applied iptables rules: %v", err)
+		app.appliedRulesHash = ""
+		return
+	}
+	app.appliedRulesHash = state.HashLines(util.GetChainRulesFromTablesData(d.Bytes(), cfg.IpChainName))
+
+	app.saveState(cfg, payload)
+}
+
+// Persist applied config state to the state file, if defined
+func (app *App) saveState(cfg *AppConfig, payload []byte) {
+	if app.stateFile == "" {
+		return
+	}
+
+	s := &state.State{
+		BuildVersion:    build.Version,
+		Instance:        app.instance,
+		AppliedAt:       app.currentTime().UTC(),
+		ChainName:       cfg.IpChainName,
+		RestrictedPorts: cfg.RestrictedPorts,
+		AllowedNetworks: cfg.AllowedNetworks,
+		DeniedNetworks:  cfg.DeniedNetworks,
+		Action:          cfg.RejectAction.Target,
+		RejectWith:      cfg.RejectAction.RejectWith,
+		StartupPolicy:   cfg.StartupPolicy,
+		PayloadHash:     state.Hash(payload),
+		RulesHash:       app.appliedRulesHash,
+		Hits:            app.hits,
+	}
+	if err := s.Save(app.stateFile); err != nil {
+		glog.Errorf("can't save state file: %v", err)
+	}
+}
 
+// Fetch running config from iptables rules, using last applied state from the state file,
+// if present, to find rules created with different chain name and to detect rules tampering.
+// Stale rules chains created by previous runs are scheduled to clean up.
+func (app *App) fetchRunningConfig() *AppConfig {
 	d := bytes.NewBuffer(nil)
+	if err := app.iptables.SaveInto(utiliptables.TableFilter, d); err != nil {
+		glog.Errorf("can't fetch running config from iptables: %v", err)
+		return nil
+	}
+	data := d.Bytes()
 
-	err := app.iptables.SaveInto(utiliptables.TableFilter, d)
+	var st *state.State
+	if app.stateFile != "" {
+		var err error
+		if st, err = state.Load(app.stateFile); err != nil {
+			glog.Errorf("can't load state file: %v", err)
+		}
+		if st != nil && st.Instance != app.instance {
+			glog.Errorf("state file %s belongs to instance %s, ignored", app.stateFile, instanceName(st.Instance))
+			st = nil
+		}
+		if st != nil && app.hits == nil {
+			app.hits = st.Hits
+		}
+	}
 
-	if err == nil {
-		ports := util.GetRestrictedPortsFromTablesData(d.Bytes(), app.cfg.IpChainName)
+	chain := app.cfg.IpChainName
+	if st != nil && st.ChainName != chain && util.GetRestrictedPortsFromTablesData(data, st.ChainName) != nil {
+		// Chain name changed since last run, migrate from old chain
+		glog.Infof("chain name changed from %s to %s since last run", st.ChainName, chain)
+		chain = st.ChainName
+	}
 
-		if ports != nil {
-			cfg = NewAppConfig(app.cfg.IpChainName, ports, nil)
+	cfg := runningConfigFromTablesData(data, chain)
+
+	if st != nil && cfg != nil && st.ChainName == chain {
+		if util.Matched(st.RestrictedPorts, cfg.RestrictedPorts) &&
+			st.RulesHash == state.HashLines(util.GetChainRulesFromTablesData(data, chain)) {
+			glog.V(2).Infof("running rules match state applied at %v", st.AppliedAt)
+			// Use last applied state for exact diffs
+			applied := NewAppConfig(chain, st.RestrictedPorts, st.AllowedNetworks)
+			applied.DeniedNetworks = st.DeniedNetworks
+			applied.RejectAction = util.RejectAction{Target: st.Action, RejectWith: st.RejectWith}
+			// Implicitly allowed critical sources are not in the state, rebuild them by the current
+			// config ones, so rules of the state config keep critical sources allowed on rollback
+			applied.SafeNetworks = RejectedSources(applied, app.cfg.CriticalSources)
+			app.applied = applied
+		} else {
+			glog.Warningf("running rules were modified since last applied at %v", st.AppliedAt)
 		}
-	} else {
+	}
+
+	if app.stateFile != "" {
+		// Find stale chains with restricted ports rules left by previous runs
+		app.staleChains = map[string][]string{}
+		for c, ports := range util.GetRestrictedPortsChainsFromTablesData(data, app.instance) {
+			if c != chain && c != app.cfg.IpChainName {
+				glog.Infof("found stale chain %s, will be cleaned up", c)
+				app.staleChains[c] = ports
+			}
+		}
+	}
+
+	return cfg
+}
+
+// Fetch running config from iptables rules, if present
+func (app *App) fetchRunningConfigFromTables() *AppConfig {
+	d := bytes.NewBuffer(nil)
+
+	if err := app.iptables.SaveInto(utiliptables.TableFilter, d); err != nil {
 		glog.Errorf("can't fetch running config from iptables: %v", err)
+		return nil
+	}
+
+	return runningConfigFromTablesData(d.Bytes(), app.cfg.IpChainName)
+}
+
+// Get running config for the chain from iptables-save data, nil if chain rules not found
+func runningConfigFromTablesData(data []byte, chain string) *AppConfig {
+	ports := util.GetRestrictedPortsFromTablesData(data, chain)
+	if ports == nil {
+		return nil
+	}
+
+	cfg := NewAppConfig(chain, ports, nil)
+	if action := util.GetRejectActionFromTablesData(data, chain); action != nil {
+		cfg.RejectAction = *action
 	}
 
 	return cfg
 }
 
-// Create iptables-restore data for synchronizing old config to new one
-func (app *App) createTablesRestoreData(oldCfg, newCfg *AppConfig) []byte {
+// Create iptables-restore data for synchronizing old config to new one. New rules are built
+// in a separate chain and restricted ports are redirected to it before the old chain is deleted,
+// so restricted ports are protected at any point of the rules update. INPUT rules redirecting
+// to the old and stale chains are deleted as found in the running rules (iptables-save data)
+func (app *App) createTablesRestoreData(data []byte, oldCfg, newCfg *AppConfig) []byte {
 	lines := bytes.NewBuffer(nil)
 
 	// Begin with table name ('filter')
 	util.WriteLine(lines, "*"+string(utiliptables.TableFilter))
 
-	// Add migration rules, if needed
-	if oldCfg != nil {
-		if oldCfg.IpChainName != newCfg.IpChainName {
-			// Flush old network rules chain
-			util.WriteLine(lines, util.CreateEmptyChainRule(oldCfg.IpChainName))
-		}
-		// Create/flush new network rules chain
-		util.WriteLine(lines, util.CreateEmptyChainRule(newCfg.IpChainName))
+	// Build new rules in the staging chain if the running chain is replaced
+	chain := newCfg.IpChainName
+	if oldCfg != nil && oldCfg.IpChainName == newCfg.IpChainName {
+		chain = util.StagingChainName(newCfg.IpChainName)
+	}
 
-		// Check INPUT rule for redirecting restricted ports to network rules chain should be updated
-		if (oldCfg.IpChainName != newCfg.IpChainName) || !util.Matched(oldCfg.RestrictedPorts, newCfg.RestrictedPorts) {
-			// Delete old rule
-			util.WriteLine(lines, util.CreateRestrictedPortsDeleteRule(oldCfg.IpChainName, oldCfg.RestrictedPorts))
-			// Add new rule
-			util.WriteLine(lines, util.CreateRestrictedPortsAddRule(newCfg.IpChainName, newCfg.RestrictedPorts))
-		}
-	} else {
-		// Flush network rules chain
-		util.WriteLine(lines, util.CreateEmptyChainRule(newCfg.IpChainName))
-		// Add INPUT rule for redirecting restricted ports to network rules chain
-		util.WriteLine(lines, util.CreateRestrictedPortsAddRule(newCfg.IpChainName, newCfg.RestrictedPorts))
+	// Stale chain with the same name must be cleaned up before the chain is built
+	if _, ok := app.staleChains[chain]; ok {
+		writeChainCleanupRules(lines, data, chain)
+	}
+
+	// Create/flush network rules chain
+	util.WriteLine(lines, util.CreateEmptyChainRule(chain))
+
+	// Write rules for implicitly allowed critical sources to the chain, before all others
+	for _, net := range newCfg.SafeNetworks {
+		util.WriteLine(lines, util.CreateAllowedNetworkChainRule(chain, net))
+	}
+
+	// Write rules for all denied networks to the chain, before the allowed ones
+	for _, net := range newCfg.DeniedNetworks {
+		util.WriteLine(lines, util.CreateDeniedNetworkChainRule(chain, net, newCfg.RejectAction))
 	}
 
 	// Write rules for all allowed networks to the chain
 	for _, net := range newCfg.AllowedNetworks {
-		util.WriteLine(lines, util.CreateAllowedNetworkChainRule(newCfg.IpChainName, net))
+		util.WriteLine(lines, util.CreateAllowedNetworkChainRule(chain, net))
+	}
+
+	// Write default (reject) rule for unmatched networks at the end of network rules chain
+	util.WriteLine(lines, util.CreateDefaultNetworkChainRule(chain, newCfg.RejectAction))
+
+	// Add INPUT rule redirecting restricted ports to the complete network rules chain
+	util.WriteLine(lines, util.CreateRestrictedPortsAddRule(app.instance, chain, newCfg.RestrictedPorts))
+
+	if oldCfg != nil {
+		// Delete INPUT rule redirecting to the old chain, flush and delete old chain
+		writeChainCleanupRules(lines, data, oldCfg.IpChainName)
+		if chain != newCfg.IpChainName {
+			// Rename staging chain, INPUT rule redirecting to it is updated as well
+			util.WriteLine(lines, util.CreateRenameChainRule(chain, newCfg.IpChainName))
+		}
 	}
 
-	// Write default (DROP) rule for unmatched networks at the end of network rules chain
-	util.WriteLine(lines, util.CreateDefaultNetworkChainRule(newCfg.IpChainName))
+	// Clean up stale chains: delete INPUT rules redirecting to them, flush and delete chains
+	var staleChains []string
+	for c := range app.staleChains {
+		if c != chain {
+			staleChains = append(staleChains, c)
+		}
+	}
+	sort.Strings(staleChains)
+	for _, c := range staleChains {
+		writeChainCleanupRules(lines, data, c)
+	}
 
 	// Commit all rules
 	util.WriteLine(lines, "COMMIT")
 
 	return lines.Bytes()
 }
+
+// Write rules deleting INPUT rules redirecting restricted ports to the chain found in iptables-save
+// data by exact match, flushing and deleting the chain
+func writeChainCleanupRules(lines *bytes.Buffer, data []byte, chain string) {
+	for _, rule := range util.GetRestrictedPortsRulesFromTablesData(data, chain) {
+		util.WriteLine(lines, util.CreateDeleteRule(rule))
+	}
+	util.WriteLine(lines, util.CreateEmptyChainRule(chain))
+	util.WriteLine(lines, util.CreateDeleteChainRule(chain))
+}
+
+// Check running rules match the last applied ones and re-apply config if rules drifted
+// (e.g. modified or deleted outside of the app) or weren't applied at all
+func (app *App) reconcile() {
+	if app.cfg == nil {
+		return
+	}
+	if app.applied == nil || app.appliedRulesHash == "" {
+		// Rules are not applied yet, e.g. initial sync failed, so retry
+		glog.Info("retrying iptables rules sync")
+		if err := app.updateTables(app.fetchRunningConfig(), app.cfg); err != nil {
+			glog.Errorf("iptables rules sync error: %v", err)
+		} else {
+			glog.Info("iptables rules sync done")
+			reportConfigApplied(app.cfg)
+		}
+		return
+	}
+
+	d := bytes.NewBuffer(nil)
+	if err := app.iptables.SaveInto(utiliptables.TableFilter, d); err != nil {
+		glog.Errorf("can't fetch running iptables rules: %v", err)
+		return
+	}
+	data := d.Bytes()
+
+	chain := app.applied.IpChainName
+	running := runningConfigFromTablesData(data, chain)
+	if running != nil && util.Matched(running.RestrictedPorts, app.applied.RestrictedPorts) &&
+		state.HashLines(util.GetChainRulesFromTablesData(data, chain)) == app.appliedRulesHash {
+		glog.V(4).Info("running rules match the applied ones")
+		return
+	}
+
+	glog.Warning("running rules drifted from the applied ones, re-applying config")
+	if err := app.updateTables(running, app.cfg); err != nil {
+		glog.Errorf("iptables rules reconcile error: %v", err)
+	} else {
+		glog.Info("iptables rules reconcile done")
+	}
+}
+
+// Remove rules created by the app: INPUT rule redirecting restricted ports to the network
+// rules chain and the chain itself. State file, if any, is removed as well
+func (app *App) Cleanup() error {
+	chain := app.cfg.IpChainName
+	if app.applied != nil {
+		chain = app.applied.IpChainName
+	}
+
+	d := bytes.NewBuffer(nil)
+	if err := app.iptables.SaveInto(utiliptables.TableFilter, d); err != nil {
+		return err
+	}
+	data := d.Bytes()
+
+	if util.GetRestrictedPortsRulesFromTablesData(data, chain) == nil && !util.HasChain(data, chain) {
+		glog.V(2).Infof("no rules found for chain %s, nothing to clean up", chain)
+	} else {
+		lines := bytes.NewBuffer(nil)
+		util.WriteLine(lines, "*"+string(utiliptables.TableFilter))
+		writeChainCleanupRules(lines, data, chain)
+		util.WriteLine(lines, "COMMIT")
+		glog.V(4).Infof("iptables-restore cleanup data:\n%s", lines.Bytes())
+
+		if err := app.iptables.RestoreAll(lines.Bytes(), utiliptables.NoFlushTables,
+			utiliptables.NoRestoreCounters); err != nil {
+			return err
+		}
+	}
+
+	app.applied = nil
+	app.appliedRulesHash = ""
+
+	if app.stateFile != "" {
+		if err := os.Remove(app.stateFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -15,8 +15,13 @@
 package app
 
 import (
+	"github.com/3cky/kube-restrict-ip/state"
 	"github.com/3cky/kube-restrict-ip/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
@@ -49,7 +54,7 @@ func TestApp_fetchRunningConfigFromTables(t *testing.T) {
 				iptables utiliptables.Interface
 			}{cfg: NewAppConfig("TEST-CHAIN", nil, nil),
 				iptables: &testiptables.FakeIPTables{Lines: []byte(util.JoinWords("-A", "INPUT",
-					util.CreateRestrictedPortsMatchRule("TEST-CHAIN-1", []string{"1234", "3456"})))}},
+					util.CreateRestrictedPortsMatchRule("", "TEST-CHAIN-1", []string{"1234", "3456"})))}},
 			want: nil,
 		},
 		{
@@ -59,7 +64,7 @@ func TestApp_fetchRunningConfigFromTables(t *testing.T) {
 				iptables utiliptables.Interface
 			}{cfg: NewAppConfig("TEST-CHAIN", []string{}, []string{}),
 				iptables: &testiptables.FakeIPTables{Lines: []byte(util.JoinWords("-A", "INPUT",
-					util.CreateRestrictedPortsMatchRule("TEST-CHAIN", []string{"1234", "3456"})))}},
+					util.CreateRestrictedPortsMatchRule("", "TEST-CHAIN", []string{"1234", "3456"})))}},
 			want: NewAppConfig("TEST-CHAIN", []string{"1234", "3456"}, nil),
 		},
 	}
@@ -98,21 +103,158 @@ func TestApp_updateTables(t *testing.T) {
 				iptables utiliptables.Interface
 			}{
 				cfg:      NewAppConfig("", nil, nil),
-				iptables: testiptables.NewFake(),
+				iptables: newSavedRulesFake("TEST-CHAIN", []string{"1234"}),
 			},
 			args: struct {
 				oldCfg *AppConfig
 				newCfg *AppConfig
 			}{
 				oldCfg: NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{}),
-				newCfg: NewAppConfig("TEST-CHAIN-NEW", []string{"4567"}, []string{"127.0.0.1"})},
+				newCfg: NewAppConfig("TEST-CHAIN-2", []string{"4567"}, []string{"127.0.0.1"})},
+			want: `*filter
+:TEST-CHAIN-2 - [0:0]
+-A TEST-CHAIN-2 -s 127.0.0.1 -j RETURN
+-A TEST-CHAIN-2 -j REJECT --reject-with icmp-port-unreachable
+-I INPUT 1 -p tcp -m multiport --dports 4567 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN-2
+-D INPUT -p tcp -m multiport --dports 1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+:TEST-CHAIN - [0:0]
+-X TEST-CHAIN
+COMMIT
+`,
+		},
+		{
+			name: "drop action",
+			fields: struct {
+				cfg      *AppConfig
+				iptables utiliptables.Interface
+			}{
+				cfg:      NewAppConfig("", nil, nil),
+				iptables: testiptables.NewFake(),
+			},
+			args: struct {
+				oldCfg *AppConfig
+				newCfg *AppConfig
+			}{
+				oldCfg: nil,
+				newCfg: &AppConfig{IpChainName: "TEST-CHAIN", RestrictedPorts: []string{"4567"},
+					AllowedNetworks: []string{"127.0.0.1"}, RejectAction: util.RejectAction{Target: "DROP"}}},
 			want: `*filter
 :TEST-CHAIN - [0:0]
+-A TEST-CHAIN -s 127.0.0.1 -j RETURN
+-A TEST-CHAIN -j DROP
+-I INPUT 1 -p tcp -m multiport --dports 4567 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN
+COMMIT
+`,
+		},
+		{
+			name: "denied networks",
+			fields: struct {
+				cfg      *AppConfig
+				iptables utiliptables.Interface
+			}{
+				cfg:      NewAppConfig("", nil, nil),
+				iptables: newSavedRulesFake("TEST-CHAIN", []string{"4567"}),
+			},
+			args: struct {
+				oldCfg *AppConfig
+				newCfg *AppConfig
+			}{
+				oldCfg: NewAppConfig("TEST-CHAIN", []string{"4567"}, []string{"10.0.0.0/8"}),
+				newCfg: &AppConfig{IpChainName: "TEST-CHAIN", RestrictedPorts: []string{"4567"},
+					AllowedNetworks: []string{"10.0.0.0/8"}, DeniedNetworks: []string{"10.1.0.0/16"},
+					RejectAction: util.RejectAction{Target: "REJECT", RejectWith: "tcp-reset"}}},
+			want: `*filter
 :TEST-CHAIN-NEW - [0:0]
--D INPUT -p tcp -m multiport --dports 1234 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN
+-A TEST-CHAIN-NEW -s 10.1.0.0/16 -p tcp -j REJECT --reject-with tcp-reset
+-A TEST-CHAIN-NEW -s 10.0.0.0/8 -j RETURN
+-A TEST-CHAIN-NEW -p tcp -j REJECT --reject-with tcp-reset
 -I INPUT 1 -p tcp -m multiport --dports 4567 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN-NEW
+-D INPUT -p tcp -m multiport --dports 4567 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+:TEST-CHAIN - [0:0]
+-X TEST-CHAIN
+-E TEST-CHAIN-NEW TEST-CHAIN
+COMMIT
+`,
+		},
+		{
+			name: "aggregated networks",
+			fields: struct {
+				cfg      *AppConfig
+				iptables utiliptables.Interface
+			}{
+				cfg:      NewAppConfig("", nil, nil),
+				iptables: newSavedRulesFake("TEST-CHAIN", []string{"4567"}),
+			},
+			args: struct {
+				oldCfg *AppConfig
+				newCfg *AppConfig
+			}{
+				oldCfg: NewAppConfig("TEST-CHAIN", []string{"4567"}, []string{"10.0.0.0/8"}),
+				newCfg: NewAppConfig("TEST-CHAIN", []string{"4567"},
+					[]string{"127.0.0.1", "10.1.0.0/16", "10.0.0.0/16", "10.1.2.3", "127.0.0.1"})},
+			want: `*filter
+:TEST-CHAIN-NEW - [0:0]
+-A TEST-CHAIN-NEW -s 10.0.0.0/15 -j RETURN
 -A TEST-CHAIN-NEW -s 127.0.0.1 -j RETURN
 -A TEST-CHAIN-NEW -j REJECT --reject-with icmp-port-unreachable
+-I INPUT 1 -p tcp -m multiport --dports 4567 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN-NEW
+-D INPUT -p tcp -m multiport --dports 4567 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+:TEST-CHAIN - [0:0]
+-X TEST-CHAIN
+-E TEST-CHAIN-NEW TEST-CHAIN
+COMMIT
+`,
+		},
+		{
+			name: "fail-open config",
+			fields: struct {
+				cfg      *AppConfig
+				iptables utiliptables.Interface
+			}{
+				cfg:      NewAppConfig("", nil, nil),
+				iptables: newSavedRulesFake("TEST-CHAIN", []string{"4567"}),
+			},
+			args: struct {
+				oldCfg *AppConfig
+				newCfg *AppConfig
+			}{
+				oldCfg: NewAppConfig("TEST-CHAIN", []string{"4567"}, []string{"10.0.0.0/8"}),
+				newCfg: NewFailOpenConfig("TEST-CHAIN", []string{"4567"})},
+			want: `*filter
+:TEST-CHAIN-NEW - [0:0]
+-A TEST-CHAIN-NEW -s 0.0.0.0/0 -j RETURN
+-A TEST-CHAIN-NEW -j REJECT --reject-with icmp-port-unreachable
+-I INPUT 1 -p tcp -m multiport --dports 4567 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN-NEW
+-D INPUT -p tcp -m multiport --dports 4567 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+:TEST-CHAIN - [0:0]
+-X TEST-CHAIN
+-E TEST-CHAIN-NEW TEST-CHAIN
+COMMIT
+`,
+		},
+		{
+			name: "fail-closed config",
+			fields: struct {
+				cfg      *AppConfig
+				iptables utiliptables.Interface
+			}{
+				cfg:      NewAppConfig("", nil, nil),
+				iptables: newSavedRulesFake("TEST-CHAIN", []string{"4567"}),
+			},
+			args: struct {
+				oldCfg *AppConfig
+				newCfg *AppConfig
+			}{
+				oldCfg: NewAppConfig("TEST-CHAIN", []string{"4567"}, []string{"10.0.0.0/8"}),
+				newCfg: NewFailClosedConfig("TEST-CHAIN", []string{"4567"})},
+			want: `*filter
+:TEST-CHAIN-NEW - [0:0]
+-A TEST-CHAIN-NEW -j REJECT --reject-with icmp-port-unreachable
+-I INPUT 1 -p tcp -m multiport --dports 4567 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN-NEW
+-D INPUT -p tcp -m multiport --dports 4567 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+:TEST-CHAIN - [0:0]
+-X TEST-CHAIN
+-E TEST-CHAIN-NEW TEST-CHAIN
 COMMIT
 `,
 		},
@@ -134,3 +276,314 @@ COMMIT
 		})
 	}
 }
+
+// Create fake iptables with running rules redirecting restricted ports to the chain, in iptables-save format
+func newSavedRulesFake(chain string, ports []string) *testiptables.FakeIPTables {
+	return &testiptables.FakeIPTables{Lines: []byte(util.CreateEmptyChainRule(chain) + "\n" +
+		util.JoinWords("-A", "INPUT", strings.Replace(util.CreateRestrictedPortsMatchRule("", chain, ports), "\"", "", -1)) + "\n")}
+}
+
+// Fake iptables applying restored data line by line to the rules in iptables-save format
+type saveFormatIPTables struct {
+	*testiptables.FakeIPTables
+	restored []byte
+	// Called after every restored line is applied, if set
+	onLine func(line string, tables *fakeTables)
+}
+
+func (f *saveFormatIPTables) RestoreAll(data []byte, _ utiliptables.FlushFlag, _ utiliptables.RestoreCountersFlag) error {
+	f.restored = data
+	tables := parseFakeTables(f.Lines)
+	for _, line := range strings.Split(string(data), "\n") {
+		// iptables-restore is atomic, nothing is applied on error
+		if err := tables.apply(line); err != nil {
+			return err
+		}
+		if f.onLine != nil {
+			f.onLine(line, tables)
+		}
+	}
+	f.Lines = tables.save()
+	return nil
+}
+
+func TestApp_updateTablesKeepsPortsProtected(t *testing.T) {
+	type args struct {
+		oldCfg *AppConfig
+		newCfg *AppConfig
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "networks changed",
+			args: args{oldCfg: NewAppConfig("TEST-CHAIN", []string{"1234", "3456"}, []string{"10.0.0.0/8"}),
+				newCfg: NewAppConfig("TEST-CHAIN", []string{"1234", "3456"}, []string{"192.168.0.0/16"})},
+		},
+		{
+			name: "ports changed",
+			args: args{oldCfg: NewAppConfig("TEST-CHAIN", []string{"1234", "3456"}, []string{"10.0.0.0/8"}),
+				newCfg: NewAppConfig("TEST-CHAIN", []string{"1234", "5678"}, []string{"10.0.0.0/8"})},
+		},
+		{
+			name: "chain name changed",
+			args: args{oldCfg: NewAppConfig("TEST-CHAIN", []string{"1234", "3456"}, []string{"10.0.0.0/8"}),
+				newCfg: NewAppConfig("TEST-CHAIN-2", []string{"1234"}, []string{"192.168.0.0/16"})},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iptables := &saveFormatIPTables{FakeIPTables: testiptables.NewFake()}
+			app := &App{cfg: tt.args.newCfg, iptables: iptables}
+			if err := app.updateTables(nil, tt.args.oldCfg); err != nil {
+				t.Fatalf("App.updateTables() error = %v", err)
+			}
+
+			// Ports restricted by both configs must be protected after every applied line
+			var ports []string
+			newPorts := util.ToSet(tt.args.newCfg.RestrictedPorts)
+			for _, port := range tt.args.oldCfg.RestrictedPorts {
+				if newPorts[port] {
+					ports = append(ports, port)
+				}
+			}
+			iptables.onLine = func(line string, tables *fakeTables) {
+				for _, port := range ports {
+					if !tables.protected(port) {
+						t.Errorf("App.updateTables() port %s is not protected after line '%s'", port, line)
+					}
+				}
+			}
+			if err := app.updateTables(tt.args.oldCfg, tt.args.newCfg); err != nil {
+				t.Fatalf("App.updateTables() error = %v", err)
+			}
+
+			got := app.fetchRunningConfigFromTables()
+			if got == nil || got.IpChainName != tt.args.newCfg.IpChainName ||
+				!reflect.DeepEqual(got.RestrictedPorts, tt.args.newCfg.RestrictedPorts) {
+				t.Fatalf("App.updateTables() running config = %v, want %v", got, tt.args.newCfg)
+			}
+			allowed, _ := util.GetNetworksFromTablesData(iptables.Lines, got.IpChainName)
+			if !reflect.DeepEqual(allowed, tt.args.newCfg.AllowedNetworks) {
+				t.Errorf("App.updateTables() allowed networks = %v, want %v", allowed, tt.args.newCfg.AllowedNetworks)
+			}
+			if strings.Contains(string(iptables.Lines), util.StagingChainName(tt.args.newCfg.IpChainName)) {
+				t.Errorf("App.updateTables() Lines '%s' contain staging chain", iptables.Lines)
+			}
+		})
+	}
+}
+
+func TestApp_updateTablesEditedRules(t *testing.T) {
+	// INPUT rules edited by hand: ports and matches reordered, rule duplicated
+	iptables := &saveFormatIPTables{FakeIPTables: &testiptables.FakeIPTables{Lines: []byte(`:TEST-CHAIN - [0:0]
+-A INPUT -p tcp -m multiport --dports 3456,1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+-A INPUT -p tcp -m comment --comment kube-restrict-ip -m multiport --dports 1234,3456 -j TEST-CHAIN
+-A TEST-CHAIN -s 10.0.0.0/8 -j RETURN
+-A TEST-CHAIN -j REJECT --reject-with icmp-port-unreachable
+`)}}
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234", "5678"}, []string{"10.0.0.0/8"})
+	app := &App{cfg: cfg, iptables: iptables}
+
+	oldCfg := app.fetchRunningConfigFromTables()
+	if oldCfg == nil || !reflect.DeepEqual(oldCfg.RestrictedPorts, []string{"3456", "1234"}) {
+		t.Fatalf("App.fetchRunningConfigFromTables() = %v, want edited rule config", oldCfg)
+	}
+	if err := app.updateTables(oldCfg, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+
+	want := []string{
+		"-A INPUT -p tcp -m multiport --dports 1234,5678 -m comment --comment kube-restrict-ip -j TEST-CHAIN",
+		"-A TEST-CHAIN -s 10.0.0.0/8 -j RETURN",
+		"-A TEST-CHAIN -j REJECT --reject-with icmp-port-unreachable",
+	}
+	if got := util.GetChainRulesFromTablesData(iptables.Lines, "TEST-CHAIN"); !reflect.DeepEqual(got, want) {
+		t.Errorf("App.updateTables() rules = %v, want %v", got, want)
+	}
+}
+
+func TestApp_fetchRunningConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	// Apply config with state file
+	iptables := &saveFormatIPTables{FakeIPTables: testiptables.NewFake()}
+	app := &App{
+		cfg:       NewAppConfig("TEST-CHAIN", nil, nil),
+		iptables:  iptables,
+		stateFile: stateFile,
+	}
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})
+	if err := app.updateTables(nil, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	st, err := state.Load(stateFile)
+	if err != nil || st == nil {
+		t.Fatalf("state.Load() = %v, %v", st, err)
+	}
+	if st.ChainName != "TEST-CHAIN" || !reflect.DeepEqual(st.AllowedNetworks, []string{"10.0.0.0/8"}) {
+		t.Errorf("saved state = %v", st)
+	}
+
+	// Restart with unchanged rules: last applied state is used, with critical sources
+	// rejected by its rules implicitly allowed
+	restartCfg := *cfg
+	restartCfg.CriticalSources = []string{"127.0.0.1", "10.1.2.3"}
+	app = &App{cfg: &restartCfg, iptables: iptables, stateFile: stateFile}
+	if got := app.fetchRunningConfig(); got == nil || got.IpChainName != "TEST-CHAIN" {
+		t.Fatalf("App.fetchRunningConfig() = %v", got)
+	}
+	if app.applied == nil || !reflect.DeepEqual(app.applied.AllowedNetworks, []string{"10.0.0.0/8"}) {
+		t.Errorf("App.fetchRunningConfig() applied = %v, want state config", app.applied)
+	}
+	if !reflect.DeepEqual(app.applied.SafeNetworks, []string{"127.0.0.1"}) {
+		t.Errorf("App.fetchRunningConfig() applied SafeNetworks = %v, want %v", app.applied.SafeNetworks,
+			[]string{"127.0.0.1"})
+	}
+
+	// Restart with modified rules: last applied state is not used
+	iptables.Lines = append(iptables.Lines, []byte("-A TEST-CHAIN -s 192.168.0.0/16 -j RETURN\n")...)
+	app = &App{cfg: cfg, iptables: iptables, stateFile: stateFile}
+	if got := app.fetchRunningConfig(); got == nil {
+		t.Fatalf("App.fetchRunningConfig() = nil")
+	}
+	if app.applied != nil {
+		t.Errorf("App.fetchRunningConfig() applied = %v for modified rules", app.applied)
+	}
+
+	// Restart with changed chain name: rules are migrated from the old chain
+	newCfg := NewAppConfig("TEST-CHAIN-2", []string{"1234"}, []string{"10.0.0.0/8"})
+	app = &App{cfg: newCfg, iptables: iptables, stateFile: stateFile}
+	if got := app.fetchRunningConfig(); got == nil || got.IpChainName != "TEST-CHAIN" {
+		t.Errorf("App.fetchRunningConfig() = %v, want old chain config", got)
+	}
+
+	// Restart with stale chain created by previous runs: chain is cleaned up
+	iptables.Lines = []byte(`:TEST-CHAIN - [0:0]
+:TEST-CHAIN-OLD - [0:0]
+-A INPUT -p tcp -m multiport --dports 5678 -m comment --comment kube-restrict-ip -j TEST-CHAIN-OLD
+-A INPUT -p tcp -m multiport --dports 1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+-A TEST-CHAIN -j REJECT --reject-with icmp-port-unreachable
+`)
+	app = &App{cfg: cfg, iptables: iptables, stateFile: stateFile}
+	oldCfg := app.fetchRunningConfig()
+	if err := app.updateTables(oldCfg, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	want := `*filter
+:TEST-CHAIN-NEW - [0:0]
+-A TEST-CHAIN-NEW -s 10.0.0.0/8 -j RETURN
+-A TEST-CHAIN-NEW -j REJECT --reject-with icmp-port-unreachable
+-I INPUT 1 -p tcp -m multiport --dports 1234 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN-NEW
+-D INPUT -p tcp -m multiport --dports 1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+:TEST-CHAIN - [0:0]
+-X TEST-CHAIN
+-E TEST-CHAIN-NEW TEST-CHAIN
+-D INPUT -p tcp -m multiport --dports 5678 -m comment --comment kube-restrict-ip -j TEST-CHAIN-OLD
+:TEST-CHAIN-OLD - [0:0]
+-X TEST-CHAIN-OLD
+COMMIT
+`
+	if got := string(iptables.restored); got != want {
+		t.Errorf("App.updateTables() Lines '%s', want '%s'", got, want)
+	}
+}
+
+func TestApp_reconcile(t *testing.T) {
+	iptables := &saveFormatIPTables{FakeIPTables: testiptables.NewFake()}
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})
+	app := &App{cfg: cfg, iptables: iptables}
+	if err := app.updateTables(nil, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	applied := iptables.Lines
+
+	// Running rules match the applied ones: nothing is re-applied
+	iptables.restored = nil
+	app.reconcile()
+	if iptables.restored != nil {
+		t.Errorf("App.reconcile() restored '%s' for unchanged rules", iptables.restored)
+	}
+
+	// Rule added to the chain outside of the app: chain rules are re-applied
+	iptables.Lines = append(append([]byte{}, applied...), []byte("-A TEST-CHAIN -s 192.168.0.0/16 -j RETURN\n")...)
+	app.reconcile()
+	want := `*filter
+:TEST-CHAIN-NEW - [0:0]
+-A TEST-CHAIN-NEW -s 10.0.0.0/8 -j RETURN
+-A TEST-CHAIN-NEW -j REJECT --reject-with icmp-port-unreachable
+-I INPUT 1 -p tcp -m multiport --dports 1234 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN-NEW
+-D INPUT -p tcp -m multiport --dports 1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+:TEST-CHAIN - [0:0]
+-X TEST-CHAIN
+-E TEST-CHAIN-NEW TEST-CHAIN
+COMMIT
+`
+	if got := string(iptables.restored); got != want {
+		t.Errorf("App.reconcile() restored '%s', want '%s'", got, want)
+	}
+
+	// Restricted ports rule deleted outside of the app: the rule is re-created
+	iptables.Lines = []byte(`:TEST-CHAIN - [0:0]
+-A TEST-CHAIN -s 10.0.0.0/8 -j RETURN
+-A TEST-CHAIN -j REJECT --reject-with icmp-port-unreachable
+`)
+	app.reconcile()
+	want = `*filter
+:TEST-CHAIN - [0:0]
+-A TEST-CHAIN -s 10.0.0.0/8 -j RETURN
+-A TEST-CHAIN -j REJECT --reject-with icmp-port-unreachable
+-I INPUT 1 -p tcp -m multiport --dports 1234 -m comment --comment "kube-restrict-ip" -j TEST-CHAIN
+COMMIT
+`
+	if got := string(iptables.restored); got != want {
+		t.Errorf("App.reconcile() restored '%s', want '%s'", got, want)
+	}
+}
+
+func TestApp_Cleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	iptables := &saveFormatIPTables{FakeIPTables: testiptables.NewFake()}
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})
+	app := &App{cfg: cfg, iptables: iptables, stateFile: stateFile}
+	if err := app.updateTables(nil, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+
+	if err := app.Cleanup(); err != nil {
+		t.Fatalf("App.Cleanup() error = %v", err)
+	}
+	want := `*filter
+-D INPUT -p tcp -m multiport --dports 1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+:TEST-CHAIN - [0:0]
+-X TEST-CHAIN
+COMMIT
+`
+	if got := string(iptables.restored); got != want {
+		t.Errorf("App.Cleanup() restored '%s', want '%s'", got, want)
+	}
+	if app.applied != nil {
+		t.Errorf("App.Cleanup() applied = %v, want nil", app.applied)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("App.Cleanup() state file is not removed: %v", err)
+	}
+
+	// No rules: nothing to clean up
+	iptables.Lines, iptables.restored = nil, nil
+	if err := app.Cleanup(); err != nil || iptables.restored != nil {
+		t.Errorf("App.Cleanup() error = %v, restored '%s' for no rules", err, iptables.restored)
+	}
+}
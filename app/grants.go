@@ -0,0 +1,244 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/util"
+	"github.com/golang/glog"
+)
+
+// Temporary access grant for allowed network
+type Grant struct {
+	Network string    `json:"network"`
+	Expires time.Time `json:"expires"`
+	Comment string    `json:"comment,omitempty"`
+}
+
+// Store of temporary access grants, optionally persisted to the file
+type GrantStore struct {
+	sync.Mutex
+
+	fileName string
+	maxTtl   time.Duration
+	grants   map[string]Grant
+	now      func() time.Time
+	onChange func()
+}
+
+// Create grants store with maximum grant TTL, grants are persisted to the file, if not empty
+func NewGrantStore(fileName string, maxTtl time.Duration) *GrantStore {
+	return &GrantStore{
+		fileName: fileName,
+		maxTtl:   maxTtl,
+		grants:   map[string]Grant{},
+		now:      time.Now,
+	}
+}
+
+// Load persisted grants, expired ones are dropped
+func (s *GrantStore) Load() error {
+	if s.fileName == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var grants []Grant
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return errors.New(fmt.Sprintf("invalid grants file %s: %v", s.fileName, err))
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	for _, g := range grants {
+		network, err := grantNetwork(g.Network)
+		if err != nil || !g.Expires.After(now) {
+			continue
+		}
+		// Grants of the same network persisted in different forms are merged to the latest expiring one
+		if prev, ok := s.grants[network]; ok && prev.Expires.After(g.Expires) {
+			continue
+		}
+		g.Network = network
+		s.grants[network] = g
+	}
+	glog.V(2).Infof("loaded %d grants from %s", len(s.grants), s.fileName)
+
+	return nil
+}
+
+// Add grant for the network with given TTL, existing grant for the same network is replaced
+func (s *GrantStore) Add(network string, ttl time.Duration, comment string) (Grant, error) {
+	network, err := grantNetwork(network)
+	if err != nil {
+		return Grant{}, err
+	}
+	if ttl <= 0 {
+		return Grant{}, errors.New(fmt.Sprintf("invalid grant TTL: %v", ttl))
+	}
+	if s.maxTtl > 0 && ttl > s.maxTtl {
+		return Grant{}, errors.New(fmt.Sprintf("grant TTL %v exceeds maximum %v", ttl, s.maxTtl))
+	}
+
+	s.Lock()
+	g := Grant{Network: network, Expires: s.now().Add(ttl).Truncate(time.Second), Comment: comment}
+	s.grants[network] = g
+	s.save()
+	s.Unlock()
+
+	glog.Infof("added grant for %s until %v", network, g.Expires)
+	s.changed()
+
+	return g, nil
+}
+
+// Remove grant for the network, returns false if there is no such grant
+func (s *GrantStore) Remove(network string) bool {
+	network, err := grantNetwork(network)
+	if err != nil {
+		return false
+	}
+
+	s.Lock()
+	_, ok := s.grants[network]
+	if ok {
+		delete(s.grants, network)
+		s.save()
+	}
+	s.Unlock()
+
+	if ok {
+		glog.Infof("removed grant for %s", network)
+		s.changed()
+	}
+
+	return ok
+}
+
+// Get grants active at given time, sorted by network
+func (s *GrantStore) List(t time.Time) []Grant {
+	s.Lock()
+	defer s.Unlock()
+
+	grants := []Grant{}
+	for _, g := range s.grants {
+		if g.Expires.After(t) {
+			grants = append(grants, g)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].Network < grants[j].Network
+	})
+
+	return grants
+}
+
+// Get networks of grants active at given time, expired grants are removed
+func (s *GrantStore) Networks(t time.Time) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	var nets []string
+	expired := false
+	for n, g := range s.grants {
+		if g.Expires.After(t) {
+			nets = append(nets, n)
+		} else {
+			glog.Infof("grant for %s expired", n)
+			delete(s.grants, n)
+			expired = true
+		}
+	}
+	if expired {
+		s.save()
+	}
+	sort.Strings(nets)
+
+	return nets
+}
+
+// Get the earliest expiration time of grants active at given time, false if there are no such grants
+func (s *GrantStore) NextExpiry(t time.Time) (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	var next time.Time
+	for _, g := range s.grants {
+		if g.Expires.After(t) && (next.IsZero() || g.Expires.Before(next)) {
+			next = g.Expires
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// Get grant network in canonical CIDR form (e.g. 10.0.0.1/32 for 10.0.0.1),
+// so there is the only grant for the same network
+func grantNetwork(network string) (string, error) {
+	if err := util.ValidateIPv4Networks([]string{network}); err != nil {
+		return "", err
+	}
+	n, err := util.ParseNetwork(network)
+	if err != nil {
+		return "", err
+	}
+	return n.String(), nil
+}
+
+func (s *GrantStore) changed() {
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+// Persist grants to the file, should be called with lock held
+func (s *GrantStore) save() {
+	if s.fileName == "" {
+		return
+	}
+
+	grants := []Grant{}
+	for _, g := range s.grants {
+		grants = append(grants, g)
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].Network < grants[j].Network
+	})
+
+	data, err := json.MarshalIndent(grants, "", "  ")
+	if err == nil {
+		err = util.WriteFileAtomic(s.fileName, data, 0600)
+	}
+	if err != nil {
+		glog.Errorf("can't save grants to %s: %v", s.fileName, err)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	testiptables "k8s.io/kubernetes/pkg/util/iptables/testing"
+)
+
+func TestGrantStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "grants.json")
+
+	now := time.Date(2019, 1, 7, 10, 0, 0, 0, time.UTC)
+	s := NewGrantStore(fileName, 2*time.Hour)
+	s.now = func() time.Time { return now }
+	changes := 0
+	s.onChange = func() { changes++ }
+
+	if _, err := s.Add("10.0.0.1", time.Hour, "on-call"); err != nil {
+		t.Fatalf("GrantStore.Add() error = %v", err)
+	}
+	if _, err := s.Add("10.0.0.0/24", 2*time.Hour, ""); err != nil {
+		t.Fatalf("GrantStore.Add() error = %v", err)
+	}
+	// The same network in CIDR form replaces the grant
+	if g, err := s.Add("10.0.0.1/32", time.Hour, "on-call"); err != nil || g.Network != "10.0.0.1/32" {
+		t.Fatalf("GrantStore.Add() = %v, %v, want grant for 10.0.0.1/32", g, err)
+	}
+	if _, err := s.Add("10.0.0.2", 3*time.Hour, ""); err == nil {
+		t.Errorf("GrantStore.Add() error = nil for TTL exceeding maximum")
+	}
+	if _, err := s.Add("bastion.example.com", time.Hour, ""); err == nil {
+		t.Errorf("GrantStore.Add() error = nil for invalid network")
+	}
+	if changes != 3 {
+		t.Errorf("GrantStore changes = %d, want 3", changes)
+	}
+
+	if got, ok := s.NextExpiry(now); !ok || !got.Equal(now.Add(time.Hour)) {
+		t.Errorf("GrantStore.NextExpiry() = %v, %v, want %v", got, ok, now.Add(time.Hour))
+	}
+	if got := s.Networks(now); !reflect.DeepEqual(got, []string{"10.0.0.0/24", "10.0.0.1/32"}) {
+		t.Errorf("GrantStore.Networks() = %v", got)
+	}
+
+	// Persisted grants are loaded, expired ones are dropped
+	loaded := NewGrantStore(fileName, 0)
+	loaded.now = func() time.Time { return now.Add(time.Hour) }
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("GrantStore.Load() error = %v", err)
+	}
+	want := []Grant{{Network: "10.0.0.0/24", Expires: now.Add(2 * time.Hour)}}
+	if got := loaded.List(now.Add(time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("GrantStore.List() = %v, want %v", got, want)
+	}
+
+	if !s.Remove("10.0.0.1") || s.Remove("10.0.0.1") {
+		t.Errorf("GrantStore.Remove() results are invalid")
+	}
+	if got := s.Networks(now.Add(2 * time.Hour)); got != nil {
+		t.Errorf("GrantStore.Networks() = %v for expired grants", got)
+	}
+
+	// Persisted grants of the same network in different forms are merged
+	data := `[{"network":"10.0.0.5","expires":"2019-01-07T12:00:00Z"},
+{"network":"10.0.0.5/32","expires":"2019-01-07T11:00:00Z"}]`
+	if err := ioutil.WriteFile(fileName, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded = NewGrantStore(fileName, 0)
+	loaded.now = func() time.Time { return now }
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("GrantStore.Load() error = %v", err)
+	}
+	want = []Grant{{Network: "10.0.0.5/32", Expires: now.Add(2 * time.Hour)}}
+	if got := loaded.List(now); !reflect.DeepEqual(got, want) {
+		t.Errorf("GrantStore.List() = %v, want %v", got, want)
+	}
+	if !loaded.Remove("10.0.0.5") {
+		t.Errorf("GrantStore.Remove() = false for the network in address form")
+	}
+}
+
+func TestApp_updateTablesWithGrants(t *testing.T) {
+	now := time.Date(2019, 1, 7, 10, 0, 0, 0, time.UTC)
+	grants := NewGrantStore("", 0)
+	grants.now = func() time.Time { return now }
+	if _, err := grants.Add("192.168.1.1", time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{
+		cfg:      NewAppConfig("TEST-CHAIN", nil, nil),
+		iptables: testiptables.NewFake(),
+		now:      func() time.Time { return now },
+	}
+	app.SetGrantStore(grants)
+
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})
+	if err := app.updateTables(nil, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	got := string(app.iptables.(*testiptables.FakeIPTables).Lines)
+	if !strings.Contains(got, "-A TEST-CHAIN -s 192.168.1.1 -j RETURN\n") {
+		t.Errorf("App.updateTables() Lines '%s' has no grant rule", got)
+	}
+
+	now = now.Add(time.Hour)
+	if err := app.updateTables(cfg, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	got = string(app.iptables.(*testiptables.FakeIPTables).Lines)
+	if strings.Contains(got, "192.168.1.1") {
+		t.Errorf("App.updateTables() Lines '%s' has expired grant rule", got)
+	}
+}
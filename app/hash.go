@@ -0,0 +1,92 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/state"
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+// Normalized config representation for hashing
+type normalizedConfig struct {
+	IpChainName        string
+	RestrictedPorts    []string
+	AllowedNetworks    []string
+	ScheduledNetworks  []string
+	DeniedNetworks     []string
+	Action             string
+	RejectWith         string
+	DnsRefreshInterval time.Duration
+	Verify             *VerifyConfig
+	StartupPolicy      string `json:",omitempty"`
+}
+
+// Get hash of the normalized config. Lists are sorted, since their order doesn't affect
+// the rules, and networks are aggregated the same way as for the rules, so redundant
+// networks don't change the hash. Implicitly allowed critical sources are node-specific,
+// so they are not hashed
+func (cfg *AppConfig) Hash() string {
+	n := normalizedConfig{
+		IpChainName:        cfg.IpChainName,
+		RestrictedPorts:    sortedCopy(cfg.RestrictedPorts),
+		AllowedNetworks:    aggregatedCopy(cfg.AllowedNetworks),
+		DeniedNetworks:     aggregatedCopy(cfg.DeniedNetworks),
+		Action:             cfg.RejectAction.Target,
+		RejectWith:         cfg.RejectAction.RejectWith,
+		DnsRefreshInterval: cfg.DnsRefreshInterval,
+		StartupPolicy:      cfg.StartupPolicy,
+	}
+	for _, sn := range cfg.ScheduledNetworks {
+		n.ScheduledNetworks = append(n.ScheduledNetworks, sn.String())
+	}
+	sort.Strings(n.ScheduledNetworks)
+	if cfg.Verify != nil {
+		n.Verify = &VerifyConfig{
+			Sources:     sortedCopy(cfg.Verify.Sources),
+			Endpoints:   sortedCopy(cfg.Verify.Endpoints),
+			GracePeriod: cfg.Verify.GracePeriod,
+		}
+	}
+
+	data, _ := json.Marshal(n)
+	return state.Hash(data)
+}
+
+// Checks configs are equal, including implicitly allowed critical sources
+func (cfg *AppConfig) Equal(other *AppConfig) bool {
+	return cfg.Hash() == other.Hash() && util.Matched(cfg.SafeNetworks, other.SafeNetworks)
+}
+
+func sortedCopy(a []string) []string {
+	if len(a) == 0 {
+		return nil
+	}
+	c := append([]string{}, a...)
+	sort.Strings(c)
+	return c
+}
+
+// Get aggregated networks list, host names are kept sorted at the end of the list
+func aggregatedCopy(nets []string) []string {
+	if len(nets) == 0 {
+		return nil
+	}
+	aggregated, _ := util.AggregateNetworks(sortedCopy(nets))
+	return aggregated
+}
@@ -0,0 +1,99 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+func TestAppConfig_Equal(t *testing.T) {
+	schedule, err := util.ParseSchedule("* 9-17 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCfg := func(ports, nets []string) *AppConfig {
+		cfg := NewAppConfig("TEST-CHAIN", ports, nets)
+		cfg.ScheduledNetworks = []ScheduledNetwork{{Network: "192.168.5.0/24", Schedule: schedule}}
+		cfg.DnsRefreshInterval = 5 * time.Minute
+		return cfg
+	}
+	type args struct {
+		cfg   *AppConfig
+		other *AppConfig
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{
+			name: "same",
+			args: args{cfg: newCfg([]string{"1234"}, []string{"10.0.0.0/8"}),
+				other: newCfg([]string{"1234"}, []string{"10.0.0.0/8"})},
+			want: true,
+		},
+		{
+			name: "different order",
+			args: args{cfg: newCfg([]string{"1234", "4567"}, []string{"10.0.0.0/8", "192.168.1.1"}),
+				other: newCfg([]string{"4567", "1234"}, []string{"192.168.1.1", "10.0.0.0/8"})},
+			want: true,
+		},
+		{
+			name: "different networks",
+			args: args{cfg: newCfg([]string{"1234"}, []string{"10.0.0.0/8"}),
+				other: newCfg([]string{"1234"}, []string{"10.0.0.0/9"})},
+			want: false,
+		},
+		{
+			name: "redundant networks",
+			args: args{cfg: newCfg([]string{"1234"}, []string{"10.0.0.0/8", "bastion.example.com"}),
+				other: newCfg([]string{"1234"}, []string{"bastion.example.com", "10.1.0.0/16", "10.0.0.0/9",
+					"10.128.0.0/9"})},
+			want: true,
+		},
+		{
+			name: "different scheduled networks",
+			args: args{cfg: newCfg([]string{"1234"}, []string{"10.0.0.0/8"}),
+				other: NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})},
+			want: false,
+		},
+		{
+			name: "different safe networks",
+			args: args{cfg: newCfg([]string{"1234"}, []string{"10.0.0.0/8"}),
+				other: &AppConfig{IpChainName: "TEST-CHAIN", RestrictedPorts: []string{"1234"},
+					AllowedNetworks: []string{"10.0.0.0/8"}, ScheduledNetworks: newCfg(nil, nil).ScheduledNetworks,
+					DnsRefreshInterval: 5 * time.Minute, SafeNetworks: []string{"127.0.0.1"}}},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.args.cfg.Equal(tt.args.other); got != tt.want {
+				t.Errorf("AppConfig.Equal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Implicitly allowed critical sources are node-specific, so they are not hashed
+	cfg := newCfg([]string{"1234"}, []string{"10.0.0.0/8"})
+	hash := cfg.Hash()
+	cfg.SafeNetworks = []string{"127.0.0.1"}
+	if got := cfg.Hash(); got != hash {
+		t.Errorf("AppConfig.Hash() = %v, want %v", got, hash)
+	}
+}
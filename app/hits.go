@@ -0,0 +1,177 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/3cky/kube-restrict-ip/metrics"
+	"github.com/3cky/kube-restrict-ip/state"
+)
+
+const (
+	DefaultStaleWindow = 90 * 24 * time.Hour
+
+	// Resolution of the allowed entries last hit times, to limit state file updates
+	hitsResolution = time.Hour
+)
+
+// Allowed networks config entry without hits over the stale window
+type StaleEntry struct {
+	Entry     string     `json:"entry"`
+	FirstSeen time.Time  `json:"firstSeen"`
+	LastHit   *time.Time `json:"lastHit,omitempty"`
+	// The entry shares the rule with other entries and the rule has hits over the window,
+	// so the entry may be stale, but it can't be told
+	Ambiguous bool `json:"ambiguous,omitempty"`
+}
+
+// Set window allowed networks config entries without hits over are reported stale
+func (app *App) SetStaleWindow(window time.Duration) {
+	app.staleWindow = window
+}
+
+// Get allowed networks config entries without hits over the window, sorted by entry.
+// Ambiguous entries with shared rule hits over the window are reported as ambiguous.
+// Entries tracked for less than the window are not reported
+func StaleEntries(hits map[string]*state.EntryHits, now time.Time, window time.Duration) []StaleEntry {
+	var stale []StaleEntry
+	for e, h := range hits {
+		since := h.FirstSeen
+		if h.LastHit != nil {
+			since = *h.LastHit
+		}
+		switch {
+		case now.Sub(since) >= window:
+			stale = append(stale, StaleEntry{Entry: e, FirstSeen: h.FirstSeen, LastHit: h.LastHit})
+		case h.Ambiguous && now.Sub(h.FirstSeen) >= window:
+			stale = append(stale, StaleEntry{Entry: e, FirstSeen: h.FirstSeen, LastHit: h.LastHit, Ambiguous: true})
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].Entry < stale[j].Entry
+	})
+	return stale
+}
+
+// Update allowed networks config entries hits from the running rules status and
+// report stale entries metrics. Returns true if entries hits are changed
+func (app *App) updateHits(st *Status) bool {
+	now := app.currentTime().UTC()
+
+	changed := false
+	if app.hits == nil {
+		app.hits = map[string]*state.EntryHits{}
+	}
+
+	// Track new allowed entries, forget removed ones
+	tracked := map[string]bool{}
+	for _, e := range app.cfg.AllowedNetworks {
+		tracked[e] = true
+	}
+	for _, n := range app.cfg.ScheduledNetworks {
+		tracked[n.Network] = true
+	}
+	for e := range tracked {
+		if app.hits[e] == nil {
+			app.hits[e] = &state.EntryHits{FirstSeen: now}
+			changed = true
+		}
+	}
+	for e := range app.hits {
+		if !tracked[e] {
+			delete(app.hits, e)
+			changed = true
+		}
+	}
+
+	// Rules counters are only known to be increased since the last seen values or since the rules
+	// were applied, counters seen for the first time after start are used as the baseline
+	baseline := app.rulePackets == nil
+	packets := map[string]uint64{}
+	var hitRules []string
+	for _, r := range st.Rules {
+		if r.Kind != RuleKindAllowed {
+			continue
+		}
+		packets[r.Network] = r.Packets
+		if !baseline && r.Packets > app.rulePackets[r.Network] {
+			hitRules = append(hitRules, r.Network)
+		}
+	}
+	app.rulePackets = packets
+
+	// Rules matching several entries (e.g. aggregated networks) can't tell which of them are hit
+	entries := app.configEntries()[RuleKindAllowed]
+	ambiguous := map[string]bool{}
+	for _, r := range st.Rules {
+		if matched := matchEntries(r.Network, entries); r.Kind == RuleKindAllowed && len(matched) > 1 {
+			for _, e := range matched {
+				ambiguous[e] = true
+			}
+		}
+	}
+	for e, h := range app.hits {
+		if h.Ambiguous != ambiguous[e] {
+			h.Ambiguous = ambiguous[e]
+			changed = true
+		}
+	}
+
+	if len(hitRules) > 0 {
+		hit := now.Truncate(hitsResolution)
+		for _, n := range hitRules {
+			for _, e := range matchEntries(n, entries) {
+				if h := app.hits[e]; h != nil && (h.LastHit == nil || hit.After(*h.LastHit)) {
+					h.LastHit = &hit
+					changed = true
+				}
+			}
+		}
+	}
+
+	if app.staleWindow > 0 {
+		var stale []string
+		for _, e := range StaleEntries(app.hits, now, app.staleWindow) {
+			if !e.Ambiguous {
+				stale = append(stale, e.Entry)
+			}
+		}
+		metrics.SetStaleEntries(stale)
+	}
+
+	return changed
+}
+
+// Persist allowed networks config entries hits to the state file, if defined and already saved
+func (app *App) saveHits() {
+	if app.stateFile == "" {
+		return
+	}
+	st, err := state.Load(app.stateFile)
+	if err != nil || st == nil {
+		if err != nil {
+			glog.Errorf("can't load state file: %v", err)
+		}
+		return
+	}
+	st.Hits = app.hits
+	if err := st.Save(app.stateFile); err != nil {
+		glog.Errorf("can't save state file: %v", err)
+	}
+}
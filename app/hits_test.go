@@ -0,0 +1,207 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/state"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+	testiptables "k8s.io/kubernetes/pkg/util/iptables/testing"
+)
+
+func TestStaleEntries(t *testing.T) {
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	lastHit := t0.Add(48 * time.Hour)
+	hits := map[string]*state.EntryHits{
+		"10.0.0.0/8":     {FirstSeen: t0, LastHit: &lastHit},
+		"192.168.0.0/16": {FirstSeen: t0},
+		"example.com":    {FirstSeen: t0.Add(72 * time.Hour)},
+		"10.1.0.0/16":    {FirstSeen: t0, LastHit: &lastHit, Ambiguous: true},
+	}
+	tests := []struct {
+		name string
+		now  time.Time
+		want []StaleEntry
+	}{
+		{name: "none", now: t0.Add(24 * time.Hour)},
+		{name: "never hit", now: t0.Add(48 * time.Hour),
+			want: []StaleEntry{
+				{Entry: "10.1.0.0/16", FirstSeen: t0, LastHit: &lastHit, Ambiguous: true},
+				{Entry: "192.168.0.0/16", FirstSeen: t0},
+			}},
+		{name: "all", now: t0.Add(120 * time.Hour),
+			want: []StaleEntry{
+				{Entry: "10.0.0.0/8", FirstSeen: t0, LastHit: &lastHit},
+				{Entry: "10.1.0.0/16", FirstSeen: t0, LastHit: &lastHit},
+				{Entry: "192.168.0.0/16", FirstSeen: t0},
+				{Entry: "example.com", FirstSeen: t0.Add(72 * time.Hour)},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StaleEntries(hits, tt.now, 48*time.Hour); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StaleEntries() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApp_updateHits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := t0
+	var counters string
+	setCounters := func(allowed, other uint64) {
+		counters = fmt.Sprintf(`[%d:0] -A INPUT -p tcp -m multiport --dports 1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+[%d:0] -A TEST-CHAIN -s 10.0.0.0/8 -j RETURN
+[%d:0] -A TEST-CHAIN -s 192.168.1.0/24 -j RETURN
+[0:0] -A TEST-CHAIN -j REJECT --reject-with icmp-port-unreachable
+`, allowed+other, allowed, other)
+	}
+
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8", "192.168.1.0/24"})
+	newTestApp := func() *App {
+		return &App{
+			cfg:           cfg,
+			iptables:      &saveFormatIPTables{FakeIPTables: testiptables.NewFake()},
+			stateFile:     stateFile,
+			statsInterval: time.Minute,
+			now:           func() time.Time { return now },
+			saveCounters: func(_ utiliptables.Table, buffer *bytes.Buffer) error {
+				buffer.WriteString(counters)
+				return nil
+			},
+		}
+	}
+
+	app := newTestApp()
+	if err := app.updateTables(app.fetchRunningConfig(), cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+
+	// Allowed network rule hit
+	now = t0.Add(90 * time.Minute)
+	setCounters(5, 0)
+	app.updateRuleStats()
+
+	// Counters are reset by resync, hits are counted since the reset
+	now = t0.Add(2 * time.Hour)
+	if err := app.updateTables(cfg, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	now = t0.Add(3*time.Hour + 30*time.Minute)
+	setCounters(2, 0)
+	app.updateRuleStats()
+
+	// Entries are tracked since the first counters reading
+	firstSeen := t0.Add(90 * time.Minute)
+	lastHit := t0.Add(3 * time.Hour)
+	want := map[string]*state.EntryHits{
+		"10.0.0.0/8":     {FirstSeen: firstSeen, LastHit: &lastHit},
+		"192.168.1.0/24": {FirstSeen: firstSeen},
+	}
+	st, err := state.Load(stateFile)
+	if err != nil || st == nil {
+		t.Fatalf("state.Load() = %v, %v", st, err)
+	}
+	if !reflect.DeepEqual(st.Hits, want) {
+		t.Errorf("saved hits = %v, want %v", st.Hits, want)
+	}
+
+	// Hits are restored on restart, counters seen first time are the baseline
+	app = newTestApp()
+	app.fetchRunningConfig()
+	now = t0.Add(5 * time.Hour)
+	setCounters(2, 3)
+	app.updateRuleStats()
+	if !reflect.DeepEqual(app.hits, want) {
+		t.Errorf("restored hits = %v, want %v", app.hits, want)
+	}
+	setCounters(2, 4)
+	app.updateRuleStats()
+	if h := app.hits["192.168.1.0/24"]; h.LastHit == nil || !h.LastHit.Equal(t0.Add(5*time.Hour)) {
+		t.Errorf("hits = %v, want last hit at %v", h, t0.Add(5*time.Hour))
+	}
+}
+
+func TestApp_updateHitsAmbiguous(t *testing.T) {
+	t0 := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := t0
+	var counters string
+	setCounters := func(allowed uint64) {
+		counters = fmt.Sprintf(`[%d:0] -A INPUT -p tcp -m multiport --dports 1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+[%d:0] -A TEST-CHAIN -s 10.0.0.0/8 -j RETURN
+[0:0] -A TEST-CHAIN -s 192.168.1.0/24 -j RETURN
+[0:0] -A TEST-CHAIN -j REJECT --reject-with icmp-port-unreachable
+`, allowed, allowed)
+	}
+
+	// 10.1.0.0/16 is aggregated to 10.0.0.0/8 rule
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.1.0/24"})
+	app := &App{
+		cfg:           cfg,
+		iptables:      &saveFormatIPTables{FakeIPTables: testiptables.NewFake()},
+		statsInterval: time.Minute,
+		now:           func() time.Time { return now },
+		saveCounters: func(_ utiliptables.Table, buffer *bytes.Buffer) error {
+			buffer.WriteString(counters)
+			return nil
+		},
+	}
+	if err := app.updateTables(app.fetchRunningConfig(), cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+
+	setCounters(0)
+	app.updateRuleStats()
+	now = t0.Add(90 * time.Minute)
+	setCounters(5)
+	app.updateRuleStats()
+
+	lastHit := t0.Add(time.Hour)
+	want := map[string]*state.EntryHits{
+		"10.0.0.0/8":     {FirstSeen: t0, LastHit: &lastHit, Ambiguous: true},
+		"10.1.0.0/16":    {FirstSeen: t0, LastHit: &lastHit, Ambiguous: true},
+		"192.168.1.0/24": {FirstSeen: t0},
+	}
+	if !reflect.DeepEqual(app.hits, want) {
+		t.Errorf("hits = %v, want %v", app.hits, want)
+	}
+
+	// Shared rule hits don't make the entries surely used
+	stale := StaleEntries(app.hits, t0.Add(90*time.Minute), time.Hour)
+	wantStale := []StaleEntry{
+		{Entry: "10.0.0.0/8", FirstSeen: t0, LastHit: &lastHit, Ambiguous: true},
+		{Entry: "10.1.0.0/16", FirstSeen: t0, LastHit: &lastHit, Ambiguous: true},
+		{Entry: "192.168.1.0/24", FirstSeen: t0},
+	}
+	if !reflect.DeepEqual(stale, wantStale) {
+		t.Errorf("StaleEntries() = %+v, want %+v", stale, wantStale)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+// Check restricted ports are not restricted by other app instances running on the node
+func checkInstancesConflicts(data []byte, instance string, ports []string) error {
+	instances := util.GetOtherInstancesPortsFromTablesData(data, instance)
+
+	var conflicts []string
+	for _, p := range ports {
+		if i, ok := instances[p]; ok {
+			conflicts = append(conflicts, fmt.Sprintf("%s (instance %s)", p, instanceName(i)))
+		}
+	}
+	if len(conflicts) > 0 {
+		return errors.New(fmt.Sprintf("restricted ports are already restricted by other instances: %s",
+			strings.Join(conflicts, ", ")))
+	}
+
+	return nil
+}
+
+// Get app instance name for logging
+func instanceName(instance string) string {
+	if instance == "" {
+		return "default"
+	}
+	return instance
+}
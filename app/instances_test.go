@@ -0,0 +1,87 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/3cky/kube-restrict-ip/util"
+	testiptables "k8s.io/kubernetes/pkg/util/iptables/testing"
+)
+
+func TestApp_instances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	iptables := &saveFormatIPTables{FakeIPTables: testiptables.NewFake()}
+
+	// Default instance
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})
+	app := &App{cfg: cfg, iptables: iptables, stateFile: filepath.Join(dir, "state.json")}
+	if err := app.updateTables(app.fetchRunningConfig(), cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+
+	// Other instance: rules of default instance are neither used nor cleaned up
+	instanceChain := util.InstanceChainName("TEST-CHAIN", "team-a")
+	instanceCfg := NewAppConfig(instanceChain, []string{"5678"}, []string{"192.168.0.0/16"})
+	instanceApp := &App{cfg: instanceCfg, iptables: iptables, instance: "team-a",
+		stateFile: filepath.Join(dir, "state-team-a.json")}
+	if got := instanceApp.fetchRunningConfig(); got != nil {
+		t.Errorf("App.fetchRunningConfig() = %v for other instance rules", got)
+	}
+	if len(instanceApp.staleChains) > 0 {
+		t.Errorf("App.fetchRunningConfig() stale chains = %v for other instance rules", instanceApp.staleChains)
+	}
+	if err := instanceApp.updateTables(nil, instanceCfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+
+	// Restart of default instance: rules of other instance are kept
+	newCfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"172.16.0.0/12"})
+	app = &App{cfg: newCfg, iptables: iptables, stateFile: filepath.Join(dir, "state.json")}
+	if err := app.updateTables(app.fetchRunningConfig(), newCfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	if got := util.GetRestrictedPortsFromTablesData(iptables.Lines, instanceChain); !reflect.DeepEqual(got, []string{"5678"}) {
+		t.Errorf("App.updateTables() other instance restricted ports = %v, want [5678]", got)
+	}
+	if got, _ := util.GetNetworksFromTablesData(iptables.Lines, instanceChain); !reflect.DeepEqual(got, []string{"192.168.0.0/16"}) {
+		t.Errorf("App.updateTables() other instance allowed networks = %v, want [192.168.0.0/16]", got)
+	}
+
+	// Port restricted by default instance: conflict detected, nothing applied
+	conflictCfg := NewAppConfig(instanceChain, []string{"1234", "5678"}, []string{"192.168.0.0/16"})
+	if err := instanceApp.updateTables(instanceCfg, conflictCfg); err == nil {
+		t.Errorf("App.updateTables() error = nil for port restricted by other instance")
+	}
+	if got := util.GetRestrictedPortsFromTablesData(iptables.Lines, instanceChain); !reflect.DeepEqual(got, []string{"5678"}) {
+		t.Errorf("App.updateTables() other instance restricted ports = %v, want [5678]", got)
+	}
+
+	// State file of default instance is not used by other instance
+	instanceApp = &App{cfg: instanceCfg, iptables: iptables, instance: "team-a",
+		stateFile: filepath.Join(dir, "state.json")}
+	if instanceApp.fetchRunningConfig(); instanceApp.applied != nil {
+		t.Errorf("App.fetchRunningConfig() applied = %v from other instance state", instanceApp.applied)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/util"
+	"github.com/golang/glog"
+)
+
+const (
+	DefaultDnsRefreshInterval = 5 * time.Minute
+
+	dnsLookupTimeout = 10 * time.Second
+)
+
+// Resolver looks up IP addresses of the host names, implemented by net.Resolver
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// Cache of resolved IP addresses of host names used in allowed networks
+type hostCache struct {
+	sync.Mutex
+
+	resolver Resolver
+	interval time.Duration
+	hosts    []string
+	addrs    map[string][]string
+}
+
+func newHostCache(resolver Resolver) *hostCache {
+	return &hostCache{
+		resolver: resolver,
+		interval: DefaultDnsRefreshInterval,
+		addrs:    map[string][]string{},
+	}
+}
+
+// Get host names from networks list
+func getHosts(nets []string) []string {
+	var hosts []string
+	for _, n := range nets {
+		if util.IsHostname(n) {
+			hosts = append(hosts, n)
+		}
+	}
+	return hosts
+}
+
+// Update host names to resolve and refresh interval according to the config,
+// resolving the host names not resolved yet and removing the ones not in the config
+func (c *hostCache) update(cfg *AppConfig) {
+	hosts := getHosts(cfg.AllowedNetworks)
+	for _, n := range cfg.ScheduledNetworks {
+		hosts = append(hosts, getHosts([]string{n.Network})...)
+	}
+
+	c.Lock()
+	c.hosts = hosts
+	if c.interval = cfg.DnsRefreshInterval; c.interval <= 0 {
+		c.interval = DefaultDnsRefreshInterval
+	}
+	known := map[string]bool{}
+	var unresolved []string
+	for _, h := range hosts {
+		known[h] = true
+		if _, ok := c.addrs[h]; !ok {
+			unresolved = append(unresolved, h)
+		}
+	}
+	for h := range c.addrs {
+		if !known[h] {
+			glog.V(2).Infof("host %s removed from config, addresses %v dropped", h, c.addrs[h])
+			delete(c.addrs, h)
+		}
+	}
+	c.Unlock()
+
+	for _, h := range unresolved {
+		c.resolve(h)
+	}
+}
+
+// Re-resolve all host names, returns true if any of resolved addresses changed
+func (c *hostCache) refresh() bool {
+	c.Lock()
+	hosts := c.hosts
+	c.Unlock()
+
+	changed := false
+	for _, h := range hosts {
+		if c.resolve(h) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Resolve host name IPv4 addresses, returns true if addresses changed.
+// Last known addresses are kept if host name can't be resolved.
+func (c *hostCache) resolve(host string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		glog.Errorf("can't resolve host %s: %v", host, err)
+		return false
+	}
+
+	var ips []string
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	if len(ips) == 0 {
+		glog.Errorf("no IPv4 addresses resolved for host %s", host)
+		return false
+	}
+	sort.Strings(ips)
+
+	c.Lock()
+	defer c.Unlock()
+
+	old, ok := c.addrs[host]
+	if ok && reflect.DeepEqual(old, ips) {
+		return false
+	}
+	glog.Infof("host %s resolved to %v", host, ips)
+	c.addrs[host] = ips
+	return true
+}
+
+// Replace host names in networks list with their resolved addresses,
+// host names not resolved yet are skipped
+func (c *hostCache) expand(nets []string) []string {
+	c.Lock()
+	defer c.Unlock()
+
+	var res []string
+	for _, n := range nets {
+		if !util.IsHostname(n) {
+			res = append(res, n)
+			continue
+		}
+		addrs, ok := c.addrs[n]
+		if !ok {
+			glog.Warningf("host %s is not resolved, skipped", n)
+			continue
+		}
+		res = append(res, addrs...)
+	}
+	return res
+}
+
+func (c *hostCache) refreshInterval() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	return c.interval
+}
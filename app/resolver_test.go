@@ -0,0 +1,108 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	testiptables "k8s.io/kubernetes/pkg/util/iptables/testing"
+)
+
+type fakeResolver struct {
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestHostCache_expand(t *testing.T) {
+	r := &fakeResolver{hosts: map[string][]string{
+		"bastion.example.com": {"10.0.0.2", "10.0.0.1", "fd00::1"},
+	}}
+	c := newHostCache(r)
+	c.update(NewAppConfig("TEST-CHAIN", nil, []string{"127.0.0.1", "bastion.example.com", "unknown.example.com"}))
+
+	got := c.expand([]string{"127.0.0.1", "bastion.example.com", "unknown.example.com"})
+	want := []string{"127.0.0.1", "10.0.0.1", "10.0.0.2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hostCache.expand() = %v, want %v", got, want)
+	}
+}
+
+func TestHostCache_refresh(t *testing.T) {
+	r := &fakeResolver{hosts: map[string][]string{
+		"bastion.example.com": {"10.0.0.1"},
+	}}
+	c := newHostCache(r)
+	c.update(NewAppConfig("TEST-CHAIN", nil, []string{"bastion.example.com"}))
+
+	if c.refresh() {
+		t.Errorf("hostCache.refresh() = true for unchanged addresses")
+	}
+
+	r.hosts["bastion.example.com"] = []string{"10.0.0.3"}
+	if !c.refresh() {
+		t.Errorf("hostCache.refresh() = false for changed addresses")
+	}
+
+	// Last known addresses are kept on resolution errors
+	delete(r.hosts, "bastion.example.com")
+	if c.refresh() {
+		t.Errorf("hostCache.refresh() = true for failed resolution")
+	}
+	if got := c.expand([]string{"bastion.example.com"}); !reflect.DeepEqual(got, []string{"10.0.0.3"}) {
+		t.Errorf("hostCache.expand() = %v, want last known addresses", got)
+	}
+}
+
+func TestHostCache_update(t *testing.T) {
+	r := &fakeResolver{hosts: map[string][]string{
+		"bastion.example.com": {"10.0.0.1"},
+		"monitor.example.com": {"10.0.0.2"},
+	}}
+	c := newHostCache(r)
+	c.update(NewAppConfig("TEST-CHAIN", nil, []string{"bastion.example.com", "monitor.example.com"}))
+	c.update(NewAppConfig("TEST-CHAIN", nil, []string{"monitor.example.com"}))
+
+	want := map[string][]string{"monitor.example.com": {"10.0.0.2"}}
+	if !reflect.DeepEqual(c.addrs, want) {
+		t.Errorf("hostCache.addrs = %v, want %v", c.addrs, want)
+	}
+}
+
+func TestApp_updateTablesWithHosts(t *testing.T) {
+	app := &App{
+		cfg:      NewAppConfig("TEST-CHAIN", nil, nil),
+		iptables: testiptables.NewFake(),
+		resolver: &fakeResolver{hosts: map[string][]string{"bastion.example.com": {"10.0.0.1"}}},
+	}
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"bastion.example.com"})
+	if err := app.updateTables(nil, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	got := string(app.iptables.(*testiptables.FakeIPTables).Lines)
+	if !strings.Contains(got, "-A TEST-CHAIN -s 10.0.0.1 -j RETURN\n") {
+		t.Errorf("App.updateTables() Lines '%s' has no resolved host rule", got)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/3cky/kube-restrict-ip/util"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+// Get running config parsed back from the chain rules, nil if rules not found.
+// Implicitly allowed critical sources are reported as allowed networks
+func (app *App) RunningConfig() (*AppConfig, error) {
+	data, err := app.saveTables()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := runningConfigFromTablesData(data, app.cfg.IpChainName)
+	if cfg == nil {
+		return nil, nil
+	}
+	cfg.AllowedNetworks, cfg.DeniedNetworks = util.GetNetworksFromTablesData(data, cfg.IpChainName)
+
+	return cfg, nil
+}
+
+// Get running chain rules and INPUT rules redirecting restricted ports to the chain,
+// in iptables-save format
+func (app *App) RunningRules() ([]string, error) {
+	data, err := app.saveTables()
+	if err != nil {
+		return nil, err
+	}
+	return util.GetChainRulesFromTablesData(data, app.cfg.IpChainName), nil
+}
+
+// Get chain rules and INPUT rules redirecting restricted ports to the chain to be applied
+// for the config, in iptables-save format
+func (app *App) PlannedRules() []string {
+	// INPUT rules are listed first, as in iptables-save output
+	var inputRules, chainRules []string
+	for _, line := range strings.Split(string(app.createTablesRestoreData(nil, nil, app.effectiveConfig(app.cfg))), "\n") {
+		if strings.HasPrefix(line, "-I ") {
+			inputRules = append(inputRules, util.NormalizeRule(line))
+		} else if strings.HasPrefix(line, "-A ") {
+			chainRules = append(chainRules, util.NormalizeRule(line))
+		}
+	}
+	return append(inputRules, chainRules...)
+}
+
+func (app *App) saveTables() ([]byte, error) {
+	d := bytes.NewBuffer(nil)
+	if err := app.iptables.SaveInto(utiliptables.TableFilter, d); err != nil {
+		return nil, err
+	}
+	return d.Bytes(), nil
+}
@@ -0,0 +1,71 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/3cky/kube-restrict-ip/util"
+	testiptables "k8s.io/kubernetes/pkg/util/iptables/testing"
+)
+
+func TestApp_RunningConfig(t *testing.T) {
+	iptables := &saveFormatIPTables{FakeIPTables: testiptables.NewFake()}
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})
+	cfg.DeniedNetworks = []string{"10.1.0.0/16"}
+	app := &App{cfg: cfg, iptables: iptables}
+
+	if got, err := app.RunningConfig(); err != nil || got != nil {
+		t.Errorf("App.RunningConfig() = %v, %v, want nil", got, err)
+	}
+
+	if err := app.updateTables(nil, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	got, err := app.RunningConfig()
+	if err != nil {
+		t.Fatalf("App.RunningConfig() error = %v", err)
+	}
+	want := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})
+	want.DeniedNetworks = []string{"10.1.0.0/16"}
+	want.RejectAction = util.RejectAction{Target: "REJECT", RejectWith: "icmp-port-unreachable"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("App.RunningConfig() = %+v, want %+v", got, want)
+	}
+}
+
+func TestApp_PlannedRules(t *testing.T) {
+	iptables := &saveFormatIPTables{FakeIPTables: testiptables.NewFake()}
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8", "10.1.0.0/16"})
+	app := &App{cfg: cfg, iptables: iptables}
+
+	want := []string{
+		"-A INPUT -p tcp -m multiport --dports 1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN",
+		"-A TEST-CHAIN -s 10.0.0.0/8 -j RETURN",
+		"-A TEST-CHAIN -j REJECT --reject-with icmp-port-unreachable",
+	}
+	if got := app.PlannedRules(); !reflect.DeepEqual(got, want) {
+		t.Errorf("App.PlannedRules() = %q, want %q", got, want)
+	}
+
+	// Planned rules match the running ones once applied
+	if err := app.updateTables(nil, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	if got, err := app.RunningRules(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("App.RunningRules() = %q, %v, want %q", got, err, want)
+	}
+}
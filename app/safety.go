@@ -0,0 +1,175 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/3cky/kube-restrict-ip/util"
+	"github.com/golang/glog"
+)
+
+// Safety modes for critical sources rejected by config rules
+const (
+	// Implicitly allow rejected critical sources
+	SafetyAllow = "allow"
+	// Refuse config rejecting critical sources
+	SafetyRefuse = "refuse"
+	// Don't check critical sources
+	SafetyOff = "off"
+)
+
+const loopbackAddress = "127.0.0.1"
+
+// Environment variables with in-cluster API server service address and port
+const (
+	apiServerHostEnv = "KUBERNETES_SERVICE_HOST"
+	apiServerPortEnv = "KUBERNETES_SERVICE_PORT"
+)
+
+// Get in-cluster API server endpoint addresses, replaced in tests
+var apiServerEndpoints = func(address string) ([]string, error) {
+	return util.APIServerEndpoints(address, util.ServiceAccountDir)
+}
+
+// Get critical source addresses: loopback, node own IPv4 addresses, API server addresses
+// (see APIServerSources) and the extra ones
+func CriticalSources(extra []string, kubeconfig string) []string {
+	sources := []string{loopbackAddress}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		glog.Errorf("can't get node addresses: %v", err)
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+			sources = append(sources, ipNet.IP.String())
+		}
+	}
+
+	sources = append(sources, APIServerSources(kubeconfig)...)
+
+	return append(sources, extra...)
+}
+
+// Get API server IPv4 addresses the traffic to the node comes from: in-cluster API server endpoints
+// ('kubernetes' service ones, as the service address itself is never the source) and the server
+// of the kubeconfig file current context, if the file is defined
+func APIServerSources(kubeconfig string) []string {
+	var hosts []string
+	if host := os.Getenv(apiServerHostEnv); host != "" {
+		port := os.Getenv(apiServerPortEnv)
+		if port == "" {
+			port = "443"
+		}
+		endpoints, err := apiServerEndpoints(net.JoinHostPort(host, port))
+		if err != nil {
+			glog.Errorf("can't get in-cluster API server endpoints: %v", err)
+		}
+		hosts = append(hosts, endpoints...)
+	}
+	if kubeconfig != "" {
+		host, err := util.KubeconfigServerHost(kubeconfig)
+		if err != nil {
+			glog.Errorf("can't get API server from kubeconfig: %v", err)
+		} else {
+			hosts = append(hosts, host)
+		}
+	}
+
+	var sources []string
+	seen := map[string]bool{}
+	for _, h := range hosts {
+		ips := []net.IP{net.ParseIP(h)}
+		if ips[0] == nil {
+			var err error
+			if ips, err = net.LookupIP(h); err != nil {
+				glog.Errorf("can't resolve API server %s: %v", h, err)
+				continue
+			}
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil && !seen[ip.String()] {
+				seen[ip.String()] = true
+				sources = append(sources, ip.String())
+			}
+		}
+	}
+	return sources
+}
+
+// Get critical sources which would be rejected by the config rules
+func RejectedSources(cfg *AppConfig, sources []string) []string {
+	var rejected []string
+	for _, s := range sources {
+		if allowed, _ := matchSource(cfg, net.ParseIP(s)); !allowed {
+			rejected = append(rejected, s)
+		}
+	}
+	return rejected
+}
+
+// Check the config rules don't reject critical sources, according to the safety mode:
+// refuse the config or implicitly allow rejected sources
+func ApplySafety(cfg *AppConfig, mode string, sources []string) error {
+	if err := ValidateSafetyMode(mode); err != nil {
+		return err
+	}
+	if mode == SafetyOff {
+		return nil
+	}
+
+	if err := ValidateCriticalSources(sources); err != nil {
+		return err
+	}
+	cfg.CriticalSources = sources
+
+	rejected := RejectedSources(cfg, sources)
+	if len(rejected) == 0 {
+		return nil
+	}
+
+	if mode == SafetyRefuse {
+		return errors.New(fmt.Sprintf("config rules would reject critical sources: %v", rejected))
+	}
+
+	glog.Warningf("critical sources rejected by config rules are implicitly allowed: %v", rejected)
+	cfg.SafeNetworks = rejected
+
+	return nil
+}
+
+// Validate safety mode
+func ValidateSafetyMode(mode string) error {
+	switch mode {
+	case SafetyAllow, SafetyRefuse, SafetyOff:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("invalid safety mode: %s (must be %s, %s or %s)", mode,
+		SafetyAllow, SafetyRefuse, SafetyOff))
+}
+
+// Validate critical source addresses
+func ValidateCriticalSources(sources []string) error {
+	for _, s := range sources {
+		if net.ParseIP(s) == nil {
+			return errors.New(fmt.Sprintf("invalid critical source address: %s", s))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	testiptables "k8s.io/kubernetes/pkg/util/iptables/testing"
+)
+
+func TestApplySafety(t *testing.T) {
+	type args struct {
+		cfg     *AppConfig
+		mode    string
+		sources []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "allowed sources",
+			args: args{cfg: NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"127.0.0.1", "10.0.0.0/8"}),
+				mode: SafetyRefuse, sources: []string{"127.0.0.1", "10.1.2.3"}},
+		},
+		{
+			name: "rejected sources allowed",
+			args: args{cfg: &AppConfig{IpChainName: "TEST-CHAIN", RestrictedPorts: []string{"1234"},
+				AllowedNetworks: []string{"10.0.0.0/8"}, DeniedNetworks: []string{"10.1.0.0/16"}},
+				mode: SafetyAllow, sources: []string{"127.0.0.1", "10.1.2.3", "10.2.3.4"}},
+			want: []string{"127.0.0.1", "10.1.2.3"},
+		},
+		{
+			name: "rejected sources refused",
+			args: args{cfg: NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"}),
+				mode: SafetyRefuse, sources: []string{"127.0.0.1"}},
+			wantErr: true,
+		},
+		{
+			name: "safety off",
+			args: args{cfg: NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"}),
+				mode: SafetyOff, sources: []string{"127.0.0.1"}},
+		},
+		{
+			name: "invalid mode",
+			args: args{cfg: NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"}),
+				mode: "on", sources: []string{"127.0.0.1"}},
+			wantErr: true,
+		},
+		{
+			name: "invalid source",
+			args: args{cfg: NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"}),
+				mode: SafetyAllow, sources: []string{"api.example.com"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ApplySafety(tt.args.cfg, tt.args.mode, tt.args.sources)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ApplySafety() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(tt.args.cfg.SafeNetworks, tt.want) {
+				t.Errorf("ApplySafety() SafeNetworks = %v, want %v", tt.args.cfg.SafeNetworks, tt.want)
+			}
+		})
+	}
+}
+
+func TestApp_updateTablesWithSafeNetworks(t *testing.T) {
+	app := &App{
+		cfg:      NewAppConfig("TEST-CHAIN", nil, nil),
+		iptables: testiptables.NewFake(),
+	}
+
+	cfg := &AppConfig{IpChainName: "TEST-CHAIN", RestrictedPorts: []string{"1234"},
+		AllowedNetworks: []string{"10.0.0.0/8"}, DeniedNetworks: []string{"0.0.0.0/0"}}
+	if err := ApplySafety(cfg, SafetyAllow, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.updateTables(nil, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+	want := `-A TEST-CHAIN -s 127.0.0.1 -j RETURN
+-A TEST-CHAIN -s 0.0.0.0/0 -j REJECT --reject-with icmp-port-unreachable
+-A TEST-CHAIN -s 10.0.0.0/8 -j RETURN
+`
+	if got := string(app.iptables.(*testiptables.FakeIPTables).Lines); !strings.Contains(got, want) {
+		t.Errorf("App.updateTables() Lines '%s', want '%s'", got, want)
+	}
+}
+
+func TestAPIServerSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	data := `
+clusters:
+- name: kubernetes
+  cluster:
+    server: https://10.0.0.1:6443
+contexts:
+- name: default
+  context:
+    cluster: kubernetes
+current-context: default
+`
+	if err := ioutil.WriteFile(kubeconfig, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Setenv(apiServerHostEnv, os.Getenv(apiServerHostEnv))
+	defer os.Setenv(apiServerPortEnv, os.Getenv(apiServerPortEnv))
+	os.Setenv(apiServerPortEnv, "")
+	defer func(f func(string) ([]string, error)) { apiServerEndpoints = f }(apiServerEndpoints)
+
+	// In-cluster API server service endpoints by service address
+	services := map[string][]string{
+		"10.96.0.1:443": {"192.0.2.10", "192.0.2.11"},
+		"10.96.0.2:443": {"10.0.0.1"},
+		"10.96.0.3:443": {"fd00::1"},
+	}
+	apiServerEndpoints = func(address string) ([]string, error) {
+		if endpoints, ok := services[address]; ok {
+			return endpoints, nil
+		}
+		return nil, errors.New("connection refused")
+	}
+
+	type args struct {
+		env        string
+		kubeconfig string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
+	}{
+		{name: "none"},
+		{name: "in-cluster", args: args{env: "10.96.0.1"}, want: []string{"192.0.2.10", "192.0.2.11"}},
+		{name: "kubeconfig", args: args{kubeconfig: kubeconfig}, want: []string{"10.0.0.1"}},
+		{name: "in-cluster and kubeconfig", args: args{env: "10.96.0.1", kubeconfig: kubeconfig},
+			want: []string{"192.0.2.10", "192.0.2.11", "10.0.0.1"}},
+		{name: "duplicate", args: args{env: "10.96.0.2", kubeconfig: kubeconfig}, want: []string{"10.0.0.1"}},
+		{name: "IPv6", args: args{env: "10.96.0.3"}},
+		{name: "in-cluster unavailable", args: args{env: "10.96.0.4", kubeconfig: kubeconfig},
+			want: []string{"10.0.0.1"}},
+		{name: "missing kubeconfig", args: args{kubeconfig: filepath.Join(dir, "missing")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(apiServerHostEnv, tt.args.env)
+			if got := APIServerSources(tt.args.kubeconfig); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("APIServerSources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+// Allowed network active only within the time window and/or by the schedule
+type ScheduledNetwork struct {
+	Network   string
+	NotBefore time.Time
+	NotAfter  time.Time
+	Schedule  *util.Schedule
+}
+
+// Checks the network is active at given time
+func (n ScheduledNetwork) Active(t time.Time) bool {
+	if !n.NotBefore.IsZero() && t.Before(n.NotBefore) {
+		return false
+	}
+	if !n.NotAfter.IsZero() && !t.Before(n.NotAfter) {
+		return false
+	}
+	return n.Schedule == nil || n.Schedule.Matches(t)
+}
+
+func (n ScheduledNetwork) String() string {
+	s := n.Network
+	if !n.NotBefore.IsZero() {
+		s += " notBefore " + n.NotBefore.UTC().Format(time.RFC3339)
+	}
+	if !n.NotAfter.IsZero() {
+		s += " notAfter " + n.NotAfter.UTC().Format(time.RFC3339)
+	}
+	if n.Schedule != nil {
+		s += " schedule " + n.Schedule.String()
+	}
+	return s
+}
+
+// Get networks active at given time
+func activeScheduledNetworks(nets []ScheduledNetwork, t time.Time) []string {
+	var active []string
+	for _, n := range nets {
+		if n.Active(t) {
+			active = append(active, n.Network)
+		}
+	}
+	return active
+}
+
+// Get the time of next possible change of scheduled networks activity after given time,
+// false if no changes are possible
+func nextScheduleChange(nets []ScheduledNetwork, t time.Time) (time.Time, bool) {
+	var next time.Time
+	update := func(c time.Time) {
+		if c.After(t) && (next.IsZero() || c.Before(next)) {
+			next = c
+		}
+	}
+
+	for _, n := range nets {
+		if !n.NotAfter.IsZero() && !t.Before(n.NotAfter) {
+			// Expired
+			continue
+		}
+		update(n.NotBefore)
+		update(n.NotAfter)
+		if n.Schedule != nil {
+			// Schedule matching could change at the start of every minute
+			update(t.Truncate(time.Minute).Add(time.Minute))
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// Timer firing at the earliest of scheduled changes. Later changes don't postpone
+// the armed timer, so it isn't delayed by frequent config updates or other events
+type scheduleTimer struct {
+	timer *time.Timer
+	at    time.Time
+	armed bool
+}
+
+// Arm timer to fire at given time, unless it's already armed to fire earlier
+func (t *scheduleTimer) arm(at, now time.Time) {
+	if t.armed && !at.Before(t.at) {
+		return
+	}
+	if t.timer == nil {
+		t.timer = time.NewTimer(at.Sub(now))
+	} else {
+		t.timer.Stop()
+		select {
+		case <-t.timer.C:
+		default:
+		}
+		t.timer.Reset(at.Sub(now))
+	}
+	t.at, t.armed = at, true
+}
+
+// Get timer channel, nil if timer is not armed
+func (t *scheduleTimer) C() <-chan time.Time {
+	if !t.armed {
+		return nil
+	}
+	return t.timer.C
+}
+
+// Mark timer fired, so it could be armed for the next change
+func (t *scheduleTimer) fired() {
+	t.armed = false
+}
+
+func (t *scheduleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.armed = false
+}
@@ -0,0 +1,114 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+func TestActiveScheduledNetworks(t *testing.T) {
+	businessHours, err := util.ParseSchedule("* 9-17 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2019-01-07 is Monday
+	base := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	nets := []ScheduledNetwork{
+		{Network: "10.0.0.1", NotBefore: base.Add(8 * time.Hour)},
+		{Network: "10.0.0.2", NotAfter: base.Add(12 * time.Hour)},
+		{Network: "10.0.0.3", Schedule: businessHours},
+		{Network: "10.0.0.4", NotBefore: base.Add(10 * time.Hour), NotAfter: base.Add(11 * time.Hour),
+			Schedule: businessHours},
+	}
+	tests := []struct {
+		name     string
+		t        time.Time
+		want     []string
+		wantNext time.Time
+	}{
+		{name: "before all", t: base.Add(7 * time.Hour), want: []string{"10.0.0.2"},
+			wantNext: base.Add(7*time.Hour + time.Minute)},
+		{name: "not before reached", t: base.Add(8 * time.Hour), want: []string{"10.0.0.1", "10.0.0.2"},
+			wantNext: base.Add(8*time.Hour + time.Minute)},
+		{name: "business hours", t: base.Add(10*time.Hour + 30*time.Second),
+			want:     []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			wantNext: base.Add(10*time.Hour + time.Minute)},
+		{name: "not after reached", t: base.Add(12 * time.Hour), want: []string{"10.0.0.1", "10.0.0.3"},
+			wantNext: base.Add(12*time.Hour + time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := activeScheduledNetworks(nets, tt.t); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("activeScheduledNetworks() = %v, want %v", got, tt.want)
+			}
+			if got, ok := nextScheduleChange(nets, tt.t); !ok || !got.Equal(tt.wantNext) {
+				t.Errorf("nextScheduleChange() = %v, %v, want %v", got, ok, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestNextScheduleChange(t *testing.T) {
+	base := time.Date(2019, 1, 7, 0, 0, 0, 0, time.UTC)
+	nets := []ScheduledNetwork{
+		{Network: "10.0.0.1", NotBefore: base.Add(2 * time.Hour), NotAfter: base.Add(3 * time.Hour)},
+	}
+	if got, ok := nextScheduleChange(nets, base); !ok || !got.Equal(base.Add(2*time.Hour)) {
+		t.Errorf("nextScheduleChange() = %v, %v, want not before time", got, ok)
+	}
+	if got, ok := nextScheduleChange(nets, base.Add(2*time.Hour)); !ok || !got.Equal(base.Add(3*time.Hour)) {
+		t.Errorf("nextScheduleChange() = %v, %v, want not after time", got, ok)
+	}
+	if got, ok := nextScheduleChange(nets, base.Add(3*time.Hour)); ok {
+		t.Errorf("nextScheduleChange() = %v, %v, want no changes for expired network", got, ok)
+	}
+}
+
+func TestScheduleTimer(t *testing.T) {
+	now := time.Now()
+	st := &scheduleTimer{}
+	defer st.stop()
+
+	if st.C() != nil {
+		t.Fatalf("scheduleTimer.C() is not nil for not armed timer")
+	}
+
+	st.arm(now.Add(10*time.Millisecond), now)
+	// Later change doesn't postpone armed timer
+	st.arm(now.Add(time.Hour), now)
+	select {
+	case <-st.C():
+		st.fired()
+	case <-time.After(time.Second):
+		t.Fatalf("scheduleTimer is postponed by later change")
+	}
+	if st.C() != nil {
+		t.Fatalf("scheduleTimer.C() is not nil for fired timer")
+	}
+
+	// Earlier change re-arms timer
+	now = time.Now()
+	st.arm(now.Add(time.Hour), now)
+	st.arm(now.Add(10*time.Millisecond), now)
+	select {
+	case <-st.C():
+	case <-time.After(time.Second):
+		t.Fatalf("scheduleTimer is not re-armed by earlier change")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/3cky/kube-restrict-ip/metrics"
+	"github.com/3cky/kube-restrict-ip/state"
+	"github.com/3cky/kube-restrict-ip/util"
+	"github.com/golang/glog"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+// Kinds of network rules chain rules
+const (
+	RuleKindCritical = "critical"
+	RuleKindDenied   = "denied"
+	RuleKindAllowed  = "allowed"
+	RuleKindDefault  = "default"
+)
+
+// Running network rules chain rule with its traffic counters
+type RuleStatus struct {
+	Kind    string `json:"kind"`
+	Network string `json:"network,omitempty"`
+	Target  string `json:"target"`
+	// Config entries the rule is created for
+	Entries []string `json:"entries,omitempty"`
+	Packets uint64   `json:"packets"`
+	Bytes   uint64   `json:"bytes"`
+}
+
+// Running rules status with traffic counters
+type Status struct {
+	Chain           string   `json:"chain"`
+	RestrictedPorts []string `json:"restrictedPorts"`
+	// Startup policy the applied config is created by due to invalid config file, as recorded in the state file
+	StartupPolicy   string       `json:"startupPolicy,omitempty"`
+	Packets         uint64       `json:"packets"`
+	Bytes           uint64       `json:"bytes"`
+	RejectedPackets uint64       `json:"rejectedPackets"`
+	RejectedBytes   uint64       `json:"rejectedBytes"`
+	Rules           []RuleStatus `json:"rules"`
+}
+
+// Get running rules status with traffic counters, mapping every rule back to the config
+// entries it's created for. Returns nil if running rules are not found
+func (app *App) Status() (*Status, error) {
+	st, err := app.readStatus()
+	if err != nil || st == nil {
+		return nil, err
+	}
+
+	if app.stateFile != "" {
+		s, err := state.Load(app.stateFile)
+		if err != nil {
+			glog.Errorf("can't load state file: %v", err)
+		} else if s != nil && s.Instance == app.instance && s.ChainName == st.Chain {
+			st.StartupPolicy = s.StartupPolicy
+		}
+	}
+
+	entries := app.configEntries()
+	for i := range st.Rules {
+		if r := &st.Rules[i]; r.Kind != RuleKindDefault {
+			r.Entries = matchEntries(r.Network, entries[r.Kind])
+		}
+	}
+
+	return st, nil
+}
+
+// Read running rules status with traffic counters, without config entries.
+// Returns nil if running rules are not found
+func (app *App) readStatus() (*Status, error) {
+	d := bytes.NewBuffer(nil)
+	if err := app.saveTablesWithCounters(utiliptables.TableFilter, d); err != nil {
+		return nil, err
+	}
+	data := d.Bytes()
+
+	chain := app.cfg.IpChainName
+	ports := util.GetRestrictedPortsFromTablesData(util.RemoveCountersFromTablesData(data), chain)
+	if ports == nil {
+		return nil, nil
+	}
+
+	st := &Status{Chain: chain, RestrictedPorts: ports, Rules: []RuleStatus{}}
+	if c := util.GetRestrictedPortsCountersFromTablesData(data, chain); c != nil {
+		st.Packets, st.Bytes = c.Packets, c.Bytes
+	}
+
+	for _, r := range util.GetChainRuleCountersFromTablesData(data, chain) {
+		rs := RuleStatus{Network: r.Network, Target: r.Target, Packets: r.Packets, Bytes: r.Bytes}
+		switch {
+		case r.Network == "":
+			rs.Kind = RuleKindDefault
+		case r.Target != "RETURN":
+			rs.Kind = RuleKindDenied
+		case isSafeNetwork(r.Network, app.cfg.SafeNetworks):
+			rs.Kind = RuleKindCritical
+		default:
+			rs.Kind = RuleKindAllowed
+		}
+		if rs.Target != "RETURN" {
+			st.RejectedPackets += rs.Packets
+			st.RejectedBytes += rs.Bytes
+		}
+		st.Rules = append(st.Rules, rs)
+	}
+
+	return st, nil
+}
+
+// Checks the rule network is created for implicitly allowed critical source
+func isSafeNetwork(network string, safeNets []string) bool {
+	ruleNet, err := util.ParseNetwork(network)
+	if err != nil {
+		return false
+	}
+	for _, s := range safeNets {
+		if n, err := util.ParseNetwork(s); err == nil && n.String() == ruleNet.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Read running rules traffic counters and export them as metrics
+func (app *App) updateRuleStats() {
+	if app.cfg == nil {
+		return
+	}
+
+	st, err := app.readStatus()
+	if err != nil {
+		glog.Errorf("can't read iptables rules counters: %v", err)
+		return
+	}
+
+	var counters []metrics.RuleCounters
+	if st != nil {
+		ports := strings.Join(st.RestrictedPorts, ",")
+		for _, r := range st.Rules {
+			counters = append(counters, metrics.RuleCounters{Network: r.Network, Ports: ports, Kind: r.Kind,
+				Packets: r.Packets, Bytes: r.Bytes})
+		}
+	}
+	metrics.UpdateRuleCounters(counters)
+
+	if st != nil && app.updateHits(st) {
+		app.saveHits()
+	}
+}
+
+// Get config entries by kind of rules created for them, mapped to their addresses
+// (host names are resolved)
+func (app *App) configEntries() map[string]map[string][]string {
+	cfg := app.cfg
+	hosts := app.hostCache()
+	hosts.update(cfg)
+
+	addrs := func(nets []string) map[string][]string {
+		m := map[string][]string{}
+		for _, n := range nets {
+			m[n] = hosts.expand([]string{n})
+		}
+		return m
+	}
+
+	allowed := append([]string{}, cfg.AllowedNetworks...)
+	for _, n := range cfg.ScheduledNetworks {
+		allowed = append(allowed, n.Network)
+	}
+	if app.grants != nil {
+		allowed = append(allowed, app.grants.Networks(app.currentTime())...)
+	}
+
+	return map[string]map[string][]string{
+		RuleKindCritical: addrs(cfg.SafeNetworks),
+		RuleKindDenied:   addrs(cfg.DeniedNetworks),
+		RuleKindAllowed:  addrs(allowed),
+	}
+}
+
+// Get config entries having any of the addresses within the rule network, sorted
+func matchEntries(network string, entries map[string][]string) []string {
+	ruleNet, err := util.ParseNetwork(network)
+	if err != nil {
+		return nil
+	}
+
+	var matched []string
+	for e, addrs := range entries {
+		for _, a := range addrs {
+			if n, err := util.ParseNetwork(a); err == nil && util.ContainsNetwork(ruleNet, n) {
+				matched = append(matched, e)
+				break
+			}
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil
+	}
+	return sortedKeys(util.ToSet(matched))
+}
+
+// Save table rules with counters to the buffer. Iptables interface saves rules without counters,
+// so iptables-save is run by the interface executor for the interface protocol
+func (app *App) saveTablesWithCounters(table utiliptables.Table, buffer *bytes.Buffer) error {
+	if app.saveCounters != nil {
+		return app.saveCounters(table, buffer)
+	}
+	// Warnings (e.g. about legacy tables) are kept out of the saved rules
+	var stderr bytes.Buffer
+	cmd := app.execer.Command(iptablesSaveCommand(app.protocol), "-c", "-t", string(table))
+	cmd.SetStdout(buffer)
+	cmd.SetStderr(&stderr)
+	err := cmd.Run()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v: %s", err, msg))
+		}
+		glog.Warningf("iptables-save: %s", msg)
+	}
+	return err
+}
+
+// Get iptables-save command for the protocol, the same as used by iptables interface
+func iptablesSaveCommand(protocol utiliptables.Protocol) string {
+	if protocol == utiliptables.ProtocolIpv6 {
+		return "ip6tables-save"
+	}
+	return "iptables-save"
+}
@@ -0,0 +1,152 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+	"k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+func TestApp_Status(t *testing.T) {
+	data := `*filter
+:INPUT ACCEPT [100:10000]
+:TEST-CHAIN - [0:0]
+[42:4200] -A INPUT -p tcp -m multiport --dports 1234 -m comment --comment kube-restrict-ip -j TEST-CHAIN
+[3:180] -A TEST-CHAIN -s 127.0.0.1/32 -j RETURN
+[1:60] -A TEST-CHAIN -s 10.1.0.0/16 -j DROP
+[30:3000] -A TEST-CHAIN -s 10.0.0.0/8 -j RETURN
+[0:0] -A TEST-CHAIN -s 192.168.1.0/24 -j RETURN
+[8:960] -A TEST-CHAIN -j DROP
+COMMIT
+`
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8", "10.2.0.0/16", "example.com"})
+	cfg.ScheduledNetworks = []ScheduledNetwork{{Network: "192.168.1.0/24"}}
+	cfg.DeniedNetworks = []string{"10.1.0.0/16"}
+	cfg.SafeNetworks = []string{"127.0.0.1"}
+	app := &App{
+		cfg:      cfg,
+		resolver: &fakeResolver{hosts: map[string][]string{"example.com": {"10.3.0.1"}}},
+		saveCounters: func(_ utiliptables.Table, buffer *bytes.Buffer) error {
+			buffer.WriteString(data)
+			return nil
+		},
+	}
+
+	got, err := app.Status()
+	if err != nil {
+		t.Fatalf("App.Status() error = %v", err)
+	}
+	want := &Status{
+		Chain:           "TEST-CHAIN",
+		RestrictedPorts: []string{"1234"},
+		Packets:         42,
+		Bytes:           4200,
+		RejectedPackets: 9,
+		RejectedBytes:   1020,
+		Rules: []RuleStatus{
+			{Kind: RuleKindCritical, Network: "127.0.0.1/32", Target: "RETURN", Entries: []string{"127.0.0.1"},
+				Packets: 3, Bytes: 180},
+			{Kind: RuleKindDenied, Network: "10.1.0.0/16", Target: "DROP", Entries: []string{"10.1.0.0/16"},
+				Packets: 1, Bytes: 60},
+			{Kind: RuleKindAllowed, Network: "10.0.0.0/8", Target: "RETURN",
+				Entries: []string{"10.0.0.0/8", "10.2.0.0/16", "example.com"}, Packets: 30, Bytes: 3000},
+			{Kind: RuleKindAllowed, Network: "192.168.1.0/24", Target: "RETURN", Entries: []string{"192.168.1.0/24"}},
+			{Kind: RuleKindDefault, Target: "DROP", Packets: 8, Bytes: 960},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("App.Status() = %+v, want %+v", got, want)
+	}
+
+	// Startup policy of the applied config is read from the state file
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	cfg.StartupPolicy = "failClosed"
+	app.SetStateFile(stateFile)
+	app.saveState(cfg, nil)
+	if got, err := app.Status(); err != nil || got.StartupPolicy != "failClosed" {
+		t.Errorf("App.Status() startup policy = %v, %v, want failClosed", got, err)
+	}
+
+	app.cfg = NewAppConfig("OTHER-CHAIN", nil, nil)
+	if got, err := app.Status(); err != nil || got != nil {
+		t.Errorf("App.Status() = %+v, %v, want nil", got, err)
+	}
+}
+
+func TestApp_saveTablesWithCounters(t *testing.T) {
+	rules := "*filter\n[1:60] -A INPUT -j TEST-CHAIN\nCOMMIT\n"
+	warning := "# Warning: iptables-legacy tables present, use iptables-legacy-save to see them\n"
+	type args struct {
+		protocol utiliptables.Protocol
+		stderr   string
+		err      error
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantCmd []string
+		wantErr bool
+	}{
+		{name: "ipv4", args: args{protocol: utiliptables.ProtocolIpv4},
+			wantCmd: []string{"iptables-save", "-c", "-t", "filter"}},
+		{name: "ipv6", args: args{protocol: utiliptables.ProtocolIpv6},
+			wantCmd: []string{"ip6tables-save", "-c", "-t", "filter"}},
+		{name: "warning", args: args{protocol: utiliptables.ProtocolIpv4, stderr: warning},
+			wantCmd: []string{"iptables-save", "-c", "-t", "filter"}},
+		{name: "error", args: args{protocol: utiliptables.ProtocolIpv4, stderr: "permission denied",
+			err: errors.New("exit status 1")}, wantCmd: []string{"iptables-save", "-c", "-t", "filter"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fcmd := &fakeexec.FakeCmd{
+				RunScript: []fakeexec.FakeRunAction{
+					func() ([]byte, []byte, error) { return []byte(rules), []byte(tt.args.stderr), tt.args.err },
+				},
+			}
+			fexec := &fakeexec.FakeExec{
+				CommandScript: []fakeexec.FakeCommandAction{
+					func(cmd string, args ...string) exec.Cmd { return fakeexec.InitFakeCmd(fcmd, cmd, args...) },
+				},
+			}
+			app := &App{execer: fexec, protocol: tt.args.protocol}
+
+			buffer := &bytes.Buffer{}
+			err := app.saveTablesWithCounters(utiliptables.TableFilter, buffer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("App.saveTablesWithCounters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(fcmd.Argv, tt.wantCmd) {
+				t.Errorf("App.saveTablesWithCounters() command = %v, want %v", fcmd.Argv, tt.wantCmd)
+			}
+			if buffer.String() != rules {
+				t.Errorf("App.saveTablesWithCounters() = %q, want %q", buffer.String(), rules)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+const fakeInputChain = "INPUT"
+
+var fakeJumpRuleRegex = regexp.MustCompile(`--dports (\S+) .*-j (\S+)$`)
+
+// Filter table rules simulating iptables-restore commands
+type fakeTables struct {
+	// Chain names in creation order
+	chains []string
+	// Rules arguments (after chain name), by chain name
+	rules map[string][]string
+}
+
+// Parse rules in iptables-save format
+func parseFakeTables(data []byte) *fakeTables {
+	t := &fakeTables{chains: []string{fakeInputChain}, rules: map[string][]string{fakeInputChain: nil}}
+	for _, line := range strings.Split(string(data), "\n") {
+		words := strings.Fields(line)
+		switch {
+		case len(words) > 0 && strings.HasPrefix(words[0], ":"):
+			t.create(strings.TrimPrefix(words[0], ":"))
+		case len(words) > 2 && words[0] == "-A":
+			t.create(words[1])
+			t.rules[words[1]] = append(t.rules[words[1]], ruleArgs(words[2:]))
+		}
+	}
+	return t
+}
+
+func ruleArgs(words []string) string {
+	return strings.Replace(util.JoinWords(words...), "\"", "", -1)
+}
+
+func (t *fakeTables) create(chain string) {
+	if _, ok := t.rules[chain]; !ok {
+		t.chains = append(t.chains, chain)
+		t.rules[chain] = nil
+	}
+}
+
+// Apply iptables-restore line
+func (t *fakeTables) apply(line string) error {
+	words := strings.Fields(line)
+	switch {
+	case len(words) == 0, words[0] == "COMMIT", strings.HasPrefix(words[0], "*"):
+		return nil
+	case strings.HasPrefix(words[0], ":"):
+		// Create or flush chain
+		chain := strings.TrimPrefix(words[0], ":")
+		t.create(chain)
+		t.rules[chain] = nil
+		return nil
+	case len(words) < 2:
+		return errors.New(fmt.Sprintf("invalid line: %s", line))
+	}
+
+	chain := words[1]
+	rules, ok := t.rules[chain]
+	if !ok {
+		return errors.New(fmt.Sprintf("no chain %s: %s", chain, line))
+	}
+
+	switch words[0] {
+	case "-A":
+		t.rules[chain] = append(rules, ruleArgs(words[2:]))
+	case "-I":
+		pos, err := strconv.Atoi(words[2])
+		if err != nil || pos < 1 || pos > len(rules)+1 {
+			return errors.New(fmt.Sprintf("invalid rule position: %s", line))
+		}
+		t.rules[chain] = append(rules[:pos-1], append([]string{ruleArgs(words[3:])}, rules[pos-1:]...)...)
+	case "-D":
+		args := ruleArgs(words[2:])
+		for i, r := range rules {
+			if r == args {
+				t.rules[chain] = append(rules[:i], rules[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New(fmt.Sprintf("no rule to delete: %s", line))
+	case "-X":
+		if len(rules) > 0 || t.referenced(chain) {
+			return errors.New(fmt.Sprintf("chain is not empty or referenced: %s", line))
+		}
+		delete(t.rules, chain)
+		for i, c := range t.chains {
+			if c == chain {
+				t.chains = append(t.chains[:i], t.chains[i+1:]...)
+				break
+			}
+		}
+	case "-E":
+		newName := words[2]
+		if _, ok := t.rules[newName]; ok {
+			return errors.New(fmt.Sprintf("chain already exists: %s", line))
+		}
+		t.rules[newName] = rules
+		delete(t.rules, chain)
+		for i, c := range t.chains {
+			if c == chain {
+				t.chains[i] = newName
+			}
+		}
+		for c, rules := range t.rules {
+			for i, r := range rules {
+				if strings.HasSuffix(r, "-j "+chain) {
+					t.rules[c][i] = strings.TrimSuffix(r, chain) + newName
+				}
+			}
+		}
+	default:
+		return errors.New(fmt.Sprintf("unsupported command: %s", line))
+	}
+
+	return nil
+}
+
+// Checks chain is referenced by any rule
+func (t *fakeTables) referenced(chain string) bool {
+	for _, rules := range t.rules {
+		for _, r := range rules {
+			if strings.HasSuffix(r, "-j "+chain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks traffic to the port is redirected to the complete network rules chain
+// (i.e. chain with the default rule rejecting unmatched networks)
+func (t *fakeTables) protected(port string) bool {
+	for _, r := range t.rules[fakeInputChain] {
+		m := fakeJumpRuleRegex.FindStringSubmatch(r)
+		if m == nil || !util.ToSet(strings.Split(m[1], ","))[port] {
+			continue
+		}
+		rules := t.rules[m[2]]
+		if len(rules) > 0 {
+			last := rules[len(rules)-1]
+			if !strings.HasPrefix(last, "-s ") && !strings.HasSuffix(last, "-j RETURN") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Get rules in iptables-save format
+func (t *fakeTables) save() []byte {
+	lines := bytes.NewBuffer(nil)
+	for _, c := range t.chains {
+		if c == fakeInputChain {
+			util.WriteLine(lines, ":"+c+" ACCEPT [0:0]")
+		} else {
+			util.WriteLine(lines, util.CreateEmptyChainRule(c))
+		}
+	}
+	for _, c := range t.chains {
+		for _, r := range t.rules[c] {
+			util.WriteLine(lines, util.JoinWords("-A", c, r))
+		}
+	}
+	return lines.Bytes()
+}
@@ -0,0 +1,173 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/util"
+	"github.com/golang/glog"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+const (
+	DefaultVerifyGracePeriod = 30 * time.Second
+
+	verifyProbeTimeout  = 2 * time.Second
+	verifyRetryInterval = time.Second
+)
+
+// Post-apply rules verification config
+type VerifyConfig struct {
+	// Source addresses which must be allowed by the rules
+	Sources []string `mapstructure:"sources"`
+	// Endpoints (host:port) which must be reachable after rules applying
+	Endpoints []string `mapstructure:"endpoints"`
+	// Time to wait for endpoints to become reachable
+	GracePeriod time.Duration `mapstructure:"gracePeriod"`
+}
+
+func (c *VerifyConfig) Validate() error {
+	for _, s := range c.Sources {
+		if net.ParseIP(s) == nil {
+			return errors.New(fmt.Sprintf("invalid verify source address: %s", s))
+		}
+	}
+	for _, e := range c.Endpoints {
+		if _, _, err := net.SplitHostPort(e); err != nil {
+			return errors.New(fmt.Sprintf("invalid verify endpoint %s: %v", e, err))
+		}
+	}
+	if c.GracePeriod < 0 {
+		return errors.New(fmt.Sprintf("invalid verify grace period: %v", c.GracePeriod))
+	}
+	return nil
+}
+
+// Check source addresses would be allowed by the config rules
+func checkSources(cfg *AppConfig, sources []string) error {
+	for _, s := range sources {
+		if allowed, n := matchSource(cfg, net.ParseIP(s)); !allowed {
+			if n != "" {
+				return errors.New(fmt.Sprintf("source %s is denied by network %s", s, n))
+			}
+			return errors.New(fmt.Sprintf("source %s is not allowed by any network", s))
+		}
+	}
+	return nil
+}
+
+// Check verification source addresses would be allowed by the config rules, if verification is configured
+func verifySources(cfg *AppConfig) error {
+	if v := cfg.Verify; v != nil {
+		if err := checkSources(cfg, v.Sources); err != nil {
+			return errors.New(fmt.Sprintf("rules verification failed: %v", err))
+		}
+	}
+	return nil
+}
+
+// Simulate config rules evaluation for the source address: safe networks rules first,
+// then denied networks ones, then allowed networks ones, then default rule.
+// Returns whether the source is allowed and the network matched, if any
+func matchSource(cfg *AppConfig, ip net.IP) (bool, string) {
+	if n := util.FindNetwork(ip, cfg.SafeNetworks); n != "" {
+		return true, n
+	}
+	if n := util.FindNetwork(ip, cfg.DeniedNetworks); n != "" {
+		return false, n
+	}
+	if n := util.FindNetwork(ip, cfg.AllowedNetworks); n != "" {
+		return true, n
+	}
+	return false, ""
+}
+
+// Check all endpoints are reachable
+func (app *App) probeEndpoints(endpoints []string) error {
+	dial := app.dial
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	for _, e := range endpoints {
+		conn, err := dial("tcp", e, verifyProbeTimeout)
+		if err != nil {
+			return errors.New(fmt.Sprintf("endpoint %s is unreachable: %v", e, err))
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// Verify applied config rules, if verification is configured: wait for endpoints to become
+// reachable within the grace period. Waiting is cancelled by config update or app stop
+func (app *App) verifyTables(cfg *AppConfig) error {
+	v := cfg.Verify
+	if v == nil || len(v.Endpoints) == 0 {
+		return nil
+	}
+
+	gracePeriod := v.GracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = DefaultVerifyGracePeriod
+	}
+	deadline := time.Now().Add(gracePeriod)
+	for {
+		err := app.probeEndpoints(v.Endpoints)
+		if err == nil {
+			glog.V(2).Info("applied rules verified")
+			return nil
+		}
+		if !time.Now().Add(verifyRetryInterval).Before(deadline) {
+			return err
+		}
+		glog.V(2).Infof("rules verification: %v, retrying", err)
+		select {
+		case <-time.After(verifyRetryInterval):
+		case newCfg, ok := <-app.updates:
+			app.pendingUpdate = &configUpdate{cfg: newCfg, closed: !ok}
+			return errors.New(fmt.Sprintf("cancelled by config update or stop, %v", err))
+		}
+	}
+}
+
+// Restore previously applied config rules after failed verification of the config ones
+func (app *App) rollbackTables(cfg, prevCfg *AppConfig, cause error) error {
+	if prevCfg == nil {
+		return errors.New(fmt.Sprintf("rules verification failed: %v (no previous config to roll back to)", cause))
+	}
+
+	glog.Warningf("rules verification failed: %v, rolling back to previous config", cause)
+
+	data, err := app.saveTables()
+	if err != nil {
+		return errors.New(fmt.Sprintf("rules verification failed: %v, rollback error: %v", cause, err))
+	}
+
+	d := app.createTablesRestoreData(data, cfg, prevCfg)
+	glog.V(4).Infof("iptables-restore rollback data:\n%s", d)
+
+	if err := app.iptables.RestoreAll(d, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters); err != nil {
+		return errors.New(fmt.Sprintf("rules verification failed: %v, rollback error: %v", cause, err))
+	}
+
+	app.applied = prevCfg
+	app.recordApplied(prevCfg, d)
+
+	return errors.New(fmt.Sprintf("rules verification failed, rolled back to previous config: %v", cause))
+}
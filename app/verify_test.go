@@ -0,0 +1,185 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	testiptables "k8s.io/kubernetes/pkg/util/iptables/testing"
+)
+
+func TestCheckSources(t *testing.T) {
+	type args struct {
+		cfg     *AppConfig
+		sources []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "allowed",
+			args: args{cfg: NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8", "192.168.1.1"}),
+				sources: []string{"10.1.2.3", "192.168.1.1"}},
+		},
+		{
+			name: "not allowed",
+			args: args{cfg: NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"}),
+				sources: []string{"10.1.2.3", "192.168.1.1"}},
+			wantErr: true,
+		},
+		{
+			name: "denied",
+			args: args{cfg: &AppConfig{IpChainName: "TEST-CHAIN", RestrictedPorts: []string{"1234"},
+				AllowedNetworks: []string{"10.0.0.0/8"}, DeniedNetworks: []string{"10.1.0.0/16"}},
+				sources: []string{"10.1.2.3"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkSources(tt.args.cfg, tt.args.sources); (err != nil) != tt.wantErr {
+				t.Errorf("checkSources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApp_updateTablesWithVerify(t *testing.T) {
+	reachable := true
+	app := &App{
+		cfg:      NewAppConfig("TEST-CHAIN", nil, nil),
+		iptables: &saveFormatIPTables{FakeIPTables: testiptables.NewFake()},
+		dial: func(network, address string, timeout time.Duration) (net.Conn, error) {
+			if !reachable {
+				return nil, errors.New("connection timed out")
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		},
+	}
+
+	verify := &VerifyConfig{Sources: []string{"10.1.2.3"}, Endpoints: []string{"10.1.2.3:6443"}, GracePeriod: time.Millisecond}
+
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})
+	cfg.Verify = verify
+	if err := app.updateTables(nil, cfg); err != nil {
+		t.Fatalf("App.updateTables() error = %v", err)
+	}
+
+	// Source not allowed by the new config, not applied
+	newCfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"192.168.0.0/16"})
+	newCfg.Verify = verify
+	if err := app.updateTables(cfg, newCfg); err == nil {
+		t.Errorf("App.updateTables() error = nil for not allowed source")
+	}
+	got := string(app.iptables.(*saveFormatIPTables).Lines)
+	if !strings.Contains(got, "-A TEST-CHAIN -s 10.0.0.0/8 -j RETURN\n") {
+		t.Errorf("App.updateTables() Lines '%s' are applied", got)
+	}
+
+	// Endpoint unreachable, rolled back
+	reachable = false
+	newCfg = NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.1.0.0/16"})
+	newCfg.Verify = verify
+	if err := app.updateTables(cfg, newCfg); err == nil {
+		t.Errorf("App.updateTables() error = nil for unreachable endpoint")
+	}
+	got = string(app.iptables.(*saveFormatIPTables).Lines)
+	if !strings.Contains(got, "-A TEST-CHAIN -s 10.0.0.0/8 -j RETURN\n") {
+		t.Errorf("App.updateTables() Lines '%s' are not rolled back", got)
+	}
+	if !reflect.DeepEqual(app.applied.AllowedNetworks, []string{"10.0.0.0/8"}) {
+		t.Errorf("App.applied = %v, want rolled back config", app.applied)
+	}
+
+	// Endpoint unreachable without previous config, not reported applied
+	app.applied = nil
+	if err := app.updateTables(nil, newCfg); err == nil {
+		t.Errorf("App.updateTables() error = nil for unreachable endpoint")
+	}
+	if app.applied != nil {
+		t.Errorf("App.applied = %v for not verified config", app.applied)
+	}
+	app.applied = cfg
+
+	// Waiting for unreachable endpoint cancelled by config update, rolled back
+	app.updates = make(chan *AppConfig)
+	go func() {
+		app.updates <- cfg
+	}()
+	newCfg.Verify = &VerifyConfig{Endpoints: []string{"10.1.2.3:6443"}, GracePeriod: time.Hour}
+	if err := app.updateTables(cfg, newCfg); err == nil {
+		t.Errorf("App.updateTables() error = nil for cancelled verification")
+	}
+	if app.pendingUpdate == nil || app.pendingUpdate.cfg != cfg {
+		t.Errorf("App.pendingUpdate = %+v, want config update", app.pendingUpdate)
+	}
+	if !reflect.DeepEqual(app.applied.AllowedNetworks, []string{"10.0.0.0/8"}) {
+		t.Errorf("App.applied = %v, want rolled back config", app.applied)
+	}
+
+	// Endpoint reachable
+	reachable = true
+	if err := app.updateTables(cfg, newCfg); err != nil {
+		t.Errorf("App.updateTables() error = %v", err)
+	}
+}
+
+func TestApp_updateConfigWithVerify(t *testing.T) {
+	reachable := true
+	app := &App{
+		iptables: &saveFormatIPTables{FakeIPTables: testiptables.NewFake()},
+		dial: func(network, address string, timeout time.Duration) (net.Conn, error) {
+			if !reachable {
+				return nil, errors.New("connection timed out")
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		},
+	}
+	verify := &VerifyConfig{Endpoints: []string{"10.1.2.3:6443"}, GracePeriod: time.Millisecond}
+
+	cfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.0.0.0/8"})
+	cfg.Verify = verify
+	app.updateConfig(cfg)
+	if got := app.AppliedConfig(); got != cfg {
+		t.Errorf("App.AppliedConfig() = %+v, want %+v", got, cfg)
+	}
+
+	// Rolled back config is not reported applied
+	reachable = false
+	newCfg := NewAppConfig("TEST-CHAIN", []string{"1234"}, []string{"10.1.0.0/16"})
+	newCfg.Verify = verify
+	app.updateConfig(newCfg)
+	if got := app.AppliedConfig(); got != cfg {
+		t.Errorf("App.AppliedConfig() = %+v, want %+v", got, cfg)
+	}
+
+	// Same config applied on retry
+	reachable = true
+	app.updateConfig(newCfg)
+	if got := app.AppliedConfig(); got != newCfg {
+		t.Errorf("App.AppliedConfig() = %+v, want %+v", got, newCfg)
+	}
+}
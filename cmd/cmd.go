@@ -15,12 +15,16 @@
 package cmd
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/3cky/kube-restrict-ip/util"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -31,23 +35,79 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/3cky/kube-restrict-ip/app"
+	"github.com/3cky/kube-restrict-ip/config"
 	"github.com/3cky/kube-restrict-ip/log"
+	"github.com/3cky/kube-restrict-ip/metrics"
 	"github.com/3cky/kube-restrict-ip/pkg/build"
+	"github.com/3cky/kube-restrict-ip/source"
+	"github.com/3cky/kube-restrict-ip/watcher"
 )
 
+// Fetcher of allowed networks sources defined in config file
+var sourceFetcher *source.Fetcher
+
+// Contents of the last read config file (merged config files in config directory mode)
+var configData []byte
+
+// Directory with config files to merge, if defined
+var configDir string
+
+// Environment variables prefix
+const EnvPrefix = "KRI"
+
+// Startup policy in effect due to invalid config file, empty if config file is valid
+var startupPolicyInEffect string
+
 const (
 	FlagRunOnce             = "once"
+	FlagDaemon              = "daemon"
+	FlagReconcileInterval   = "reconcile-interval"
+	FlagCleanupOnExit       = "cleanup-on-exit"
 	FlagVersion             = "version"
 	FlagConfigCheckInterval = "check-interval"
 	FlagIpChainName         = "ip-chain"
 	FlagRestrictedPorts     = "restricted-ports"
 	FlagAllowedNetworks     = "allowed-networks"
+	FlagDeniedNetworks      = "denied-networks"
+	FlagRejectAction        = "action"
+	FlagRejectWith          = "reject-with"
+	FlagDnsRefreshInterval  = "dns-refresh-interval"
+	FlagSourcesCacheDir     = "sources-cache-dir"
+	FlagApiAddress          = "api-address"
+	FlagApiTokenFile        = "api-token-file"
+	FlagApiAllowRemote      = "api-allow-remote"
+	FlagGrantsFile          = "grants-file"
+	FlagGrantMaxTtl         = "grant-max-ttl"
+	FlagStateFile           = "state-file"
+	FlagStartupPolicy       = "startup-policy"
+	FlagLastKnownGoodFile   = "last-known-good-file"
+	FlagSafety              = "safety"
+	FlagCriticalSources     = "critical-sources"
+	FlagKubeconfig          = "kubeconfig"
+	FlagMetricsAddress      = "metrics-address"
+	FlagStatsInterval       = "stats-interval"
+	FlagStaleWindow         = "stale-window"
+	FlagInstance            = "instance"
 	FlagConfigFileName      = "config-file"
-
-	ConfigCheckInterval   = "checkInterval"
-	ConfigIpChainName     = "ipChain"
-	ConfigRestrictedPorts = "restrictedPorts"
-	ConfigAllowedNetworks = "allowedNetworks"
+	FlagConfigDir           = "config-dir"
+
+	ConfigCheckInterval         = config.KeyCheckInterval
+	ConfigIpChainName           = config.KeyIpChainName
+	ConfigRestrictedPorts       = config.KeyRestrictedPorts
+	ConfigAllowedNetworks       = config.KeyAllowedNetworks
+	ConfigDeniedNetworks        = config.KeyDeniedNetworks
+	ConfigRejectAction          = config.KeyRejectAction
+	ConfigRejectWith            = config.KeyRejectWith
+	ConfigDnsRefreshInterval    = config.KeyDnsRefreshInterval
+	ConfigAllowedNetworkSources = config.KeyAllowedNetworkSources
+	ConfigSourcesCacheDir       = config.KeySourcesCacheDir
+	ConfigVerify                = config.KeyVerify
+	ConfigSafety                = config.KeySafety
+	ConfigCriticalSources       = config.KeyCriticalSources
+
+	StartupPolicyFailOpen      = "failOpen"
+	StartupPolicyFailClosed    = "failClosed"
+	StartupPolicyLastKnownGood = "lastKnownGood"
 )
 
 func NewCmd() *cobra.Command {
@@ -57,20 +117,23 @@ func NewCmd() *cobra.Command {
 		Run:  runCmd,
 	}
 	initCmd(cmd)
+	cmd.AddCommand(newRunCmd())
+	cmd.AddCommand(newApplyCmd())
+	cmd.AddCommand(newDiffCmd())
+	cmd.AddCommand(newStatusCmd())
+	cmd.AddCommand(newCleanupCmd())
+	cmd.AddCommand(newStaleCmd())
+	cmd.AddCommand(newVersionCmd())
+	cmd.AddCommand(newGrantCmd())
+	cmd.AddCommand(newValidateCmd())
+	cmd.AddCommand(newSchemaCmd())
 	return cmd
 }
 
 func initCmd(cmd *cobra.Command) {
 	// Command-related flags set
 	f := cmd.Flags()
-	f.BoolP(FlagVersion, "V", false, "display the build number and timestamp")
-	f.Bool(FlagRunOnce, false, "run once and exit")
-	f.StringP(FlagConfigFileName, "c", "",
-		fmt.Sprintf("config file name to watch (implied '%s' if omitted)", FlagRunOnce))
-	f.DurationP(FlagConfigCheckInterval, "t", 60*time.Second, "config file update check interval")
-	f.String(FlagIpChainName, "KUBE-RESTRICT-IP", "iptables chain name")
-	f.StringSlice(FlagRestrictedPorts, nil, "restricted ports")
-	f.StringSlice(FlagAllowedNetworks, nil, "allowed networks")
+	addFlags(f)
 
 	// Merge flags
 	pflag.CommandLine.SetNormalizeFunc(func(_ *pflag.FlagSet, name string) pflag.NormalizedName {
@@ -94,6 +157,45 @@ func initCmd(cmd *cobra.Command) {
 	defer log.Flush()
 }
 
+// Add app flags to the flag set
+func addFlags(f *pflag.FlagSet) {
+	f.BoolP(FlagVersion, "V", false, "display the build number and timestamp")
+	f.Bool(FlagRunOnce, false, "run once and exit")
+	f.Bool(FlagDaemon, false, fmt.Sprintf("keep running without config file (instead of implied '%s')", FlagRunOnce))
+	f.Duration(FlagReconcileInterval, 5*time.Minute, "running rules drift check interval (disabled if 0)")
+	f.Bool(FlagCleanupOnExit, false, "remove rules on exit (not applied with 'once')")
+	f.StringP(FlagConfigFileName, "c", "",
+		fmt.Sprintf("config file name to watch (implied '%s' if omitted)", FlagRunOnce))
+	f.String(FlagConfigDir, "", fmt.Sprintf("directory with config files to merge and watch (instead of '%s')",
+		FlagConfigFileName))
+	f.DurationP(FlagConfigCheckInterval, "t", 60*time.Second, "config file update check interval")
+	f.String(FlagIpChainName, config.DefaultIpChainName, "iptables chain name")
+	f.String(FlagInstance, "", "instance ID to run multiple independent instances on the node (appended to chain name)")
+	f.StringSlice(FlagRestrictedPorts, nil, "restricted ports")
+	f.StringSlice(FlagAllowedNetworks, nil, "allowed networks")
+	f.StringSlice(FlagDeniedNetworks, nil, "denied networks (take precedence over allowed networks)")
+	f.String(FlagRejectAction, "", "action for not allowed networks (REJECT, DROP or custom target)")
+	f.String(FlagRejectWith, "", "reject type for REJECT action (default depends on protocol)")
+	f.Duration(FlagDnsRefreshInterval, app.DefaultDnsRefreshInterval, "allowed networks host names refresh interval")
+	f.String(FlagSourcesCacheDir, "", "directory to cache last fetched allowed networks sources data")
+	f.String(FlagApiAddress, "", "address (host:port) of local API for temporary access grants (disabled if empty)")
+	f.String(FlagApiTokenFile, "", "file with local API bearer token")
+	f.Bool(FlagApiAllowRemote, false, "allow local API address to be non-loopback one, reachable from the network")
+	f.String(FlagGrantsFile, "", "file to persist temporary access grants")
+	f.Duration(FlagGrantMaxTtl, 24*time.Hour, "maximum temporary access grant TTL")
+	f.String(FlagStateFile, "", "file to persist last applied state to")
+	f.String(FlagStartupPolicy, "", fmt.Sprintf("policy on invalid config file at startup (%s, %s or %s, exit if empty)",
+		StartupPolicyFailOpen, StartupPolicyFailClosed, StartupPolicyLastKnownGood))
+	f.String(FlagLastKnownGoodFile, "", "file to cache last valid config file copy to")
+	f.String(FlagSafety, app.SafetyAllow, fmt.Sprintf("mode for critical sources rejected by rules (%s, %s or %s)",
+		app.SafetyAllow, app.SafetyRefuse, app.SafetyOff))
+	f.String(FlagMetricsAddress, "", "address (host:port) to serve Prometheus metrics on (disabled if empty)")
+	f.Duration(FlagStatsInterval, time.Minute, "rules traffic counters read interval for metrics and hits tracking (disabled if 0)")
+	f.Duration(FlagStaleWindow, app.DefaultStaleWindow, "window allowed networks entries without hits over are reported stale")
+	f.StringSlice(FlagCriticalSources, nil, "critical source addresses in addition to loopback, node and API server ones")
+	f.String(FlagKubeconfig, "", "kubeconfig file to get API server critical source from (KUBECONFIG if empty)")
+}
+
 func checkErr(err error) {
 	if err != nil {
 		glog.Fatalf("error: %v", err)
@@ -102,69 +204,363 @@ func checkErr(err error) {
 
 func runCmd(cmd *cobra.Command, _ []string) {
 	if f, _ := cmd.Flags().GetBool(FlagVersion); f {
-		fmt.Printf("Build version: %s\n", build.Version)
-		fmt.Printf("Build timestamp: %s\n", build.Timestamp)
+		printVersion()
 		return
 	}
 
-	cf, err := cmd.Flags().GetString(FlagConfigFileName)
+	once, daemon, err := runModeFlags(cmd.Flags())
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	appCfg, watch := loadAppConfig(cmd)
+	if isRunOnce(once, daemon, watch) {
+		applyAppConfig(cmd.Flags(), appCfg)
+	} else {
+		runDaemon(cmd.Flags(), appCfg, watch)
+	}
+}
+
+// Get run once and daemon mode flags, which are mutually exclusive
+func runModeFlags(f *pflag.FlagSet) (bool, bool, error) {
+	once, err := f.GetBool(FlagRunOnce)
+	if err != nil {
+		return false, false, err
+	}
+	daemon, err := f.GetBool(FlagDaemon)
+	if err != nil {
+		return false, false, err
+	}
+	if once && daemon {
+		return false, false, errors.New(fmt.Sprintf("'--%s' and '--%s' options are mutually exclusive",
+			FlagRunOnce, FlagDaemon))
+	}
+	return once, daemon, nil
+}
+
+// Check config should be applied once and exit. Without config file to watch,
+// run once is implied unless daemon mode is requested
+func isRunOnce(once, daemon, watch bool) bool {
+	return once || (!watch && !daemon)
+}
+
+func printVersion() {
+	fmt.Printf("Build version: %s\n", build.Version)
+	fmt.Printf("Build timestamp: %s\n", build.Timestamp)
+}
+
+// Set config file or config directory to read config from, as defined by flags.
+// Returns false if neither config file nor config directory is defined
+func setConfigSource(f *pflag.FlagSet) bool {
+	cf, err := f.GetString(FlagConfigFileName)
 	if err != nil {
 		glog.Fatalf("can't get config file name: %v", err)
 	}
 
-	if cf != "" {
-		cf = strings.TrimSpace(cf)
+	dir, err := f.GetString(FlagConfigDir)
+	if err != nil {
+		glog.Fatalf("can't get config directory: %v", err)
+	}
 
+	if cf != "" && dir != "" {
+		glog.Fatalf("'--%s' and '--%s' options are mutually exclusive", FlagConfigFileName, FlagConfigDir)
+	}
+
+	switch {
+	case dir != "":
+		configDir = strings.TrimSpace(dir)
+		glog.V(2).Infof("using config directory: %s", configDir)
+	case cf != "":
+		cf = strings.TrimSpace(cf)
 		glog.V(2).Infof("using config file: %s", cf)
+		viper.SetConfigFile(cf)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Load app config from config file or config directory, if defined, applying startup policy
+// if config is invalid, or from flags and environment variables otherwise. Returns true if
+// config is loaded from config files, which could be watched for updates. Nil config
+// means running rules should be kept untouched until valid config is read
+func loadAppConfig(cmd *cobra.Command) (*app.AppConfig, bool) {
+	policy, err := cmd.Flags().GetString(FlagStartupPolicy)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if policy != "" && !util.ToSet([]string{StartupPolicyFailOpen, StartupPolicyFailClosed,
+		StartupPolicyLastKnownGood})[policy] {
+		glog.Fatalf("invalid startup policy: %s", policy)
+	}
 
-		if err := readConfigFile(cmd, cf); err != nil {
-			glog.Fatalf("can't read config file: %v", err)
+	if !setConfigSource(cmd.Flags()) {
+		// No config file specified, use flags and environment variables only for config creating
+		checkErr(bindConfig(cmd.Flags()))
+		appCfg, err := newAppConfigFromFlags()
+		if err != nil {
+			glog.Fatalf("error: %v", err)
 		}
+		return appCfg, false
+	}
 
-		appCfg, err := newAppConfigFromFile()
+	appCfg, err := loadConfigFile(cmd)
+	if err != nil {
+		appCfg, err = newStartupPolicyAppConfig(cmd.Flags(), err)
 		if err != nil {
 			glog.Fatalf("config file error: %v", err)
 		}
+	} else {
+		saveLastKnownGoodConfig(cmd.Flags())
+	}
 
-		once, err := cmd.Flags().GetBool(FlagRunOnce)
-		if err != nil {
-			glog.Fatal(err)
+	return appCfg, true
+}
+
+// Apply app config once and exit
+func applyAppConfig(f *pflag.FlagSet, appCfg *app.AppConfig) {
+	if appCfg == nil {
+		glog.Warning("no config to apply, running rules are kept untouched")
+		return
+	}
+	runAppOnce(f, appCfg)
+}
+
+// Run app until exit signal is received, watching config files for updates, if any
+func runDaemon(f *pflag.FlagSet, appCfg *app.AppConfig, watch bool) {
+	cfgCheckInterval := viper.GetDuration(ConfigCheckInterval)
+	if watch {
+		if cfgCheckInterval == 0 {
+			glog.Fatal("config file update check interval can't be 0")
 		}
+		glog.V(2).Infof("will watch config file for updates, polling every %v", cfgCheckInterval)
+	} else {
+		glog.V(2).Info("running without config file")
+	}
+	runApp(f, appCfg, cfgCheckInterval)
+}
 
-		if once {
-			runAppOnce(appCfg)
-		} else {
-			cfgCheckInterval := viper.GetDuration(ConfigCheckInterval)
-			if cfgCheckInterval == 0 {
-				glog.Fatal("config file update check interval can't be 0")
+// Read config file and create app config from it
+func loadConfigFile(cmd *cobra.Command) (*app.AppConfig, error) {
+	if err := readConfigFile(cmd); err != nil {
+		return nil, errors.New(fmt.Sprintf("can't read config file: %v", err))
+	}
+	return newAppConfigFromFile()
+}
+
+// Create app config according to the startup policy in case of invalid config file,
+// nil config means running rules should be kept untouched until valid config is read
+func newStartupPolicyAppConfig(f *pflag.FlagSet, cfgErr error) (*app.AppConfig, error) {
+	policy, err := f.GetString(FlagStartupPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	chainName, err := ipChainName()
+	if err != nil {
+		return nil, err
+	}
+
+	var appCfg *app.AppConfig
+	switch policy {
+	case "":
+		return nil, cfgErr
+	case StartupPolicyFailOpen, StartupPolicyFailClosed:
+		ports := app.NewApp(app.NewAppConfig(chainName, nil, nil)).RunningRestrictedPorts()
+		if ports == nil {
+			if ports = getStringSlice(ConfigRestrictedPorts); util.ValidatePorts(ports) != nil {
+				ports = nil
 			}
-			glog.V(2).Infof("will check config file for updates every %v", cfgCheckInterval)
-			runApp(appCfg, cfgCheckInterval)
 		}
-	} else {
-		// No config file specified, use flags only for config creating
-		appCfg, err := newAppConfigFromFlags(cmd.Flags())
+		if ports == nil || len(ports) == 0 {
+			if policy == StartupPolicyFailClosed {
+				return nil, errors.New(fmt.Sprintf("%v (no restricted ports known to apply %s startup policy)",
+					cfgErr, policy))
+			}
+			// Nothing is restricted, so nothing to open
+			break
+		}
+		if policy == StartupPolicyFailOpen {
+			appCfg = app.NewFailOpenConfig(chainName, ports)
+		} else {
+			appCfg = app.NewFailClosedConfig(chainName, ports)
+		}
+	case StartupPolicyLastKnownGood:
+		appCfg, err = loadLastKnownGoodConfig(f)
 		if err != nil {
-			glog.Fatalf("error: %v", err)
+			return nil, errors.New(fmt.Sprintf("%v (can't apply %s startup policy: %v)", cfgErr, policy, err))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid startup policy: %s", policy))
+	}
+
+	if appCfg != nil {
+		appCfg.StartupPolicy = policy
+	}
+
+	if appCfg != nil && policy != StartupPolicyLastKnownGood {
+		if err := applySafety(appCfg); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v (can't apply %s startup policy: %v)", cfgErr, policy, err))
 		}
+	}
+
+	glog.Errorf("config file error: %v", cfgErr)
+	glog.Warningf("%s startup policy is in effect until config file is fixed", policy)
+	startupPolicyInEffect = policy
+	metrics.SetStartupPolicy(policy)
+
+	return appCfg, nil
+}
+
+// Cache last read config file copy as the last known good one, if enabled
+func saveLastKnownGoodConfig(f *pflag.FlagSet) {
+	if startupPolicyInEffect != "" {
+		glog.Infof("config file is valid now, %s startup policy is not in effect anymore", startupPolicyInEffect)
+		startupPolicyInEffect = ""
+		metrics.SetStartupPolicy("")
+	}
 
-		runAppOnce(appCfg)
+	fileName, err := f.GetString(FlagLastKnownGoodFile)
+	checkErr(err)
+	if fileName == "" || configData == nil {
+		return
+	}
+
+	if err := util.WriteFileAtomic(fileName, configData, 0644); err != nil {
+		glog.Errorf("can't save last known good config file: %v", err)
 	}
 }
 
-func runAppOnce(appCfg *app.AppConfig) {
-	newApp := app.NewApp(appCfg)
-	newApp.RunOnce()
+// Create app config from the last known good config file copy
+func loadLastKnownGoodConfig(f *pflag.FlagSet) (*app.AppConfig, error) {
+	fileName, err := f.GetString(FlagLastKnownGoodFile)
+	if err != nil {
+		return nil, err
+	}
+	if fileName == "" {
+		return nil, errors.New(fmt.Sprintf("no last known good config file defined (use '--%s' option)",
+			FlagLastKnownGoodFile))
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := readConfigData(data); err != nil {
+		return nil, err
+	}
+
+	glog.Infof("using last known good config file: %s", fileName)
+
+	return newAppConfigFromFile()
 }
 
-func runApp(appCfg *app.AppConfig, cfgCheckInterval time.Duration) {
-	cfgFile := viper.ConfigFileUsed()
+// Read config file set in viper or merged config directory files, keeping config contents
+func readInConfig() error {
+	if configDir != "" {
+		return readConfigDir()
+	}
 
-	cfgFileStat, err := os.Stat(cfgFile)
+	cf := viper.ConfigFileUsed()
+	if ext := strings.TrimPrefix(filepath.Ext(cf), "."); !util.ToSet(config.FileExts)[ext] {
+		return viper.UnsupportedConfigError(ext)
+	}
+	data, err := ioutil.ReadFile(cf)
 	if err != nil {
-		glog.Fatalf("can't stat config file: %v", err)
+		return err
+	}
+	if err := readConfigData(data); err != nil {
+		return err
 	}
+	configData = data
+	return nil
+}
 
+// Decode config data of any schema version strictly and read it into viper in flat format
+func readConfigData(data []byte) error {
+	cfg, err := config.Decode(data)
+	if err != nil {
+		return err
+	}
+	flat, err := cfg.MarshalFlat()
+	if err != nil {
+		return err
+	}
+	viper.SetConfigType("yaml")
+	return viper.ReadConfig(bytes.NewReader(flat))
+}
+
+// Read and merge config files in config directory
+func readConfigDir() error {
+	files, err := config.ListFiles(configDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New(fmt.Sprintf("no config files found in %s", configDir))
+	}
+
+	m, err := config.MergeFiles(files)
+	if err != nil {
+		return err
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := readConfigData(data); err != nil {
+		return err
+	}
+	configData = data
+
+	glog.V(2).Infof("merged config files: %v", files)
+	for _, key := range sortedKeys(m.Origins) {
+		origins := m.Origins[key]
+		items := make([]string, 0, len(origins))
+		for item := range origins {
+			items = append(items, item)
+		}
+		sort.Strings(items)
+		for _, item := range items {
+			glog.Infof("%s entry %s is defined in %s", key, item, strings.Join(origins[item], ", "))
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Create app with options from the flags
+func newApp(f *pflag.FlagSet, appCfg *app.AppConfig) *app.App {
+	a := app.NewApp(appCfg)
+	instance, err := instanceId()
+	checkErr(err)
+	a.SetInstance(instance)
+
+	stateFile, err := f.GetString(FlagStateFile)
+	checkErr(err)
+	if stateFile != "" {
+		glog.V(2).Infof("using state file: %s", stateFile)
+		a.SetStateFile(stateFile)
+	}
+
+	return a
+}
+
+func runAppOnce(f *pflag.FlagSet, appCfg *app.AppConfig) {
+	newApp(f, appCfg).RunOnce()
+}
+
+func runApp(f *pflag.FlagSet, appCfg *app.AppConfig, cfgCheckInterval time.Duration) {
 	cfgCh := make(chan *app.AppConfig)
 	doneCh := make(chan struct{})
 	signalCh := make(chan os.Signal, 1)
@@ -176,8 +572,57 @@ func runApp(appCfg *app.AppConfig, cfgCheckInterval time.Duration) {
 		syscall.SIGQUIT,
 	)
 
-	newApp := app.NewApp(appCfg)
-	go newApp.Run(cfgCh, doneCh)
+	a := newApp(f, appCfg)
+
+	reconcileInterval, err := f.GetDuration(FlagReconcileInterval)
+	checkErr(err)
+	a.SetReconcileInterval(reconcileInterval)
+	cleanupOnExit, err := f.GetBool(FlagCleanupOnExit)
+	checkErr(err)
+	a.SetCleanupOnExit(cleanupOnExit)
+
+	apiServer, err := startApi(f, a)
+	if err != nil {
+		glog.Fatalf("can't start API server: %v", err)
+	}
+	if apiServer != nil {
+		defer apiServer.Stop()
+	}
+
+	metricsServer, err := startMetrics(f)
+	if err != nil {
+		glog.Fatalf("can't start metrics server: %v", err)
+	}
+	if metricsServer != nil {
+		defer metricsServer.Stop()
+	}
+
+	statsInterval, err := f.GetDuration(FlagStatsInterval)
+	checkErr(err)
+	a.SetStatsInterval(statsInterval)
+	staleWindow, err := f.GetDuration(FlagStaleWindow)
+	checkErr(err)
+	a.SetStaleWindow(staleWindow)
+
+	go a.Run(cfgCh, doneCh)
+
+	// Last config notified to app, it could be not applied yet or failed to apply
+	lastAppCfg := appCfg
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// Watch config files, if any
+	var w *watcher.Watcher
+	var changesCh <-chan struct{}
+	if configDir != "" || viper.ConfigFileUsed() != "" {
+		w = newConfigWatcher(cfgCheckInterval)
+		go w.Run(stopCh)
+		changesCh = w.Changes()
+	}
+
+	// Allowed networks sources are refreshed independently of config file checks
+	refreshCh := sourcesRefreshTimer()
 
 Free:
 	for {
@@ -188,20 +633,31 @@ Free:
 			close(cfgCh)
 			<-doneCh
 			break Free // I want to :)
-		case <-time.After(cfgCheckInterval):
-			s, err := os.Stat(cfgFile)
+		case <-refreshCh:
+			glog.V(2).Info("refreshing allowed networks sources")
+			// Sources due to refresh are rescheduled regardless of fetch and config errors
+			changed := sourceFetcher.Refresh()
+			refreshCh = sourcesRefreshTimer()
+			if !changed {
+				continue
+			}
+			newAppCfg, err := newAppConfigFromFile()
 			if err != nil {
-				glog.Errorf("can't stat config file: %v", err)
+				glog.Errorf("config file error: %v", err)
+				metrics.CountConfigUpdate(metrics.ConfigUpdateError)
 				continue
 			}
-			if cfgFileStat.Size() == s.Size() && !cfgFileStat.ModTime().Before(s.ModTime()) {
-				glog.V(4).Infof("config file is unchanged")
+			if isConfigUnchanged(lastAppCfg, a.AppliedConfig(), newAppCfg) {
 				continue
 			}
+			// Notify app about allowed networks sources update
+			cfgCh <- newAppCfg
+			lastAppCfg = newAppCfg
+		case <-changesCh:
 			glog.Infof("config file is updated")
-			cfgFileStat = s
-			if err := viper.ReadInConfig(); err != nil {
+			if err := readInConfig(); err != nil {
 				glog.Errorf("can't read config file: %v", err)
+				metrics.CountConfigUpdate(metrics.ConfigUpdateError)
 				continue
 			}
 			newCfgCheckInterval := viper.GetDuration(ConfigCheckInterval)
@@ -209,97 +665,235 @@ Free:
 				glog.Errorf("invalid new config file check interval: %v", newCfgCheckInterval)
 			} else if newCfgCheckInterval != cfgCheckInterval {
 				cfgCheckInterval = newCfgCheckInterval
+				w.SetInterval(cfgCheckInterval)
 				glog.V(2).Infof("config file check interval changed to %v", cfgCheckInterval)
 			}
 			newAppCfg, err := newAppConfigFromFile()
+			// Sources could be changed by config file update
+			refreshCh = sourcesRefreshTimer()
 			if err != nil {
 				glog.Errorf("config file error: %v", err)
+				metrics.CountConfigUpdate(metrics.ConfigUpdateError)
+				continue
+			}
+			saveLastKnownGoodConfig(f)
+			if isConfigUnchanged(lastAppCfg, a.AppliedConfig(), newAppCfg) {
 				continue
 			}
 			// Notify app about config file update
 			cfgCh <- newAppCfg
+			lastAppCfg = newAppCfg
 		}
 	}
 
 	glog.V(2).Info("exiting")
 }
 
-func newAppConfigFromFlags(f *pflag.FlagSet) (*app.AppConfig, error) {
-	chainName, err := f.GetString(FlagIpChainName)
-	if err != nil {
-		return nil, err
+// Checks new config is equal to the last one notified to app and to the one applied by app,
+// so the config failed to apply (or rolled back) is notified again
+func isConfigUnchanged(lastAppCfg, appliedCfg, newAppCfg *app.AppConfig) bool {
+	if lastAppCfg == nil || !lastAppCfg.Equal(newAppCfg) || appliedCfg == nil || !appliedCfg.Equal(newAppCfg) {
+		glog.Infof("config hash: %s", newAppCfg.Hash())
+		return false
 	}
+	glog.V(2).Infof("config is unchanged, hash: %s", newAppCfg.Hash())
+	metrics.CountConfigUpdate(metrics.ConfigUpdateUnchanged)
+	return true
+}
 
-	ports, err := f.GetStringSlice(FlagRestrictedPorts)
+// Start metrics server, if enabled
+func startMetrics(f *pflag.FlagSet) (*metrics.Server, error) {
+	address, err := f.GetString(FlagMetricsAddress)
 	if err != nil {
 		return nil, err
 	}
-	if ports == nil || len(ports) == 0 {
-		return nil, errors.New(fmt.Sprintf("no restricted ports defined (use '--%s' option)", FlagRestrictedPorts))
-	}
-	if err := util.ValidatePorts(ports); err != nil {
-		return nil, err
+	if address == "" {
+		return nil, nil
 	}
+	return metrics.Start(address)
+}
 
-	nets, err := f.GetStringSlice(FlagAllowedNetworks)
-	if err != nil {
-		return nil, err
+// Create watcher for config file or config directory files
+func newConfigWatcher(interval time.Duration) *watcher.Watcher {
+	if configDir != "" {
+		return watcher.New([]string{configDir}, func() ([]string, error) {
+			return config.ListFiles(configDir)
+		}, interval)
 	}
-	if nets == nil || len(nets) == 0 {
-		return nil, errors.New(fmt.Sprintf("no allowed networks defined (use '--%s' option)", FlagAllowedNetworks))
+	return watcher.NewFileWatcher(viper.ConfigFileUsed(), interval)
+}
+
+// Get timer channel for the next allowed networks sources refresh, nil if there are no sources
+func sourcesRefreshTimer() <-chan time.Time {
+	if sourceFetcher == nil {
+		return nil
 	}
-	if err := util.ValidateNetworks(nets); err != nil {
-		return nil, err
+	if d, ok := sourceFetcher.NextRefresh(); ok {
+		return time.After(d)
 	}
+	return nil
+}
 
-	glog.V(2).Infof("chain name: %s, restricted ports: %v, allowed networks: %v", chainName, ports, nets)
-
-	return app.NewAppConfig(chainName, ports, nets), nil
+// Create app config from flags and environment variables, by the same code as config file is read with
+func newAppConfigFromFlags() (*app.AppConfig, error) {
+	appCfg, err := newAppConfigFromFile()
+	if errs, ok := err.(config.ValueErrors); ok {
+		// Point to flags and environment variables to define required values with
+		for _, e := range errs {
+			if flag, ok := configFlags[e.Key]; ok && e.Missing {
+				e.Err = errors.New(fmt.Sprintf("no %s defined (use '--%s' option or %s environment variable)",
+					strings.Replace(flag, "-", " ", -1), flag, envName(flag)))
+			}
+		}
+	}
+	return appCfg, err
 }
 
+// Create app config from config values of config file, flags and environment variables
 func newAppConfigFromFile() (*app.AppConfig, error) {
-	chainName := viper.GetString(ConfigIpChainName)
-
-	ports := viper.GetStringSlice(ConfigRestrictedPorts)
-	if ports == nil || len(ports) == 0 {
-		return nil, errors.New(fmt.Sprintf("no restricted ports defined (add '%s' section)", ConfigRestrictedPorts))
-	}
-	if err := util.ValidatePorts(ports); err != nil {
+	// Invalid instance ID is reported by config check along with invalid config values
+	instance, _ := instanceId()
+	appCfg, err := config.NewAppConfig(viper.GetViper(), instance, fetchAllowedNetworkSources)
+	if err != nil {
 		return nil, err
 	}
+	warnShadowedNetworks(appCfg.DeniedNetworks, appCfg.AllowedNetworks)
 
-	nets := viper.GetStringSlice(ConfigAllowedNetworks)
-	if nets == nil || len(nets) == 0 {
-		return nil, errors.New(fmt.Sprintf("no allowed networks defined (add '%s' section)", ConfigAllowedNetworks))
-	}
-	if err := util.ValidateNetworks(nets); err != nil {
+	glog.V(2).Infof("chain name: %s, restricted ports: %v, allowed networks: %v, denied networks: %v, action: %v",
+		appCfg.IpChainName, appCfg.RestrictedPorts, appCfg.AllowedNetworks, appCfg.DeniedNetworks, appCfg.RejectAction)
+
+	if err := applySafety(appCfg); err != nil {
 		return nil, err
 	}
 
-	glog.V(2).Infof("chain name: %s, restricted ports: %v, allowed networks: %v", chainName, ports, nets)
+	return appCfg, nil
+}
 
-	return app.NewAppConfig(chainName, ports, nets), nil
+// Check config rules don't reject critical sources, according to the safety mode from config file
+func applySafety(appCfg *app.AppConfig) error {
+	return app.ApplySafety(appCfg, viper.GetString(ConfigSafety),
+		app.CriticalSources(getStringSlice(ConfigCriticalSources), kubeconfigFile()))
 }
 
-func readConfigFile(cmd *cobra.Command, cf string) error {
-	viper.SetConfigFile(cf)
+// Get kubeconfig file to find API server in, from command line or KUBECONFIG environment variable
+func kubeconfigFile() string {
+	kubeconfig, err := pflag.CommandLine.GetString(FlagKubeconfig)
+	checkErr(err)
+	if kubeconfig == "" {
+		// Only the first file of the list is used
+		if files := filepath.SplitList(os.Getenv("KUBECONFIG")); len(files) > 0 {
+			kubeconfig = files[0]
+		}
+	}
+	return kubeconfig
+}
 
-	if err := viper.BindPFlag(ConfigCheckInterval, cmd.Flags().Lookup(FlagConfigCheckInterval)); err != nil {
-		return err
+// Fetch networks from allowed networks sources defined in config file
+func fetchAllowedNetworkSources(sources []source.Source) ([]string, error) {
+	if sourceFetcher == nil {
+		if len(sources) == 0 {
+			return nil, nil
+		}
+		sourceFetcher = source.NewFetcher(viper.GetString(ConfigSourcesCacheDir))
 	}
-	if err := viper.BindPFlag(ConfigIpChainName, cmd.Flags().Lookup(FlagIpChainName)); err != nil {
-		return err
+	sourceFetcher.Retain(sources)
+
+	var nets []string
+	for _, s := range sources {
+		sourceNets, err := sourceFetcher.Networks(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, sourceNets...)
 	}
-	if err := viper.BindPFlag(ConfigRestrictedPorts, cmd.Flags().Lookup(FlagRestrictedPorts)); err != nil {
-		return err
+
+	return nets, nil
+}
+
+// Log warnings for networks which rules can never match due to rules ordering
+func warnShadowedNetworks(denied, allowed []string) {
+	for _, w := range util.GetShadowedNetworks(denied, allowed) {
+		glog.Warning(w)
 	}
-	if err := viper.BindPFlag(ConfigAllowedNetworks, cmd.Flags().Lookup(FlagAllowedNetworks)); err != nil {
+}
+
+func readConfigFile(cmd *cobra.Command) error {
+	if err := bindConfig(cmd.Flags()); err != nil {
 		return err
 	}
 
-	if err := viper.ReadInConfig(); err != nil {
+	if err := readInConfig(); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Config keys settable by flags and environment variables, with flag names
+var configFlags = map[string]string{
+	ConfigCheckInterval:      FlagConfigCheckInterval,
+	ConfigIpChainName:        FlagIpChainName,
+	ConfigRestrictedPorts:    FlagRestrictedPorts,
+	ConfigAllowedNetworks:    FlagAllowedNetworks,
+	ConfigDeniedNetworks:     FlagDeniedNetworks,
+	ConfigRejectAction:       FlagRejectAction,
+	ConfigRejectWith:         FlagRejectWith,
+	ConfigSourcesCacheDir:    FlagSourcesCacheDir,
+	ConfigDnsRefreshInterval: FlagDnsRefreshInterval,
+	ConfigSafety:             FlagSafety,
+	ConfigCriticalSources:    FlagCriticalSources,
+}
+
+// Bind config keys to flags and environment variables. Config values are taken from
+// (in order of precedence): flags, environment variables, config file, flags defaults
+func bindConfig(f *pflag.FlagSet) error {
+	for key, flag := range configFlags {
+		if err := viper.BindPFlag(key, f.Lookup(flag)); err != nil {
+			return err
+		}
+		if err := viper.BindEnv(key, envName(flag)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get network rules chain name with app instance ID embedded, if any
+func ipChainName() (string, error) {
+	instance, err := instanceId()
+	if err != nil {
+		return "", err
+	}
+	return util.InstanceChainName(viper.GetString(ConfigIpChainName), instance), nil
+}
+
+// Get network rules chain name of running rules, exit on invalid instance ID
+func runningChainName() string {
+	chainName, err := ipChainName()
+	checkErr(err)
+	return chainName
+}
+
+// Get app instance ID from flags or environment variable. Invalid instance ID
+// is returned along with validation error
+func instanceId() (string, error) {
+	instance, err := pflag.CommandLine.GetString(FlagInstance)
+	if err != nil {
+		return "", err
+	}
+	if instance == "" {
+		instance = os.Getenv(envName(FlagInstance))
+	}
+	return instance, util.ValidateInstance(viper.GetString(ConfigIpChainName), instance)
+}
+
+// Get environment variable name for the flag, e.g. KRI_RESTRICTED_PORTS for 'restricted-ports'
+func envName(flag string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// Get config value as string slice. String values (i.e. environment variables ones)
+// are split by commas and whitespace
+func getStringSlice(key string) []string {
+	return config.StringSlice(viper.GetViper(), key)
+}
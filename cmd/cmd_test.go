@@ -0,0 +1,240 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/3cky/kube-restrict-ip/app"
+)
+
+// Set fresh viper and command line flags parsed from args, returns function restoring them
+func setTestFlags(t *testing.T, args []string) func() {
+	commandLine := pflag.CommandLine
+	viper.Reset()
+	configDir, configData, sourceFetcher = "", nil, nil
+
+	f := pflag.NewFlagSet("kube-restrict-ip", pflag.ContinueOnError)
+	addFlags(f)
+	if err := f.Parse(args); err != nil {
+		t.Fatalf("can't parse flags %v: %v", args, err)
+	}
+	pflag.CommandLine = f
+
+	return func() {
+		pflag.CommandLine = commandLine
+		viper.Reset()
+	}
+}
+
+// Set environment variables, returns function restoring them
+func setTestEnv(env map[string]string) func() {
+	saved := map[string]*string{}
+	for name, value := range env {
+		if v, ok := os.LookupEnv(name); ok {
+			saved[name] = &v
+		} else {
+			saved[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, value := range saved {
+			if value != nil {
+				os.Setenv(name, *value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+func TestBindConfig(t *testing.T) {
+	type args struct {
+		flags []string
+		env   map[string]string
+		file  string
+	}
+	type want struct {
+		chain string
+		ports []string
+		nets  []string
+	}
+	const file = `
+ipChain: FILE-CHAIN
+restrictedPorts: [22]
+allowedNetworks: [10.0.0.0/8]
+`
+	tests := []struct {
+		name    string
+		args    args
+		want    want
+		wantErr bool
+	}{
+		{
+			name: "file",
+			args: args{file: file},
+			want: want{chain: "FILE-CHAIN", ports: []string{"22"}, nets: []string{"10.0.0.0/8"}},
+		},
+		{
+			name: "env over file",
+			args: args{file: file, env: map[string]string{
+				"KRI_IP_CHAIN":         "ENV-CHAIN",
+				"KRI_RESTRICTED_PORTS": "80, 443",
+				"KRI_ALLOWED_NETWORKS": "192.168.0.0/16 172.16.0.0/12",
+			}},
+			want: want{chain: "ENV-CHAIN", ports: []string{"80", "443"},
+				nets: []string{"192.168.0.0/16", "172.16.0.0/12"}},
+		},
+		{
+			name: "flags over env and file",
+			args: args{file: file,
+				flags: []string{"--ip-chain=FLAG-CHAIN", "--restricted-ports=8080,8443"},
+				env: map[string]string{
+					"KRI_IP_CHAIN":         "ENV-CHAIN",
+					"KRI_RESTRICTED_PORTS": "80,443",
+					"KRI_ALLOWED_NETWORKS": "192.168.0.0/16",
+				}},
+			want: want{chain: "FLAG-CHAIN", ports: []string{"8080", "8443"}, nets: []string{"192.168.0.0/16"}},
+		},
+		{
+			name: "flags and env without file",
+			args: args{
+				flags: []string{"--allowed-networks=10.0.0.0/8,192.168.0.0/16"},
+				env:   map[string]string{"KRI_RESTRICTED_PORTS": "80,\n443"},
+			},
+			want: want{chain: "KUBE-RESTRICT-IP", ports: []string{"80", "443"},
+				nets: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		},
+		{
+			name: "flags over env without file",
+			args: args{
+				flags: []string{"--restricted-ports=22", "--allowed-networks=10.0.0.0/8"},
+				env:   map[string]string{"KRI_RESTRICTED_PORTS": "80", "KRI_ALLOWED_NETWORKS": "192.168.0.0/16"},
+			},
+			want: want{chain: "KUBE-RESTRICT-IP", ports: []string{"22"}, nets: []string{"10.0.0.0/8"}},
+		},
+		{
+			name:    "invalid env value",
+			args:    args{file: file, env: map[string]string{"KRI_RESTRICTED_PORTS": "80,http"}},
+			wantErr: true,
+		},
+		{
+			name: "invalid env duration without file",
+			args: args{
+				flags: []string{"--restricted-ports=22", "--allowed-networks=10.0.0.0/8"},
+				env:   map[string]string{"KRI_DNS_REFRESH_INTERVAL": "-1m"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "invalid safety mode without file",
+			args:    args{flags: []string{"--restricted-ports=22", "--allowed-networks=10.0.0.0/8", "--safety=maybe"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid instance env",
+			args:    args{file: file, env: map[string]string{"KRI_INSTANCE": "team/a"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid instance flag without file",
+			args:    args{flags: []string{"--restricted-ports=22", "--allowed-networks=10.0.0.0/8", "--instance=a-NEW"}},
+			wantErr: true,
+		},
+		{
+			name:    "no allowed networks without file",
+			args:    args{flags: []string{"--restricted-ports=22"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Clear variables possibly set in test environment, empty ones are ignored
+			defer setTestEnv(map[string]string{"KRI_IP_CHAIN": "", "KRI_RESTRICTED_PORTS": "",
+				"KRI_ALLOWED_NETWORKS": "", "KRI_INSTANCE": "", "KRI_DNS_REFRESH_INTERVAL": ""})()
+			defer setTestEnv(tt.args.env)()
+			defer setTestFlags(t, tt.args.flags)()
+
+			if err := bindConfig(pflag.CommandLine); err != nil {
+				t.Fatalf("bindConfig() error = %v", err)
+			}
+			var appCfg *app.AppConfig
+			var err error
+			if tt.args.file != "" {
+				if err := readConfigData([]byte(tt.args.file)); err != nil {
+					t.Fatalf("readConfigData() error = %v", err)
+				}
+				appCfg, err = newAppConfigFromFile()
+			} else {
+				appCfg, err = newAppConfigFromFlags()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("app config error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := want{chain: appCfg.IpChainName, ports: appCfg.RestrictedPorts, nets: appCfg.AllowedNetworks}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("app config = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunMode(t *testing.T) {
+	type args struct {
+		flags []string
+		watch bool
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    bool
+		wantErr bool
+	}{
+		{name: "config file", args: args{watch: true}, want: false},
+		{name: "config file once", args: args{flags: []string{"--once"}, watch: true}, want: true},
+		{name: "no config file", args: args{}, want: true},
+		{name: "no config file once", args: args{flags: []string{"--once"}}, want: true},
+		{name: "no config file daemon", args: args{flags: []string{"--daemon"}}, want: false},
+		{name: "config file daemon", args: args{flags: []string{"--daemon"}, watch: true}, want: false},
+		{name: "once and daemon", args: args{flags: []string{"--once", "--daemon"}, watch: true}, wantErr: true},
+		{name: "once and daemon without config file", args: args{flags: []string{"--daemon", "--once"}},
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setTestFlags(t, tt.args.flags)()
+
+			once, daemon, err := runModeFlags(pflag.CommandLine)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runModeFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := isRunOnce(once, daemon, tt.args.watch); got != tt.want {
+				t.Errorf("isRunOnce() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
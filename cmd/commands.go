@@ -0,0 +1,330 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"github.com/3cky/kube-restrict-ip/app"
+	"github.com/3cky/kube-restrict-ip/config"
+	"github.com/3cky/kube-restrict-ip/state"
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+const (
+	FlagStatusOutput = "output"
+
+	StatusOutputTable = "table"
+	StatusOutputJson  = "json"
+	StatusOutputYaml  = "yaml"
+)
+
+func newRunCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "run",
+		Short: "Apply config and keep running, watching config files for updates, if any",
+		Args:  cobra.NoArgs,
+		Run:   runRunCmd,
+	}
+}
+
+func newApplyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "apply",
+		Short: "Apply config once and exit",
+		Args:  cobra.NoArgs,
+		Run:   runApplyCmd,
+	}
+}
+
+func newDiffCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "diff",
+		Short: "Show changes of running rules config would apply, exit with non-zero status if any",
+		Args:  cobra.NoArgs,
+		Run:   runDiffCmd,
+	}
+}
+
+func newStatusCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show running rules with traffic counters",
+		Long: "Show running rules with packet and byte counters, mapping every rule to the config entries " +
+			"it's created for, or running rules parsed back into config form (yaml output format).",
+		Args: cobra.NoArgs,
+		Run:  runStatusCmd,
+	}
+	cmd.Flags().StringP(FlagStatusOutput, "o", StatusOutputTable,
+		fmt.Sprintf("output format (%s, %s or %s)", StatusOutputTable, StatusOutputJson, StatusOutputYaml))
+	return cmd
+}
+
+func newCleanupCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "cleanup",
+		Short: "Remove running rules and state file",
+		Args:  cobra.NoArgs,
+		Run:   runCleanupCmd,
+	}
+}
+
+func newStaleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stale",
+		Short: "Show allowed networks entries without hits over the stale window",
+		Long: fmt.Sprintf("Show allowed networks config entries without traffic over the window set by '--%s' "+
+			"option, as tracked by running kube-restrict-ip in the state file set by '--%s' option.",
+			FlagStaleWindow, FlagStateFile),
+		Args: cobra.NoArgs,
+		Run:  runStaleCmd,
+	}
+	cmd.Flags().StringP(FlagStatusOutput, "o", StatusOutputTable,
+		fmt.Sprintf("output format (%s or %s)", StatusOutputTable, StatusOutputJson))
+	return cmd
+}
+
+func newVersionCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Display the build number and timestamp",
+		Args:  cobra.NoArgs,
+		Run: func(_ *cobra.Command, _ []string) {
+			printVersion()
+		},
+	}
+}
+
+func runRunCmd(cmd *cobra.Command, _ []string) {
+	if once, _ := cmd.Flags().GetBool(FlagRunOnce); once {
+		glog.Fatalf("'--%s' option can't be used with '%s' command, use 'apply' command instead",
+			FlagRunOnce, cmd.Name())
+	}
+	appCfg, watch := loadAppConfig(cmd)
+	runDaemon(cmd.Flags(), appCfg, watch)
+}
+
+func runApplyCmd(cmd *cobra.Command, _ []string) {
+	appCfg, _ := loadAppConfig(cmd)
+	applyAppConfig(cmd.Flags(), appCfg)
+}
+
+func runDiffCmd(cmd *cobra.Command, _ []string) {
+	appCfg, _ := loadAppConfig(cmd)
+	if appCfg == nil {
+		glog.Fatal("no config to compare running rules with")
+	}
+
+	a := newApp(cmd.Flags(), appCfg)
+	running, err := a.RunningRules()
+	if err != nil {
+		glog.Fatalf("can't fetch running rules: %v", err)
+	}
+
+	diff := util.DiffLines(running, a.PlannedRules())
+	if !util.HasChanges(diff) {
+		fmt.Println("running rules are up to date")
+		return
+	}
+	for _, l := range diff {
+		fmt.Println(l)
+	}
+	os.Exit(1)
+}
+
+func runStatusCmd(cmd *cobra.Command, _ []string) {
+	output, err := cmd.Flags().GetString(FlagStatusOutput)
+	checkErr(err)
+	if output != StatusOutputTable && output != StatusOutputJson && output != StatusOutputYaml {
+		glog.Fatalf("invalid output format: %s", output)
+	}
+
+	a := newApp(cmd.Flags(), loadStatusAppConfig(cmd))
+
+	if output == StatusOutputYaml {
+		running, err := a.RunningConfig()
+		if err != nil {
+			glog.Fatalf("can't fetch running rules: %v", err)
+		}
+		if running == nil {
+			exitNoRunningRules()
+		}
+		data, err := yaml.Marshal(newConfigFromAppConfig(running))
+		checkErr(err)
+		fmt.Print(string(data))
+		return
+	}
+
+	st, err := a.Status()
+	if err != nil {
+		glog.Fatalf("can't fetch running rules: %v", err)
+	}
+	if st == nil {
+		exitNoRunningRules()
+	}
+
+	if output == StatusOutputJson {
+		data, err := json.MarshalIndent(st, "", "  ")
+		checkErr(err)
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Printf("Chain %s, restricted ports %s: %d packets, %d bytes\n", st.Chain,
+		strings.Join(st.RestrictedPorts, ","), st.Packets, st.Bytes)
+	if st.StartupPolicy != "" {
+		fmt.Printf("Startup policy in effect: %s\n", st.StartupPolicy)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNETWORK\tTARGET\tPACKETS\tBYTES\tENTRIES")
+	for _, r := range st.Rules {
+		network := r.Network
+		if network == "" {
+			network = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", r.Kind, network, r.Target, r.Packets, r.Bytes,
+			strings.Join(r.Entries, ","))
+	}
+	checkErr(w.Flush())
+	fmt.Printf("Rejected: %d packets, %d bytes\n", st.RejectedPackets, st.RejectedBytes)
+}
+
+func runStaleCmd(cmd *cobra.Command, _ []string) {
+	output, err := cmd.Flags().GetString(FlagStatusOutput)
+	checkErr(err)
+	if output != StatusOutputTable && output != StatusOutputJson {
+		glog.Fatalf("invalid output format: %s", output)
+	}
+	window, err := cmd.Flags().GetDuration(FlagStaleWindow)
+	checkErr(err)
+	if window <= 0 {
+		glog.Fatalf("invalid stale window: %v", window)
+	}
+	stateFile, err := cmd.Flags().GetString(FlagStateFile)
+	checkErr(err)
+	if stateFile == "" {
+		glog.Fatalf("no state file defined (use '--%s' option)", FlagStateFile)
+	}
+
+	st, err := state.Load(stateFile)
+	if err != nil {
+		glog.Fatalf("can't load state file: %v", err)
+	}
+	if st == nil {
+		glog.Fatalf("state file %s not found", stateFile)
+	}
+
+	stale := app.StaleEntries(st.Hits, time.Now(), window)
+
+	if output == StatusOutputJson {
+		if stale == nil {
+			stale = []app.StaleEntry{}
+		}
+		data, err := json.MarshalIndent(stale, "", "  ")
+		checkErr(err)
+		fmt.Println(string(data))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTRY\tLAST HIT\tTRACKED SINCE")
+	ambiguous := 0
+	for _, e := range stale {
+		lastHit := "never"
+		if e.LastHit != nil {
+			lastHit = e.LastHit.Local().Format(time.RFC3339)
+		}
+		if e.Ambiguous {
+			lastHit += " (shared)"
+			ambiguous++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Entry, lastHit, e.FirstSeen.Local().Format(time.RFC3339))
+	}
+	checkErr(w.Flush())
+	fmt.Printf("%d of %d allowed networks entries have no hits for %v\n", len(stale)-ambiguous, len(st.Hits), window)
+	if ambiguous > 0 {
+		fmt.Printf("%d entries share the rule with other entries and may have no hits (shared)\n", ambiguous)
+	}
+}
+
+func exitNoRunningRules() {
+	fmt.Printf("no running rules found for chain %s\n", runningChainName())
+	os.Exit(1)
+}
+
+// Load app config to map running rules to config entries. In case of invalid config,
+// only chain name is taken from config file, flags or environment variables
+func loadStatusAppConfig(cmd *cobra.Command) *app.AppConfig {
+	if setConfigSource(cmd.Flags()) {
+		appCfg, err := loadConfigFile(cmd)
+		if err != nil {
+			glog.Warningf("can't map running rules to config entries: %v", err)
+			return app.NewAppConfig(runningChainName(), nil, nil)
+		}
+		return appCfg
+	}
+
+	checkErr(bindConfig(cmd.Flags()))
+	appCfg, err := newAppConfigFromFlags()
+	if err != nil {
+		// Config entries are optional without config file
+		glog.V(2).Infof("can't map running rules to config entries: %v", err)
+		return app.NewAppConfig(runningChainName(), nil, nil)
+	}
+	return appCfg
+}
+
+func runCleanupCmd(cmd *cobra.Command, _ []string) {
+	if err := newApp(cmd.Flags(), app.NewAppConfig(loadChainName(cmd), nil, nil)).Cleanup(); err != nil {
+		glog.Fatalf("can't clean up rules: %v", err)
+	}
+	glog.V(2).Info("iptables rules removed")
+}
+
+// Get chain name from config file, if defined and valid, or from flags and environment variables
+func loadChainName(cmd *cobra.Command) string {
+	if setConfigSource(cmd.Flags()) {
+		if err := readConfigFile(cmd); err != nil {
+			glog.Warningf("can't read config file, using chain name from flags: %v", err)
+		}
+	} else {
+		checkErr(bindConfig(cmd.Flags()))
+	}
+	return runningChainName()
+}
+
+// Create config in v1 schema from app config
+func newConfigFromAppConfig(appCfg *app.AppConfig) *config.Config {
+	cfg := &config.Config{
+		ApiVersion:      config.ApiVersionV1,
+		Chain:           appCfg.IpChainName,
+		RestrictedPorts: appCfg.RestrictedPorts,
+		Networks:        config.Networks{Denied: appCfg.DeniedNetworks},
+		Action:          config.Action{Target: appCfg.RejectAction.Target, RejectWith: appCfg.RejectAction.RejectWith},
+	}
+	for _, n := range appCfg.AllowedNetworks {
+		cfg.Networks.Allowed = append(cfg.Networks.Allowed, config.AllowedNetwork{Network: n})
+	}
+	return cfg
+}
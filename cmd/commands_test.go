@@ -0,0 +1,169 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+
+	"github.com/3cky/kube-restrict-ip/app"
+)
+
+func TestSubcommandConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"cfg.yaml": `
+ipChain: FILE-CHAIN
+restrictedPorts: [22]
+allowedNetworks: [10.0.0.0/8]
+`,
+		"invalid.yaml": `
+ipChain: FILE-CHAIN
+restrictedPorts: [http]
+allowedNetworks: [10.0.0.0/8]
+`,
+		filepath.Join("conf.d", "10-base.yaml"): `
+ipChain: DIR-CHAIN
+restrictedPorts: [22]
+allowedNetworks: [10.0.0.0/8]
+`,
+		filepath.Join("conf.d", "20-team.yaml"): `
+allowedNetworks: [192.168.0.0/16]
+`,
+	}
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgFile := "--config-file=" + filepath.Join(dir, "cfg.yaml")
+
+	// Config loaders of subcommands
+	loadApp := func(cmd *cobra.Command) (*app.AppConfig, bool) {
+		return loadAppConfig(cmd)
+	}
+	loadStatus := func(cmd *cobra.Command) (*app.AppConfig, bool) {
+		return loadStatusAppConfig(cmd), false
+	}
+	loadCleanup := func(cmd *cobra.Command) (*app.AppConfig, bool) {
+		return app.NewAppConfig(loadChainName(cmd), nil, nil), false
+	}
+
+	type args struct {
+		cmd   *cobra.Command
+		load  func(cmd *cobra.Command) (*app.AppConfig, bool)
+		flags []string
+	}
+	type want struct {
+		chain string
+		ports []string
+		nets  []string
+		watch bool
+	}
+	tests := []struct {
+		name string
+		args args
+		want want
+	}{
+		{
+			name: "run config file",
+			args: args{cmd: newRunCmd(), load: loadApp, flags: []string{cfgFile}},
+			want: want{chain: "FILE-CHAIN", ports: []string{"22"}, nets: []string{"10.0.0.0/8"}, watch: true},
+		},
+		{
+			name: "run flags",
+			args: args{cmd: newRunCmd(), load: loadApp,
+				flags: []string{"--restricted-ports=80", "--allowed-networks=10.0.0.0/8"}},
+			want: want{chain: "KUBE-RESTRICT-IP", ports: []string{"80"}, nets: []string{"10.0.0.0/8"}},
+		},
+		{
+			name: "apply config file with flags",
+			args: args{cmd: newApplyCmd(), load: loadApp, flags: []string{cfgFile, "--restricted-ports=80"}},
+			want: want{chain: "FILE-CHAIN", ports: []string{"80"}, nets: []string{"10.0.0.0/8"}, watch: true},
+		},
+		{
+			name: "apply config directory",
+			args: args{cmd: newApplyCmd(), load: loadApp,
+				flags: []string{"--config-dir=" + filepath.Join(dir, "conf.d")}},
+			want: want{chain: "DIR-CHAIN", ports: []string{"22"}, nets: []string{"10.0.0.0/8", "192.168.0.0/16"},
+				watch: true},
+		},
+		{
+			name: "diff config file with instance",
+			args: args{cmd: newDiffCmd(), load: loadApp, flags: []string{cfgFile, "--instance=team-a"}},
+			want: want{chain: "FILE-CHAIN-team-a", ports: []string{"22"}, nets: []string{"10.0.0.0/8"}, watch: true},
+		},
+		{
+			name: "status config file",
+			args: args{cmd: newStatusCmd(), load: loadStatus, flags: []string{cfgFile, "-o", "json"}},
+			want: want{chain: "FILE-CHAIN", ports: []string{"22"}, nets: []string{"10.0.0.0/8"}},
+		},
+		{
+			name: "status invalid config file",
+			args: args{cmd: newStatusCmd(), load: loadStatus,
+				flags: []string{"--config-file=" + filepath.Join(dir, "invalid.yaml")}},
+			want: want{chain: "FILE-CHAIN"},
+		},
+		{
+			name: "status without config",
+			args: args{cmd: newStatusCmd(), load: loadStatus, flags: []string{"--ip-chain=FLAG-CHAIN"}},
+			want: want{chain: "FLAG-CHAIN"},
+		},
+		{
+			name: "cleanup config file",
+			args: args{cmd: newCleanupCmd(), load: loadCleanup, flags: []string{cfgFile, "--instance=team-a"}},
+			want: want{chain: "FILE-CHAIN-team-a"},
+		},
+		{
+			name: "cleanup flags",
+			args: args{cmd: newCleanupCmd(), load: loadCleanup, flags: []string{"--ip-chain=FLAG-CHAIN"}},
+			want: want{chain: "FLAG-CHAIN"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setTestEnv(map[string]string{"KRI_IP_CHAIN": "", "KRI_RESTRICTED_PORTS": "",
+				"KRI_ALLOWED_NETWORKS": "", "KRI_INSTANCE": ""})()
+			defer setTestFlags(t, nil)()
+
+			// Root flags are inherited by subcommands as in the app command
+			root := &cobra.Command{Use: "kube-restrict-ip"}
+			root.AddCommand(tt.args.cmd)
+			if err := tt.args.cmd.ParseFlags(tt.args.flags); err != nil {
+				t.Fatalf("ParseFlags() error = %v", err)
+			}
+
+			appCfg, watch := tt.args.load(tt.args.cmd)
+			got := want{chain: appCfg.IpChainName, ports: appCfg.RestrictedPorts, nets: appCfg.AllowedNetworks,
+				watch: watch}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("app config = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/3cky/kube-restrict-ip/api"
+	"github.com/3cky/kube-restrict-ip/app"
+)
+
+const (
+	FlagGrantTtl     = "ttl"
+	FlagGrantComment = "comment"
+)
+
+func newGrantCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "grant",
+		Short: "Manage temporary access grants via local API",
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add NETWORK",
+		Short: "Add temporary access grant for the network",
+		Args:  cobra.ExactArgs(1),
+		Run:   runGrantAddCmd,
+	}
+	addCmd.Flags().Duration(FlagGrantTtl, time.Hour, "grant TTL")
+	addCmd.Flags().String(FlagGrantComment, "", "grant comment")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List active temporary access grants",
+		Args:  cobra.NoArgs,
+		Run:   runGrantListCmd,
+	}
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke NETWORK",
+		Short: "Revoke temporary access grant for the network",
+		Args:  cobra.ExactArgs(1),
+		Run:   runGrantRevokeCmd,
+	}
+
+	cmd.AddCommand(addCmd, listCmd, revokeCmd)
+
+	return cmd
+}
+
+func runGrantAddCmd(cmd *cobra.Command, args []string) {
+	ttl, err := cmd.Flags().GetDuration(FlagGrantTtl)
+	checkErr(err)
+	comment, err := cmd.Flags().GetString(FlagGrantComment)
+	checkErr(err)
+
+	g, err := newApiClient(cmd.Flags()).AddGrant(args[0], ttl, comment)
+	if err != nil {
+		glog.Fatalf("can't add grant: %v", err)
+	}
+	fmt.Printf("Granted access for %s until %s\n", g.Network, g.Expires.Local().Format(time.RFC3339))
+}
+
+func runGrantListCmd(cmd *cobra.Command, _ []string) {
+	grants, err := newApiClient(cmd.Flags()).ListGrants()
+	if err != nil {
+		glog.Fatalf("can't list grants: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NETWORK\tEXPIRES\tCOMMENT")
+	for _, g := range grants {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", g.Network, g.Expires.Local().Format(time.RFC3339), g.Comment)
+	}
+	checkErr(w.Flush())
+}
+
+func runGrantRevokeCmd(cmd *cobra.Command, args []string) {
+	if err := newApiClient(cmd.Flags()).RemoveGrant(args[0]); err != nil {
+		glog.Fatalf("can't revoke grant: %v", err)
+	}
+	fmt.Printf("Revoked access for %s\n", args[0])
+}
+
+func newApiClient(f *pflag.FlagSet) *api.Client {
+	address, err := f.GetString(FlagApiAddress)
+	checkErr(err)
+	if address == "" {
+		glog.Fatalf("no API address defined (use '--%s' option)", FlagApiAddress)
+	}
+	token, err := readApiToken(f)
+	checkErr(err)
+	return api.NewClient(address, token)
+}
+
+// Read local API bearer token from the token file
+func readApiToken(f *pflag.FlagSet) (string, error) {
+	tokenFile, err := f.GetString(FlagApiTokenFile)
+	if err != nil {
+		return "", err
+	}
+	if tokenFile == "" {
+		return "", errors.New(fmt.Sprintf("no API token file defined (use '--%s' option)", FlagApiTokenFile))
+	}
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New(fmt.Sprintf("empty API token in file %s", tokenFile))
+	}
+	return token, nil
+}
+
+// Start local API server for temporary access grants, if enabled
+func startApi(f *pflag.FlagSet, a *app.App) (*api.Server, error) {
+	address, err := f.GetString(FlagApiAddress)
+	if err != nil {
+		return nil, err
+	}
+	if address == "" {
+		return nil, nil
+	}
+
+	token, err := readApiToken(f)
+	if err != nil {
+		return nil, err
+	}
+	grantsFile, err := f.GetString(FlagGrantsFile)
+	if err != nil {
+		return nil, err
+	}
+	maxTtl, err := f.GetDuration(FlagGrantMaxTtl)
+	if err != nil {
+		return nil, err
+	}
+	allowRemote, err := f.GetBool(FlagApiAllowRemote)
+	if err != nil {
+		return nil, err
+	}
+	if !allowRemote {
+		if err := api.ValidateLoopbackAddress(address); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v (use '--%s' option to allow it)", err, FlagApiAllowRemote))
+		}
+	}
+
+	grants := app.NewGrantStore(grantsFile, maxTtl)
+	if err := grants.Load(); err != nil {
+		return nil, err
+	}
+	a.SetGrantStore(grants)
+
+	server := api.NewServer(grants, token)
+	server.SetAllowRemote(allowRemote)
+	if err := server.Start(address); err != nil {
+		return nil, err
+	}
+
+	return server, nil
+}
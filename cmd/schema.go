@@ -0,0 +1,48 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+
+	"github.com/3cky/kube-restrict-ip/config"
+)
+
+const FlagSchemaApiVersion = "api-version"
+
+func newSchemaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Print JSON Schema of config file for editors validation",
+		Args:  cobra.NoArgs,
+		Run:   runSchemaCmd,
+	}
+	cmd.Flags().String(FlagSchemaApiVersion, config.ApiVersionV1,
+		fmt.Sprintf("config schema version (%s or %s)", config.ApiVersionV1, config.ApiVersionV1Alpha1))
+	return cmd
+}
+
+func runSchemaCmd(cmd *cobra.Command, _ []string) {
+	version, err := cmd.Flags().GetString(FlagSchemaApiVersion)
+	checkErr(err)
+	s, err := config.JsonSchema(version)
+	if err != nil {
+		glog.Fatalf("can't get config schema: %v", err)
+	}
+	fmt.Println(string(s))
+}
@@ -0,0 +1,100 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/3cky/kube-restrict-ip/config"
+)
+
+func newValidateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate [FILE...]",
+		Short: "Validate config files and exit with non-zero status on problems",
+		Long: fmt.Sprintf("Validate config files given as arguments, by '--%s' or '--%s' options. "+
+			"All problems found are reported with config file line numbers. Config values are checked "+
+			"as they are read by the app, with the chain name of the instance defined by '--%s' option.",
+			FlagConfigFileName, FlagConfigDir, FlagInstance),
+		Run: runValidateCmd,
+	}
+}
+
+func runValidateCmd(cmd *cobra.Command, args []string) {
+	files := args
+	if cf, _ := cmd.Flags().GetString(FlagConfigFileName); cf != "" {
+		files = append(files, cf)
+	}
+	dir, _ := cmd.Flags().GetString(FlagConfigDir)
+	if len(files) == 0 && dir == "" {
+		glog.Fatalf("no config files to validate (use '--%s' or '--%s' options)", FlagConfigFileName, FlagConfigDir)
+	}
+
+	var problems []config.Problem
+	instance, err := instanceId()
+	if err != nil {
+		// Config files are checked without instance ID to report their own problems
+		problems = append(problems, config.Problem{File: instanceSource(), Message: err.Error()})
+		instance = ""
+	}
+	for _, f := range files {
+		problems = append(problems, validateFile(f, false, instance)...)
+	}
+
+	if dir != "" {
+		dirFiles, err := config.ListFiles(dir)
+		if err != nil {
+			glog.Fatalf("can't read config directory %s: %v", dir, err)
+		}
+		// Config directory files are partial configs, required keys are checked in merged config
+		for _, f := range dirFiles {
+			problems = append(problems, validateFile(f, true, instance)...)
+		}
+		if m, err := config.MergeFiles(dirFiles); err == nil {
+			problems = append(problems, config.ValidateMerged(dir, m, instance)...)
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Println("config is valid")
+}
+
+func validateFile(f string, partial bool, instance string) []config.Problem {
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		return []config.Problem{{File: f, Message: err.Error()}}
+	}
+	return config.Validate(f, data, partial, instance)
+}
+
+// Get source of app instance ID to report its problems
+func instanceSource() string {
+	if f := pflag.CommandLine.Lookup(FlagInstance); f != nil && f.Changed {
+		return "--" + FlagInstance
+	}
+	return envName(FlagInstance)
+}
@@ -0,0 +1,342 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cast"
+
+	"github.com/3cky/kube-restrict-ip/app"
+	"github.com/3cky/kube-restrict-ip/source"
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+// Default network rules chain name
+const DefaultIpChainName = "KUBE-RESTRICT-IP"
+
+// Config values by flat config keys, e.g. viper
+type Values interface {
+	Get(key string) interface{}
+}
+
+// Config values map by flat config keys
+type ValuesMap map[string]interface{}
+
+func (m ValuesMap) Get(key string) interface{} {
+	return m[key]
+}
+
+// Invalid config value
+type ValueError struct {
+	// Flat config key of the value
+	Key string
+	// Invalid list entry or object field value, empty if the key value is invalid as a whole
+	Value string
+	// The key is required but not defined
+	Missing bool
+	Err     error
+}
+
+func (e *ValueError) Error() string {
+	return e.Err.Error()
+}
+
+// Invalid config values
+type ValueErrors []*ValueError
+
+func (e ValueErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, ve := range e {
+		msgs = append(msgs, ve.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Fetch networks of allowed networks sources
+type SourcesFetcher func(sources []source.Source) ([]string, error)
+
+type appConfigBuilder struct {
+	values Values
+	errs   ValueErrors
+}
+
+func (b *appConfigBuilder) addf(key, value string, format string, args ...interface{}) {
+	b.errs = append(b.errs, &ValueError{Key: key, Value: value, Err: errors.New(fmt.Sprintf(format, args...))})
+}
+
+func (b *appConfigBuilder) add(key, value string, err error) {
+	b.errs = append(b.errs, &ValueError{Key: key, Value: value, Err: err})
+}
+
+func (b *appConfigBuilder) missingf(key string, format string, args ...interface{}) {
+	b.errs = append(b.errs, &ValueError{Key: key, Missing: true, Err: errors.New(fmt.Sprintf(format, args...))})
+}
+
+// Create app config from flat config values, with app instance ID embedded to the network rules chain name.
+// All invalid values are reported as ValueErrors. Allowed networks sources are fetched by the fetcher,
+// or only validated if the fetcher is nil. Critical sources safety is not applied
+func NewAppConfig(values Values, instance string, fetch SourcesFetcher) (*app.AppConfig, error) {
+	b := &appConfigBuilder{values: values}
+
+	chainName := cast.ToString(values.Get(KeyIpChainName))
+	if chainName == "" {
+		chainName = DefaultIpChainName
+	}
+	if err := util.ValidateChainName(chainName); err != nil {
+		b.add(KeyIpChainName, chainName, err)
+	} else if err := util.ValidateInstance(chainName, instance); err != nil {
+		b.add(KeyIpChainName, chainName, err)
+	}
+	chainName = util.InstanceChainName(chainName, instance)
+
+	checkInterval := b.duration(KeyCheckInterval)
+	dnsRefreshInterval := b.duration(KeyDnsRefreshInterval)
+
+	ports := StringSlice(values, KeyRestrictedPorts)
+	if len(ports) == 0 {
+		b.missingf(KeyRestrictedPorts, "no restricted ports defined (add '%s' section)", KeyRestrictedPorts)
+	}
+	for _, p := range ports {
+		if err := util.ValidatePorts([]string{p}); err != nil {
+			b.add(KeyRestrictedPorts, p, err)
+		}
+	}
+
+	nets, scheduledNets := b.allowedNetworks(values.Get(KeyAllowedNetworks))
+
+	var sources []source.Source
+	if err := decodeValue(values.Get(KeyAllowedNetworkSources), &sources); err != nil {
+		b.addf(KeyAllowedNetworkSources, "", "invalid '%s' section: %v", KeyAllowedNetworkSources, err)
+	}
+	validSources := true
+	for _, s := range sources {
+		if err := s.Validate(); err != nil {
+			value := s.Url
+			if value == "" {
+				value = s.File
+			}
+			b.add(KeyAllowedNetworkSources, value, err)
+			validSources = false
+		}
+	}
+	if fetch != nil && validSources && len(b.errs) == 0 {
+		sourceNets, err := fetch(sources)
+		if err != nil {
+			b.add(KeyAllowedNetworkSources, "", err)
+		}
+		nets = append(nets, sourceNets...)
+	}
+	if len(nets) == 0 && len(scheduledNets) == 0 && (fetch != nil || len(sources) == 0) {
+		b.missingf(KeyAllowedNetworks, "no allowed networks defined (add '%s' or '%s' section)",
+			KeyAllowedNetworks, KeyAllowedNetworkSources)
+	}
+
+	deniedNets := StringSlice(values, KeyDeniedNetworks)
+	for _, n := range deniedNets {
+		if err := util.ValidateNetworks([]string{n}); err != nil {
+			b.addf(KeyDeniedNetworks, n, "invalid '%s' entry: %s", KeyDeniedNetworks, n)
+		}
+	}
+
+	target, rejectWith := cast.ToString(values.Get(KeyRejectAction)), cast.ToString(values.Get(KeyRejectWith))
+	action := util.NewRejectAction(target, rejectWith, util.RestrictedPortsProtocol)
+	if err := util.ValidateRejectTarget(action.Target, chainName); err != nil {
+		b.add(KeyRejectAction, target, err)
+	} else if err := util.ValidateRejectAction(action, chainName); err != nil {
+		if rejectWith != "" {
+			b.add(KeyRejectWith, rejectWith, err)
+		} else {
+			b.add(KeyRejectAction, target, err)
+		}
+	}
+
+	var verify *app.VerifyConfig
+	if v := values.Get(KeyVerify); v != nil {
+		verify = &app.VerifyConfig{}
+		if err := decodeValue(v, verify); err != nil {
+			b.addf(KeyVerify, "", "invalid '%s' section: %v", KeyVerify, err)
+		} else if err := verify.Validate(); err != nil {
+			b.add(KeyVerify, "", err)
+		}
+	}
+
+	if mode := cast.ToString(values.Get(KeySafety)); mode != "" {
+		if err := app.ValidateSafetyMode(mode); err != nil {
+			b.add(KeySafety, mode, err)
+		}
+	}
+	for _, s := range StringSlice(values, KeyCriticalSources) {
+		if err := app.ValidateCriticalSources([]string{s}); err != nil {
+			b.add(KeyCriticalSources, s, err)
+		}
+	}
+
+	if len(b.errs) > 0 {
+		return nil, b.errs
+	}
+
+	appCfg := app.NewAppConfig(chainName, ports, nets)
+	appCfg.ConfigCheckInterval = checkInterval
+	appCfg.ScheduledNetworks = scheduledNets
+	appCfg.DeniedNetworks = deniedNets
+	appCfg.RejectAction = action
+	appCfg.DnsRefreshInterval = dnsRefreshInterval
+	appCfg.Verify = verify
+
+	return appCfg, nil
+}
+
+// Get duration value, zero if not defined
+func (b *appConfigBuilder) duration(key string) time.Duration {
+	v := b.values.Get(key)
+	if v == nil {
+		return 0
+	}
+	d, err := cast.ToDurationE(v)
+	if err != nil || d < 0 {
+		b.addf(key, cast.ToString(v), "invalid '%s' duration: %v", key, v)
+	}
+	return d
+}
+
+// Parse allowed networks config entries: network strings or scheduled network objects
+func (b *appConfigBuilder) allowedNetworks(v interface{}) ([]string, []app.ScheduledNetwork) {
+	var nets []string
+	var scheduledNets []app.ScheduledNetwork
+
+	entries, ok := v.([]interface{})
+	if !ok {
+		// Not a list of objects, e.g. environment variable or flag value
+		for _, n := range stringSlice(v) {
+			if err := util.ValidateAllowedNetworks([]string{n}); err != nil {
+				b.addf(KeyAllowedNetworks, n, "invalid '%s' entry: %s", KeyAllowedNetworks, n)
+			}
+			nets = append(nets, n)
+		}
+		return nets, nil
+	}
+
+	for _, e := range entries {
+		m, ok := e.(map[interface{}]interface{})
+		if !ok {
+			if sm, ok := e.(map[string]interface{}); ok {
+				m = map[interface{}]interface{}{}
+				for k, v := range sm {
+					m[k] = v
+				}
+			}
+		}
+		if m == nil {
+			n := cast.ToString(e)
+			if err := util.ValidateAllowedNetworks([]string{n}); err != nil {
+				b.addf(KeyAllowedNetworks, n, "invalid '%s' entry: %s", KeyAllowedNetworks, n)
+			}
+			nets = append(nets, n)
+			continue
+		}
+
+		if n, ok := b.scheduledNetwork(m); ok {
+			if n.NotBefore.IsZero() && n.NotAfter.IsZero() && n.Schedule == nil {
+				// Not scheduled actually
+				nets = append(nets, n.Network)
+				continue
+			}
+			scheduledNets = append(scheduledNets, n)
+		}
+	}
+
+	return nets, scheduledNets
+}
+
+// Parse scheduled network object, returns false if it's invalid
+func (b *appConfigBuilder) scheduledNetwork(m map[interface{}]interface{}) (app.ScheduledNetwork, bool) {
+	// Network is used in problem messages of the other fields
+	n := app.ScheduledNetwork{Network: cast.ToString(m[KeyNetwork])}
+	valid := true
+	for k, v := range m {
+		var err error
+		switch key := cast.ToString(k); key {
+		case KeyNetwork:
+			err = util.ValidateAllowedNetworks([]string{n.Network})
+		case KeyNotBefore:
+			n.NotBefore, err = cast.ToTimeE(v)
+		case KeyNotAfter:
+			n.NotAfter, err = cast.ToTimeE(v)
+		case KeySchedule:
+			n.Schedule, err = util.ParseSchedule(cast.ToString(v))
+		default:
+			err = errors.New(fmt.Sprintf("unknown key '%s'", key))
+		}
+		if err != nil {
+			b.addf(KeyAllowedNetworks, cast.ToString(v), "invalid allowed network entry %s: %v", n.Network, err)
+			valid = false
+		}
+	}
+	if n.Network == "" {
+		b.addf(KeyAllowedNetworks, "", "invalid allowed network entry: no '%s' defined", KeyNetwork)
+		return n, false
+	}
+	if !n.NotBefore.IsZero() && !n.NotAfter.IsZero() && !n.NotBefore.Before(n.NotAfter) {
+		b.addf(KeyAllowedNetworks, cast.ToString(m[KeyNotAfter]), "invalid allowed network entry %s: '%s' is not before '%s'",
+			n.Network, KeyNotBefore, KeyNotAfter)
+		return n, false
+	}
+	return n, valid
+}
+
+// Decode config object or list value, e.g. verify section, weakly typed like viper does
+func decodeValue(v interface{}, out interface{}) error {
+	if v == nil {
+		return nil
+	}
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		Result:           out,
+	})
+	if err != nil {
+		return err
+	}
+	return d.Decode(v)
+}
+
+// Get config value as string slice. String values (i.e. environment variables ones)
+// are split by commas and whitespace
+func StringSlice(values Values, key string) []string {
+	return stringSlice(values.Get(key))
+}
+
+func stringSlice(v interface{}) []string {
+	if s, ok := v.(string); ok {
+		return SplitList(s)
+	}
+	return cast.ToStringSlice(v)
+}
+
+// Split list string by commas and whitespace
+func SplitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
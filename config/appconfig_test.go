@@ -0,0 +1,171 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/app"
+	"github.com/3cky/kube-restrict-ip/source"
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+func TestNewAppConfig(t *testing.T) {
+	fetch := func(sources []source.Source) ([]string, error) {
+		if len(sources) > 0 && sources[0].Url == "https://example.com/error" {
+			return nil, errors.New("fetch error")
+		}
+		return []string{"172.16.0.0/12"}, nil
+	}
+
+	type args struct {
+		values   ValuesMap
+		instance string
+		fetch    SourcesFetcher
+	}
+	tests := []struct {
+		name     string
+		args     args
+		want     *app.AppConfig
+		wantErrs []ValueError
+	}{
+		{
+			name: "list values",
+			args: args{values: ValuesMap{
+				KeyRestrictedPorts: []interface{}{"10250"},
+				KeyAllowedNetworks: []interface{}{"10.0.0.0/8", map[interface{}]interface{}{KeyNetwork: "192.168.1.0/24"}},
+				KeyDeniedNetworks:  []interface{}{"10.1.0.0/16"},
+				KeyVerify:          map[interface{}]interface{}{KeyVerifyGracePeriod: "10s"},
+			}},
+			want: &app.AppConfig{
+				IpChainName:     DefaultIpChainName,
+				RestrictedPorts: []string{"10250"},
+				AllowedNetworks: []string{"10.0.0.0/8", "192.168.1.0/24"},
+				DeniedNetworks:  []string{"10.1.0.0/16"},
+				RejectAction:    util.NewRejectAction("", "", util.RestrictedPortsProtocol),
+				Verify:          &app.VerifyConfig{GracePeriod: 10 * time.Second},
+			},
+		},
+		{
+			name: "environment variables values",
+			args: args{values: ValuesMap{
+				KeyIpChainName:        "TEST-CHAIN",
+				KeyRestrictedPorts:    "10250,10255",
+				KeyAllowedNetworks:    "10.0.0.0/8, 192.168.1.0/24\n192.168.2.0/24",
+				KeyDnsRefreshInterval: "1m",
+			}, instance: "team-a"},
+			want: &app.AppConfig{
+				IpChainName:        "TEST-CHAIN-team-a",
+				RestrictedPorts:    []string{"10250", "10255"},
+				AllowedNetworks:    []string{"10.0.0.0/8", "192.168.1.0/24", "192.168.2.0/24"},
+				RejectAction:       util.NewRejectAction("", "", util.RestrictedPortsProtocol),
+				DnsRefreshInterval: time.Minute,
+			},
+		},
+		{
+			name: "fetched sources",
+			args: args{values: ValuesMap{
+				KeyRestrictedPorts:       []interface{}{"10250"},
+				KeyAllowedNetworkSources: []interface{}{map[interface{}]interface{}{KeySourceUrl: "https://example.com"}},
+			}, fetch: fetch},
+			want: &app.AppConfig{
+				IpChainName:     DefaultIpChainName,
+				RestrictedPorts: []string{"10250"},
+				AllowedNetworks: []string{"172.16.0.0/12"},
+				RejectAction:    util.NewRejectAction("", "", util.RestrictedPortsProtocol),
+			},
+		},
+		{
+			name: "fetch error",
+			args: args{values: ValuesMap{
+				KeyRestrictedPorts:       []interface{}{"10250"},
+				KeyAllowedNetworkSources: []interface{}{map[interface{}]interface{}{KeySourceUrl: "https://example.com/error"}},
+			}, fetch: fetch},
+			wantErrs: []ValueError{
+				{Key: KeyAllowedNetworkSources},
+				{Key: KeyAllowedNetworks, Missing: true},
+			},
+		},
+		{
+			name: "missing keys",
+			args: args{values: ValuesMap{}},
+			wantErrs: []ValueError{
+				{Key: KeyRestrictedPorts, Missing: true},
+				{Key: KeyAllowedNetworks, Missing: true},
+			},
+		},
+		{
+			name: "invalid values",
+			args: args{values: ValuesMap{
+				KeyIpChainName:     "KUBE-RESTRICT-IP",
+				KeyRestrictedPorts: []interface{}{"10250", "0"},
+				KeyAllowedNetworks: []interface{}{"10.0.0.0/33",
+					map[interface{}]interface{}{KeyNetwork: "10.0.0.0/8", KeySchedule: "never"}},
+				KeyRejectAction: "DROP",
+				KeyRejectWith:   "tcp-reset",
+				KeySafety:       "maybe",
+			}, instance: "team-a-long"},
+			wantErrs: []ValueError{
+				{Key: KeyIpChainName, Value: "KUBE-RESTRICT-IP"},
+				{Key: KeyRestrictedPorts, Value: "0"},
+				{Key: KeyAllowedNetworks, Value: "10.0.0.0/33"},
+				{Key: KeyAllowedNetworks, Value: "never"},
+				{Key: KeyRejectWith, Value: "tcp-reset"},
+				{Key: KeySafety, Value: "maybe"},
+			},
+		},
+		{
+			name: "accept action",
+			args: args{values: ValuesMap{
+				KeyRestrictedPorts: []interface{}{"10250"},
+				KeyAllowedNetworks: []interface{}{"10.0.0.0/8"},
+				KeyRejectAction:    "ACCEPT",
+				KeyRejectWith:      "tcp-reset",
+			}},
+			wantErrs: []ValueError{{Key: KeyRejectAction, Value: "ACCEPT"}},
+		},
+		{
+			name: "own chain action",
+			args: args{values: ValuesMap{
+				KeyRestrictedPorts: []interface{}{"10250"},
+				KeyAllowedNetworks: []interface{}{"10.0.0.0/8"},
+				KeyRejectAction:    "KUBE-RESTRICT-IP-team-a",
+			}, instance: "team-a"},
+			wantErrs: []ValueError{{Key: KeyRejectAction, Value: "KUBE-RESTRICT-IP-team-a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewAppConfig(tt.args.values, tt.args.instance, tt.args.fetch)
+			var gotErrs []ValueError
+			if errs, ok := err.(ValueErrors); ok {
+				for _, e := range errs {
+					gotErrs = append(gotErrs, ValueError{Key: e.Key, Value: e.Value, Missing: e.Missing})
+				}
+			} else if err != nil {
+				t.Fatalf("NewAppConfig() error = %v, want ValueErrors", err)
+			}
+			if !reflect.DeepEqual(gotErrs, tt.wantErrs) {
+				t.Errorf("NewAppConfig() errors = %+v, want %+v", gotErrs, tt.wantErrs)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewAppConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
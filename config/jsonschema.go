@@ -0,0 +1,173 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/3cky/kube-restrict-ip/app"
+	"github.com/3cky/kube-restrict-ip/source"
+)
+
+type schema map[string]interface{}
+
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+// Get JSON Schema of the config schema version, for editors config files validation
+func JsonSchema(version string) ([]byte, error) {
+	var s schema
+	switch version {
+	case ApiVersionV1:
+		s = v1Schema()
+	case ApiVersionV1Alpha1:
+		s = v1Alpha1Schema()
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported config '%s': %s (must be %s or %s)", KeyApiVersion,
+			version, ApiVersionV1, ApiVersionV1Alpha1))
+	}
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["title"] = fmt.Sprintf("kube-restrict-ip config (%s)", version)
+	s["definitions"] = schema{
+		"duration":       durationSchema(),
+		"port":           portSchema(),
+		"allowedNetwork": allowedNetworkSchema(),
+		"source":         sourceSchema(),
+		"verify":         verifySchema(),
+	}
+	return json.MarshalIndent(s, "", "  ")
+}
+
+func v1Schema() schema {
+	return object(schema{
+		KeyApiVersion:      schema{"const": ApiVersionV1},
+		KeyCheckInterval:   describe(ref("duration"), "The interval to poll config for updates"),
+		"chain":            describe(stringSchema(), "iptables chain name"),
+		KeyRestrictedPorts: describe(list(ref("port")), "Restricted TCP ports"),
+		"networks": object(schema{
+			"allowed":             describe(list(ref("allowedNetwork")), "Allowed networks or host names"),
+			"denied":              describe(list(stringSchema()), "Denied networks"),
+			"sources":             describe(list(ref("source")), "Sources to fetch additional allowed networks from"),
+			KeySourcesCacheDir:    describe(stringSchema(), "Directory to cache last fetched sources data"),
+			KeyDnsRefreshInterval: describe(ref("duration"), "The interval to re-resolve host names"),
+		}),
+		"action": object(schema{
+			"target":      describe(stringSchema(), "Action target: REJECT, DROP or custom chain name"),
+			KeyRejectWith: describe(stringSchema(), "Reject type for REJECT target"),
+		}),
+		"safety": object(schema{
+			"mode":             safetyModeSchema(),
+			KeyCriticalSources: describe(list(stringSchema()), "Additional critical source addresses"),
+		}),
+		KeyVerify: ref("verify"),
+	}, KeyApiVersion)
+}
+
+func v1Alpha1Schema() schema {
+	return object(schema{
+		KeyApiVersion:            schema{"const": ApiVersionV1Alpha1},
+		KeyCheckInterval:         describe(ref("duration"), "The interval to poll config for updates"),
+		KeyIpChainName:           describe(stringSchema(), "iptables chain name"),
+		KeyRestrictedPorts:       describe(list(ref("port")), "Restricted TCP ports"),
+		KeyAllowedNetworks:       describe(list(ref("allowedNetwork")), "Allowed networks or host names"),
+		KeyAllowedNetworkSources: describe(list(ref("source")), "Sources to fetch additional allowed networks from"),
+		KeySourcesCacheDir:       describe(stringSchema(), "Directory to cache last fetched sources data"),
+		KeyDeniedNetworks:        describe(list(stringSchema()), "Denied networks"),
+		KeyRejectAction:          describe(stringSchema(), "Action target: REJECT, DROP or custom chain name"),
+		KeyRejectWith:            describe(stringSchema(), "Reject type for REJECT action"),
+		KeyDnsRefreshInterval:    describe(ref("duration"), "The interval to re-resolve host names"),
+		KeySafety:                safetyModeSchema(),
+		KeyCriticalSources:       describe(list(stringSchema()), "Additional critical source addresses"),
+		KeyVerify:                ref("verify"),
+	})
+}
+
+func durationSchema() schema {
+	return schema{"type": "string", "pattern": durationPattern}
+}
+
+func portSchema() schema {
+	return schema{
+		"oneOf": []schema{
+			{"type": "integer", "minimum": 1, "maximum": 65535},
+			{"type": "string", "pattern": "^[0-9]+$"},
+		},
+	}
+}
+
+func allowedNetworkSchema() schema {
+	return schema{
+		"oneOf": []schema{
+			stringSchema(),
+			object(schema{
+				KeyNetwork:   stringSchema(),
+				KeyNotBefore: describe(stringSchema(), "The time the network is allowed from (RFC 3339)"),
+				KeyNotAfter:  describe(stringSchema(), "The time the network is allowed until (RFC 3339)"),
+				KeySchedule:  describe(stringSchema(), "Cron-like schedule the network is allowed by"),
+			}, KeyNetwork),
+		},
+	}
+}
+
+func sourceSchema() schema {
+	s := object(schema{
+		KeySourceUrl:             schema{"type": "string", "pattern": "^https?://"},
+		KeySourceFile:            stringSchema(),
+		KeySourceFormat:          schema{"enum": []string{source.FormatText, source.FormatJson, source.FormatJsonPath}},
+		KeySourcePath:            describe(stringSchema(), "JSONPath expression for jsonpath format"),
+		KeySourceRefreshInterval: ref("duration"),
+	})
+	s["oneOf"] = []schema{{"required": []string{KeySourceUrl}}, {"required": []string{KeySourceFile}}}
+	return s
+}
+
+func verifySchema() schema {
+	return object(schema{
+		KeyVerifySources:     describe(list(stringSchema()), "Addresses which must be allowed by the rules"),
+		KeyVerifyEndpoints:   describe(list(stringSchema()), "Endpoints (host:port) which must be reachable"),
+		KeyVerifyGracePeriod: ref("duration"),
+	})
+}
+
+func safetyModeSchema() schema {
+	return describe(schema{"enum": []string{app.SafetyAllow, app.SafetyRefuse, app.SafetyOff}},
+		"The mode for critical sources rejected by the rules")
+}
+
+func object(properties schema, required ...string) schema {
+	s := schema{"type": "object", "properties": properties, "additionalProperties": false}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func list(items schema) schema {
+	return schema{"type": "array", "items": items}
+}
+
+func stringSchema() schema {
+	return schema{"type": "string"}
+}
+
+func ref(definition string) schema {
+	return schema{"$ref": "#/definitions/" + definition}
+}
+
+func describe(s schema, description string) schema {
+	s["description"] = description
+	return s
+}
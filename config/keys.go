@@ -0,0 +1,51 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// Config file keys
+const (
+	KeyApiVersion            = "apiVersion"
+	KeyCheckInterval         = "checkInterval"
+	KeyIpChainName           = "ipChain"
+	KeyRestrictedPorts       = "restrictedPorts"
+	KeyAllowedNetworks       = "allowedNetworks"
+	KeyDeniedNetworks        = "deniedNetworks"
+	KeyRejectAction          = "action"
+	KeyRejectWith            = "rejectWith"
+	KeyDnsRefreshInterval    = "dnsRefreshInterval"
+	KeyAllowedNetworkSources = "allowedNetworkSources"
+	KeySourcesCacheDir       = "sourcesCacheDir"
+	KeyVerify                = "verify"
+	KeySafety                = "safety"
+	KeyCriticalSources       = "criticalSources"
+
+	// Allowed network object keys
+	KeyNetwork   = "network"
+	KeyNotBefore = "notBefore"
+	KeyNotAfter  = "notAfter"
+	KeySchedule  = "schedule"
+
+	// Allowed network source object keys
+	KeySourceUrl             = "url"
+	KeySourceFile            = "file"
+	KeySourceFormat          = "format"
+	KeySourcePath            = "path"
+	KeySourceRefreshInterval = "refreshInterval"
+
+	// Verify object keys
+	KeyVerifySources     = "sources"
+	KeyVerifyEndpoints   = "endpoints"
+	KeyVerifyGracePeriod = "gracePeriod"
+)
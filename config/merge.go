@@ -0,0 +1,164 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+	"gopkg.in/yaml.v2"
+)
+
+// Supported config file name extensions, without leading dot
+var FileExts = []string{"yaml", "yml", "json"}
+
+// Merged config: values and config files defining list items, by config key
+type Merged struct {
+	Values  map[string]interface{}
+	Origins map[string]map[string][]string
+}
+
+// Get config file names in the directory, in lexical order. Hidden files
+// (e.g. ConfigMap volume internal ones) are skipped
+func ListFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, ".") || info.IsDir() {
+			continue
+		}
+		for _, ext := range FileExts {
+			if filepath.Ext(name) == "."+ext {
+				files = append(files, filepath.Join(dir, name))
+				break
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Merge config files of any schema version in the given order. List values are merged as union of their
+// items, other values (scalars and groups) defined in later files override earlier ones
+func MergeFiles(files []string) (*Merged, error) {
+	m := &Merged{
+		Values:  map[string]interface{}{},
+		Origins: map[string]map[string][]string{},
+	}
+	// Config keys are case-insensitive, keep the first key spelling
+	keys := map[string]string{}
+
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		values, err := flatValues(data)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("can't parse config file %s: %v", f, err))
+		}
+
+		for k, v := range values {
+			key, ok := keys[strings.ToLower(k)]
+			if !ok {
+				key = k
+				keys[strings.ToLower(k)] = key
+			}
+
+			items, ok := v.([]interface{})
+			if !ok {
+				m.Values[key] = v
+				continue
+			}
+
+			merged, _ := m.Values[key].([]interface{})
+			origins := m.Origins[key]
+			if origins == nil {
+				origins = map[string][]string{}
+				m.Origins[key] = origins
+			}
+			for _, item := range items {
+				id := itemId(item)
+				if _, found := origins[id]; !found {
+					merged = append(merged, item)
+				}
+				origins[id] = append(origins[id], f)
+			}
+			m.Values[key] = merged
+		}
+	}
+
+	return m, nil
+}
+
+// Decode config data of any schema version to flat config values
+func flatValues(data []byte) (map[string]interface{}, error) {
+	cfg, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return configValues(cfg)
+}
+
+// Get config values in flat format
+func configValues(cfg *Config) (map[string]interface{}, error) {
+	flat, err := cfg.MarshalFlat()
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(flat, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Get list item identity: item string value, or network of object item followed by
+// the other object fields (e.g. schedule), so objects differing in any field are distinct
+func itemId(item interface{}) string {
+	obj, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return cast.ToString(item)
+	}
+	var fields []string
+	for k, v := range obj {
+		if k != KeyNetwork {
+			fields = append(fields, fmt.Sprintf("%v=%v", k, v))
+		}
+	}
+	sort.Strings(fields)
+	n, ok := obj[KeyNetwork]
+	if !ok {
+		return fmt.Sprintf("(%s)", strings.Join(fields, ", "))
+	}
+	if len(fields) == 0 {
+		return cast.ToString(n)
+	}
+	return fmt.Sprintf("%s (%s)", cast.ToString(n), strings.Join(fields, ", "))
+}
+
+// Marshal merged config values to YAML
+func (m *Merged) Marshal() ([]byte, error) {
+	return yaml.Marshal(m.Values)
+}
@@ -0,0 +1,123 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"00-base.yaml": `
+restrictedPorts: [10250]
+allowedNetworks:
+  - 10.0.0.0/8
+  - network: 192.168.5.0/24
+    schedule: "* 9-17 * * 1-5"
+  - network: 192.168.6.0/24
+    schedule: "* 9-17 * * 1-5"
+action: REJECT
+verify:
+  sources: [10.0.0.1]
+  gracePeriod: 10s
+`,
+		"10-team.yml": `
+allowedNetworks:
+  - 192.168.1.0/24
+  - 10.0.0.0/8
+  - network: 192.168.5.0/24
+    schedule: "* 9-17 * * 1-5"
+  - network: 192.168.6.0/24
+    schedule: "* 18-23 * * 1-5"
+deniedNetworks: [10.1.0.0/16]
+action: DROP
+verify:
+  endpoints: ["10.0.0.1:6443"]
+`,
+		"15-v1.yaml": `
+apiVersion: kube-restrict-ip/v1
+restrictedPorts: [10255]
+networks:
+  denied: [10.2.0.0/16]
+`,
+		".hidden.yaml":   "action: ACCEPT\n",
+		"README.md":      "not a config\n",
+		"20-empty.yaml":  "",
+		"30-json.json":   `{"restrictedPorts": [10256]}`,
+		"40-ignored.txt": "{}",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := ListFiles(dir)
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	base, team, v1, empty, json := filepath.Join(dir, "00-base.yaml"), filepath.Join(dir, "10-team.yml"),
+		filepath.Join(dir, "15-v1.yaml"), filepath.Join(dir, "20-empty.yaml"), filepath.Join(dir, "30-json.json")
+	if want := []string{base, team, v1, empty, json}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("ListFiles() = %v, want %v", names, want)
+	}
+
+	m, err := MergeFiles(names)
+	if err != nil {
+		t.Fatalf("MergeFiles() error = %v", err)
+	}
+
+	want := map[string]interface{}{
+		"restrictedPorts": []interface{}{"10250", "10255", "10256"},
+		"allowedNetworks": []interface{}{
+			"10.0.0.0/8",
+			map[interface{}]interface{}{"network": "192.168.5.0/24", "schedule": "* 9-17 * * 1-5"},
+			map[interface{}]interface{}{"network": "192.168.6.0/24", "schedule": "* 9-17 * * 1-5"},
+			"192.168.1.0/24",
+			map[interface{}]interface{}{"network": "192.168.6.0/24", "schedule": "* 18-23 * * 1-5"},
+		},
+		"deniedNetworks": []interface{}{"10.1.0.0/16", "10.2.0.0/16"},
+		"action":         "DROP",
+		"verify":         map[interface{}]interface{}{"endpoints": []interface{}{"10.0.0.1:6443"}},
+	}
+	if !reflect.DeepEqual(m.Values, want) {
+		t.Errorf("MergeFiles() values = %v, want %v", m.Values, want)
+	}
+
+	wantOrigins := map[string][]string{
+		"10.0.0.0/8": {base, team},
+		"192.168.5.0/24 (schedule=* 9-17 * * 1-5)": {base, team},
+		"192.168.6.0/24 (schedule=* 9-17 * * 1-5)": {base},
+		"192.168.1.0/24": {team},
+		"192.168.6.0/24 (schedule=* 18-23 * * 1-5)": {team},
+	}
+	if !reflect.DeepEqual(m.Origins["allowedNetworks"], wantOrigins) {
+		t.Errorf("MergeFiles() allowedNetworks origins = %v, want %v", m.Origins["allowedNetworks"], wantOrigins)
+	}
+
+	if _, err := MergeFiles([]string{filepath.Join(dir, "README.md")}); err == nil {
+		t.Errorf("MergeFiles() error = nil for invalid config file")
+	}
+}
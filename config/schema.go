@@ -0,0 +1,321 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config schema versions
+const (
+	ApiVersionV1       = "kube-restrict-ip/v1"
+	ApiVersionV1Alpha1 = "kube-restrict-ip/v1alpha1"
+)
+
+// Config schema v1
+type Config struct {
+	ApiVersion      string        `yaml:"apiVersion"`
+	CheckInterval   time.Duration `yaml:"checkInterval,omitempty"`
+	Chain           string        `yaml:"chain,omitempty"`
+	RestrictedPorts []string      `yaml:"restrictedPorts,omitempty"`
+	Networks        Networks      `yaml:"networks,omitempty"`
+	Action          Action        `yaml:"action,omitempty"`
+	Safety          Safety        `yaml:"safety,omitempty"`
+	Verify          *Verify       `yaml:"verify,omitempty"`
+}
+
+// Allowed and denied networks
+type Networks struct {
+	Allowed            []AllowedNetwork `yaml:"allowed,omitempty"`
+	Denied             []string         `yaml:"denied,omitempty"`
+	Sources            []Source         `yaml:"sources,omitempty"`
+	SourcesCacheDir    string           `yaml:"sourcesCacheDir,omitempty"`
+	DnsRefreshInterval time.Duration    `yaml:"dnsRefreshInterval,omitempty"`
+}
+
+// Action for traffic from not allowed networks
+type Action struct {
+	Target     string `yaml:"target,omitempty"`
+	RejectWith string `yaml:"rejectWith,omitempty"`
+}
+
+// Critical sources safety check
+type Safety struct {
+	Mode            string   `yaml:"mode,omitempty"`
+	CriticalSources []string `yaml:"criticalSources,omitempty"`
+}
+
+// Allowed network: network string or object with time window or schedule
+type AllowedNetwork struct {
+	Network   string `yaml:"network"`
+	NotBefore string `yaml:"notBefore,omitempty"`
+	NotAfter  string `yaml:"notAfter,omitempty"`
+	Schedule  string `yaml:"schedule,omitempty"`
+}
+
+// Allowed networks source
+type Source struct {
+	Url             string        `yaml:"url,omitempty"`
+	File            string        `yaml:"file,omitempty"`
+	Format          string        `yaml:"format,omitempty"`
+	Path            string        `yaml:"path,omitempty"`
+	RefreshInterval time.Duration `yaml:"refreshInterval,omitempty"`
+}
+
+// Post-apply rules verification
+type Verify struct {
+	Sources     []string      `yaml:"sources,omitempty"`
+	Endpoints   []string      `yaml:"endpoints,omitempty"`
+	GracePeriod time.Duration `yaml:"gracePeriod,omitempty"`
+}
+
+// Config schema v1alpha1: the original flat config format, also used for config files without version
+type ConfigV1Alpha1 struct {
+	ApiVersion            string           `yaml:"apiVersion,omitempty"`
+	CheckInterval         time.Duration    `yaml:"checkInterval,omitempty"`
+	IpChain               string           `yaml:"ipChain,omitempty"`
+	RestrictedPorts       []string         `yaml:"restrictedPorts,omitempty"`
+	AllowedNetworks       []AllowedNetwork `yaml:"allowedNetworks,omitempty"`
+	AllowedNetworkSources []Source         `yaml:"allowedNetworkSources,omitempty"`
+	SourcesCacheDir       string           `yaml:"sourcesCacheDir,omitempty"`
+	DeniedNetworks        []string         `yaml:"deniedNetworks,omitempty"`
+	Action                string           `yaml:"action,omitempty"`
+	RejectWith            string           `yaml:"rejectWith,omitempty"`
+	DnsRefreshInterval    time.Duration    `yaml:"dnsRefreshInterval,omitempty"`
+	Safety                string           `yaml:"safety,omitempty"`
+	CriticalSources       []string         `yaml:"criticalSources,omitempty"`
+	Verify                *Verify          `yaml:"verify,omitempty"`
+}
+
+// Decode config data of any supported schema version strictly (unknown keys are errors)
+// and convert it to the config schema v1
+func Decode(data []byte) (*Config, error) {
+	return decode(data, decodeStrict)
+}
+
+// Decode config data of any supported schema version leniently: unknown keys are ignored,
+// values of invalid types are left unset and only the first of duplicate keys is used.
+// Used to check config values despite the errors
+func decodeLenient(data []byte) (*Config, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if removeDuplicateKeys(&doc) {
+		var err error
+		if data, err = yaml.Marshal(&doc); err != nil {
+			return nil, err
+		}
+	}
+	return decode(data, func(data []byte, out interface{}) error {
+		if err := yaml.Unmarshal(data, out); err != nil {
+			if _, ok := err.(*yaml.TypeError); !ok {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove duplicate keys of the node mappings, keeping the first ones. Returns true if any removed
+func removeDuplicateKeys(n *yaml.Node) bool {
+	removed := false
+	if n.Kind == yaml.MappingNode {
+		keys := map[string]bool{}
+		content := n.Content[:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if keys[n.Content[i].Value] {
+				removed = true
+				continue
+			}
+			keys[n.Content[i].Value] = true
+			content = append(content, n.Content[i], n.Content[i+1])
+		}
+		n.Content = content
+	}
+	for _, c := range n.Content {
+		if removeDuplicateKeys(c) {
+			removed = true
+		}
+	}
+	return removed
+}
+
+func decode(data []byte, decodeData func([]byte, interface{}) error) (*Config, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		// Empty config
+		return &Config{ApiVersion: ApiVersionV1}, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New(fmt.Sprintf("line %d: config must be a mapping of keys to values", root.Line))
+	}
+
+	switch version := apiVersion(root); version {
+	case ApiVersionV1:
+		cfg := &Config{}
+		if err := decodeData(data, cfg); err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	case "", ApiVersionV1Alpha1:
+		// Flat config keys are case-insensitive, so normalize them before decoding
+		if normalizeKeys(root, topLevelKeys) {
+			var err error
+			if data, err = yaml.Marshal(&doc); err != nil {
+				return nil, err
+			}
+		}
+		cfg := &ConfigV1Alpha1{}
+		if err := decodeData(data, cfg); err != nil {
+			return nil, err
+		}
+		return cfg.Convert(), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported config '%s': %s (must be %s or %s)", KeyApiVersion,
+			version, ApiVersionV1, ApiVersionV1Alpha1))
+	}
+}
+
+func decodeStrict(data []byte, out interface{}) error {
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	if err := d.Decode(out); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Get config schema version from config root node
+func apiVersion(root *yaml.Node) string {
+	if n := apiVersionNode(root); n != nil {
+		return n.Value
+	}
+	return ""
+}
+
+// Get config schema version value node, if any
+func apiVersionNode(root *yaml.Node) *yaml.Node {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == KeyApiVersion {
+			return root.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Rename mapping node keys to their canonical spelling, returns true if any key is renamed
+func normalizeKeys(n *yaml.Node, keys map[string]string) bool {
+	renamed := false
+	for i := 0; i < len(n.Content); i += 2 {
+		k := n.Content[i]
+		if key, ok := keys[strings.ToLower(k.Value)]; ok && key != k.Value {
+			k.Value = key
+			renamed = true
+		}
+	}
+	return renamed
+}
+
+// Convert v1alpha1 config to v1 one
+func (c *ConfigV1Alpha1) Convert() *Config {
+	return &Config{
+		ApiVersion:      ApiVersionV1,
+		CheckInterval:   c.CheckInterval,
+		Chain:           c.IpChain,
+		RestrictedPorts: c.RestrictedPorts,
+		Networks: Networks{
+			Allowed:            c.AllowedNetworks,
+			Denied:             c.DeniedNetworks,
+			Sources:            c.AllowedNetworkSources,
+			SourcesCacheDir:    c.SourcesCacheDir,
+			DnsRefreshInterval: c.DnsRefreshInterval,
+		},
+		Action: Action{
+			Target:     c.Action,
+			RejectWith: c.RejectWith,
+		},
+		Safety: Safety{
+			Mode:            c.Safety,
+			CriticalSources: c.CriticalSources,
+		},
+		Verify: c.Verify,
+	}
+}
+
+// Convert v1 config to v1alpha1 one
+func (c *Config) ConvertV1Alpha1() *ConfigV1Alpha1 {
+	return &ConfigV1Alpha1{
+		CheckInterval:         c.CheckInterval,
+		IpChain:               c.Chain,
+		RestrictedPorts:       c.RestrictedPorts,
+		AllowedNetworks:       c.Networks.Allowed,
+		AllowedNetworkSources: c.Networks.Sources,
+		SourcesCacheDir:       c.Networks.SourcesCacheDir,
+		DeniedNetworks:        c.Networks.Denied,
+		Action:                c.Action.Target,
+		RejectWith:            c.Action.RejectWith,
+		DnsRefreshInterval:    c.Networks.DnsRefreshInterval,
+		Safety:                c.Safety.Mode,
+		CriticalSources:       c.Safety.CriticalSources,
+		Verify:                c.Verify,
+	}
+}
+
+// Marshal config to YAML in flat (v1alpha1) format, with keys used by config reader
+func (c *Config) MarshalFlat() ([]byte, error) {
+	return yaml.Marshal(c.ConvertV1Alpha1())
+}
+
+// Decode allowed network from network string or object
+func (n *AllowedNetwork) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		*n = AllowedNetwork{Network: value.Value}
+		return nil
+	case yaml.MappingNode:
+		known := map[string]bool{KeyNetwork: true, KeyNotBefore: true, KeyNotAfter: true, KeySchedule: true}
+		for i := 0; i < len(value.Content); i += 2 {
+			if k := value.Content[i]; !known[k.Value] {
+				return errors.New(fmt.Sprintf("line %d: unknown allowed network key '%s'", k.Line, k.Value))
+			}
+		}
+		// Decode to the type without custom unmarshaler
+		type allowedNetwork AllowedNetwork
+		return value.Decode((*allowedNetwork)(n))
+	default:
+		return errors.New(fmt.Sprintf("line %d: allowed network must be a network or an object", value.Line))
+	}
+}
+
+// Encode allowed network without time window or schedule as network string
+func (n AllowedNetwork) MarshalYAML() (interface{}, error) {
+	if n.NotBefore == "" && n.NotAfter == "" && n.Schedule == "" {
+		return n.Network, nil
+	}
+	type allowedNetwork AllowedNetwork
+	return allowedNetwork(n), nil
+}
@@ -0,0 +1,199 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testConfig = &Config{
+	ApiVersion:      ApiVersionV1,
+	CheckInterval:   30 * time.Second,
+	Chain:           "TEST-CHAIN",
+	RestrictedPorts: []string{"10250", "10255"},
+	Networks: Networks{
+		Allowed: []AllowedNetwork{
+			{Network: "10.0.0.0/8"},
+			{Network: "192.168.5.0/24", Schedule: "* 9-17 * * 1-5"},
+			{Network: "203.0.113.7", NotAfter: "2019-01-07T18:00:00Z"},
+		},
+		Denied:  []string{"10.1.0.0/16"},
+		Sources: []Source{{Url: "https://example.com/nets.txt", RefreshInterval: time.Hour}},
+	},
+	Action: Action{Target: "REJECT", RejectWith: "tcp-reset"},
+	Safety: Safety{Mode: "refuse"},
+	Verify: &Verify{Sources: []string{"10.0.0.1"}, GracePeriod: 10 * time.Second},
+}
+
+func TestDecode(t *testing.T) {
+	type args struct {
+		data string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    *Config
+		wantErr bool
+	}{
+		{
+			name: "v1",
+			args: args{data: `
+apiVersion: kube-restrict-ip/v1
+checkInterval: 30s
+chain: TEST-CHAIN
+restrictedPorts: [10250, "10255"]
+networks:
+  allowed:
+    - 10.0.0.0/8
+    - network: 192.168.5.0/24
+      schedule: "* 9-17 * * 1-5"
+    - network: 203.0.113.7
+      notAfter: 2019-01-07T18:00:00Z
+  denied: [10.1.0.0/16]
+  sources:
+    - url: https://example.com/nets.txt
+      refreshInterval: 1h
+action:
+  target: REJECT
+  rejectWith: tcp-reset
+safety:
+  mode: refuse
+verify:
+  sources: [10.0.0.1]
+  gracePeriod: 10s
+`},
+			want: testConfig,
+		},
+		{
+			name: "v1alpha1",
+			args: args{data: `
+apiVersion: kube-restrict-ip/v1alpha1
+checkInterval: 30s
+ipChain: TEST-CHAIN
+restrictedPorts: [10250, 10255]
+allowedNetworks:
+  - 10.0.0.0/8
+  - network: 192.168.5.0/24
+    schedule: "* 9-17 * * 1-5"
+  - network: 203.0.113.7
+    notAfter: 2019-01-07T18:00:00Z
+deniedNetworks: [10.1.0.0/16]
+allowedNetworkSources:
+  - url: https://example.com/nets.txt
+    refreshInterval: 1h
+action: REJECT
+rejectWith: tcp-reset
+safety: refuse
+verify:
+  sources: [10.0.0.1]
+  gracePeriod: 10s
+`},
+			want: testConfig,
+		},
+		{
+			name: "no version",
+			args: args{data: "RestrictedPorts: [22]\nallowednetworks: [10.0.0.0/8]\n"},
+			want: &Config{
+				ApiVersion:      ApiVersionV1,
+				RestrictedPorts: []string{"22"},
+				Networks:        Networks{Allowed: []AllowedNetwork{{Network: "10.0.0.0/8"}}},
+			},
+		},
+		{
+			name: "empty",
+			args: args{data: ""},
+			want: &Config{ApiVersion: ApiVersionV1},
+		},
+		{
+			name:    "unknown key",
+			args:    args{data: "restrictedPorts: [22]\nallowedNetwork: [10.0.0.0/8]\n"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown v1 key",
+			args:    args{data: "apiVersion: kube-restrict-ip/v1\nnetworks:\n  allowedNetworks: [10.0.0.0/8]\n"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown allowed network key",
+			args:    args{data: "allowedNetworks:\n  - network: 10.0.0.0/8\n    until: 2019-01-07\n"},
+			wantErr: true,
+		},
+		{
+			name:    "flat keys in v1",
+			args:    args{data: "apiVersion: kube-restrict-ip/v1\nallowedNetworks: [10.0.0.0/8]\n"},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported version",
+			args:    args{data: "apiVersion: kube-restrict-ip/v2\n"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			args:    args{data: "checkInterval: 60\n"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode([]byte(tt.args.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_MarshalFlat(t *testing.T) {
+	data, err := testConfig.MarshalFlat()
+	if err != nil {
+		t.Fatalf("Config.MarshalFlat() error = %v", err)
+	}
+	got, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() error = %v, data:\n%s", err, data)
+	}
+	if !reflect.DeepEqual(got, testConfig) {
+		t.Errorf("Decode(Config.MarshalFlat()) = %+v, want %+v", got, testConfig)
+	}
+}
+
+func TestJsonSchema(t *testing.T) {
+	for _, version := range []string{ApiVersionV1, ApiVersionV1Alpha1} {
+		data, err := JsonSchema(version)
+		if err != nil {
+			t.Fatalf("JsonSchema(%s) error = %v", version, err)
+		}
+		s := map[string]interface{}{}
+		if err := json.Unmarshal(data, &s); err != nil {
+			t.Fatalf("JsonSchema(%s) is not valid JSON: %v", version, err)
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		if properties[KeyApiVersion] == nil || properties[KeyRestrictedPorts] == nil {
+			t.Errorf("JsonSchema(%s) properties = %v", version, properties)
+		}
+	}
+	if _, err := JsonSchema("v2"); err == nil {
+		t.Errorf("JsonSchema() error = nil for unsupported version")
+	}
+}
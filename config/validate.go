@@ -0,0 +1,595 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+var yamlErrorLineRegex = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// Config validation problem
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+// Network list entry with its definition line
+type networkEntry struct {
+	value string
+	net   *net.IPNet
+	line  int
+}
+
+type validator struct {
+	file     string
+	problems []Problem
+	// Config key names for problem messages by flat config keys, if differ
+	names map[string]string
+	// Config value nodes by flat config keys, to find invalid values lines
+	values map[string]*yaml.Node
+}
+
+// Validate config file data, reporting all problems found: syntax errors, unknown keys,
+// duplicate entries, overlapping networks and networks with host bits set. Config values
+// are checked by the same code as config is read by app (see NewAppConfig), with app instance
+// ID embedded to the chain name, config file nodes are used to find invalid values lines.
+// Partial config (e.g. config directory file) may miss required keys
+func Validate(file string, data []byte, partial bool, instance string) []Problem {
+	v := &validator{file: file, values: map[string]*yaml.Node{}}
+	if v.validate(data) {
+		v.check(data, partial, instance)
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].Line < v.problems[j].Line
+	})
+	return v.problems
+}
+
+// Validate merged config directory files for required keys
+func ValidateMerged(dir string, m *Merged, instance string) []Problem {
+	v := &validator{file: dir}
+	_, err := NewAppConfig(ValuesMap(m.Values), instance, nil)
+	if errs, ok := err.(ValueErrors); ok {
+		for _, e := range errs {
+			if e.Missing {
+				v.addf(nil, "%v", e)
+			}
+		}
+	}
+	return v.problems
+}
+
+func (v *validator) addf(n *yaml.Node, format string, args ...interface{}) {
+	line := 0
+	if n != nil {
+		line = n.Line
+	}
+	v.problems = append(v.problems, Problem{File: v.file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check config file structure and entries, returns false if config can't be decoded
+func (v *validator) validate(data []byte) bool {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		p := Problem{File: v.file, Message: err.Error()}
+		if m := yamlErrorLineRegex.FindStringSubmatch(err.Error()); m != nil {
+			p.Line, _ = strconv.Atoi(m[1])
+			p.Message = m[2]
+		}
+		v.problems = append(v.problems, p)
+		return false
+	}
+
+	var root *yaml.Node
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	if root != nil && root.Kind != yaml.MappingNode {
+		v.addf(root, "config must be a mapping of keys to values")
+		return false
+	}
+
+	if root != nil {
+		switch version := apiVersion(root); version {
+		case ApiVersionV1:
+			v.names = v1KeyPaths
+			root = v.flattenV1(root)
+		case "", ApiVersionV1Alpha1:
+		default:
+			v.addf(apiVersionNode(root), "unsupported config '%s': %s (must be %s or %s)", KeyApiVersion, version,
+				ApiVersionV1, ApiVersionV1Alpha1)
+			return false
+		}
+	}
+
+	keys := map[string]*yaml.Node{}
+	var allowed, denied []networkEntry
+	if root != nil {
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			k, val := root.Content[i], root.Content[i+1]
+			// Config keys are case-insensitive
+			key, ok := topLevelKeys[strings.ToLower(k.Value)]
+			if !ok {
+				v.unknownKey(k, "", topLevelKeyNames())
+				continue
+			}
+			if prev, ok := keys[key]; ok {
+				v.addf(k, "duplicate key '%s' (first defined at line %d)", v.name(key), prev.Line)
+				continue
+			}
+			keys[key] = k
+			v.values[key] = val
+
+			switch key {
+			case KeyApiVersion:
+				// Checked on config schema version detection
+			case KeyCheckInterval, KeyDnsRefreshInterval, KeyIpChainName, KeyRejectAction, KeyRejectWith,
+				KeySourcesCacheDir, KeySafety:
+				v.scalar(val, v.name(key))
+			case KeyRestrictedPorts:
+				v.ports(val)
+			case KeyAllowedNetworks:
+				allowed = v.allowedNetworks(val)
+			case KeyDeniedNetworks:
+				denied = v.networks(val, v.name(key))
+			case KeyAllowedNetworkSources:
+				v.sources(val)
+			case KeyVerify:
+				v.object(val, KeyVerify, KeyVerifySources, KeyVerifyEndpoints, KeyVerifyGracePeriod)
+			case KeyCriticalSources:
+				v.scalars(val, v.name(key))
+			}
+		}
+	}
+
+	v.overlaps(allowed, v.name(KeyAllowedNetworks))
+	v.overlaps(denied, v.name(KeyDeniedNetworks))
+	v.shadowed(denied, allowed)
+
+	return true
+}
+
+var decodeErrorLineRegex = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// Check config values by decoding config as app does and creating app config from its values,
+// invalid values problems are reported at their config file lines. If config can't be decoded,
+// the values decoded leniently are checked, so all problems are reported at once
+func (v *validator) check(data []byte, partial bool, instance string) {
+	// Problems already reported on the line are not reported again
+	lines := map[int]bool{}
+	for _, p := range v.problems {
+		lines[p.Line] = true
+	}
+
+	values, err := flatValues(data)
+	if err != nil {
+		// Problems found on config file structure check are reported by decoder as well
+		msgs := []string{err.Error()}
+		if te, ok := err.(*yaml.TypeError); ok {
+			msgs = te.Errors
+		}
+		for _, msg := range msgs {
+			p := Problem{File: v.file, Message: msg}
+			if m := decodeErrorLineRegex.FindStringSubmatch(msg); m != nil {
+				p.Line, _ = strconv.Atoi(m[1])
+				p.Message = m[2]
+			}
+			if !lines[p.Line] && (p.Line > 0 || len(v.problems) == 0) {
+				v.problems = append(v.problems, p)
+			}
+		}
+		for _, p := range v.problems {
+			lines[p.Line] = true
+		}
+
+		cfg, err := decodeLenient(data)
+		if err != nil {
+			return
+		}
+		if values, err = configValues(cfg); err != nil {
+			return
+		}
+	}
+
+	_, err = NewAppConfig(ValuesMap(values), instance, nil)
+	errs, _ := err.(ValueErrors)
+	for _, e := range errs {
+		if e.Missing && partial {
+			continue
+		}
+		n := v.find(e)
+		if n != nil && lines[n.Line] {
+			// Invalid value is reported by decoder, e.g. value of invalid type left unset
+			continue
+		}
+		v.addf(n, "%v", e)
+	}
+}
+
+// Find config file node of the invalid value: the list entry or object field scalar node
+// with the value, if any, or the config key value node otherwise
+func (v *validator) find(e *ValueError) *yaml.Node {
+	n := v.values[e.Key]
+	if n == nil || e.Value == "" {
+		return n
+	}
+	var found *yaml.Node
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		switch {
+		case found != nil:
+		case n.Kind == yaml.ScalarNode && n.Value == e.Value:
+			found = n
+		case n.Kind == yaml.MappingNode:
+			for i := 1; i < len(n.Content); i += 2 {
+				walk(n.Content[i])
+			}
+		default:
+			for _, c := range n.Content {
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	if found == nil {
+		return n
+	}
+	return found
+}
+
+// Get config key name for problem messages
+func (v *validator) name(key string) string {
+	if name, ok := v.names[key]; ok {
+		return name
+	}
+	return key
+}
+
+// Config v1 key paths by flat config keys
+var v1KeyPaths = map[string]string{
+	KeyApiVersion:            "apiVersion",
+	KeyCheckInterval:         "checkInterval",
+	KeyIpChainName:           "chain",
+	KeyRestrictedPorts:       "restrictedPorts",
+	KeyAllowedNetworks:       "networks.allowed",
+	KeyDeniedNetworks:        "networks.denied",
+	KeyAllowedNetworkSources: "networks.sources",
+	KeySourcesCacheDir:       "networks.sourcesCacheDir",
+	KeyDnsRefreshInterval:    "networks.dnsRefreshInterval",
+	KeyRejectAction:          "action.target",
+	KeyRejectWith:            "action.rejectWith",
+	KeySafety:                "safety.mode",
+	KeyCriticalSources:       "safety.criticalSources",
+	KeyVerify:                "verify",
+}
+
+// Convert config v1 root node to the flat config one, keeping original nodes for problems line numbers
+func (v *validator) flattenV1(root *yaml.Node) *yaml.Node {
+	keys := map[string]string{}
+	for key, path := range v1KeyPaths {
+		keys[path] = key
+	}
+
+	flat := &yaml.Node{Kind: yaml.MappingNode, Line: root.Line, Column: root.Column}
+	var flatten func(n *yaml.Node, prefix string)
+	flatten = func(n *yaml.Node, prefix string) {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, val := n.Content[i], n.Content[i+1]
+			path := prefix + k.Value
+			if key, ok := keys[path]; ok {
+				flat.Content = append(flat.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Value: key, Line: k.Line, Column: k.Column}, val)
+				continue
+			}
+			if names := v1KeyNames(path + "."); len(names) > 0 {
+				if val.Kind != yaml.MappingNode {
+					v.addf(val, "'%s' must be an object", path)
+					continue
+				}
+				flatten(val, path+".")
+				continue
+			}
+			v.unknownKey(k, strings.TrimSuffix(prefix, "."), v1KeyNames(prefix))
+		}
+	}
+	flatten(root, "")
+
+	return flat
+}
+
+// Get config v1 key names having the path prefix
+func v1KeyNames(prefix string) []string {
+	set := map[string]bool{}
+	for _, path := range v1KeyPaths {
+		if strings.HasPrefix(path, prefix) {
+			set[strings.SplitN(strings.TrimPrefix(path, prefix), ".", 2)[0]] = true
+		}
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var topLevelKeys = toKeySet(KeyApiVersion, KeyCheckInterval, KeyIpChainName, KeyRestrictedPorts, KeyAllowedNetworks,
+	KeyDeniedNetworks, KeyRejectAction, KeyRejectWith, KeyDnsRefreshInterval, KeyAllowedNetworkSources,
+	KeySourcesCacheDir, KeyVerify, KeySafety, KeyCriticalSources)
+
+func toKeySet(keys ...string) map[string]string {
+	set := map[string]string{}
+	for _, k := range keys {
+		set[strings.ToLower(k)] = k
+	}
+	return set
+}
+
+func topLevelKeyNames() []string {
+	names := make([]string, 0, len(topLevelKeys))
+	for _, k := range topLevelKeys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Report unknown key, suggesting similar known key, if any
+func (v *validator) unknownKey(k *yaml.Node, section string, known []string) {
+	where := ""
+	if section != "" {
+		where = fmt.Sprintf(" in '%s'", section)
+	}
+	for _, name := range known {
+		if editDistance(strings.ToLower(name), strings.ToLower(k.Value)) <= maxSuggestDistance {
+			v.addf(k, "unknown key '%s'%s, did you mean '%s'?", k.Value, where, name)
+			return
+		}
+	}
+	v.addf(k, "unknown key '%s'%s", k.Value, where)
+}
+
+// Maximum edit distance of unknown key to known one to suggest
+const maxSuggestDistance = 2
+
+// Get Levenshtein distance between strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Check node is a scalar value
+func (v *validator) scalar(n *yaml.Node, key string) bool {
+	if n.Kind != yaml.ScalarNode {
+		v.addf(n, "'%s' must be a scalar value", key)
+		return false
+	}
+	return true
+}
+
+// Get list items, nil if node is not a list
+func (v *validator) list(n *yaml.Node, key string) []*yaml.Node {
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return nil
+	}
+	if n.Kind != yaml.SequenceNode {
+		v.addf(n, "'%s' must be a list", key)
+		return nil
+	}
+	return n.Content
+}
+
+// Get object fields by key, nil if node is not an object
+func (v *validator) object(n *yaml.Node, key string, known ...string) map[string]*yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		v.addf(n, "'%s' must be an object", key)
+		return nil
+	}
+	fields := map[string]*yaml.Node{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, val := n.Content[i], n.Content[i+1]
+		if !util.ToSet(known)[k.Value] {
+			v.unknownKey(k, key, known)
+			continue
+		}
+		if _, ok := fields[k.Value]; ok {
+			v.addf(k, "duplicate key '%s' in '%s'", k.Value, key)
+			continue
+		}
+		fields[k.Value] = val
+	}
+	return fields
+}
+
+func (v *validator) ports(n *yaml.Node) {
+	lines := map[string]int{}
+	for _, item := range v.list(n, v.name(KeyRestrictedPorts)) {
+		if !v.scalar(item, v.name(KeyRestrictedPorts)+" entry") {
+			continue
+		}
+		port := strings.TrimLeft(item.Value, "0")
+		if line, ok := lines[port]; ok {
+			v.addf(item, "duplicate '%s' entry %s (first defined at line %d)", v.name(KeyRestrictedPorts), item.Value, line)
+			continue
+		}
+		lines[port] = item.Line
+	}
+}
+
+// Parse network list entry, reporting networks with host bits set. Invalid networks
+// are skipped, they are reported on config values check
+func (v *validator) network(n *yaml.Node, key string, hostnames bool) (networkEntry, bool) {
+	e := networkEntry{value: n.Value, line: n.Line}
+	if hostnames && util.IsHostname(n.Value) {
+		return e, true
+	}
+	ipNet, err := util.ParseNetwork(n.Value)
+	if err != nil {
+		return e, false
+	}
+	if ip, _, err := net.ParseCIDR(n.Value); err == nil && !ip.Equal(ipNet.IP) {
+		v.addf(n, "'%s' entry %s has host bits set (network address is %s)", key, n.Value, ipNet)
+	}
+	e.net = ipNet
+	return e, true
+}
+
+func (v *validator) networks(n *yaml.Node, key string) []networkEntry {
+	var entries []networkEntry
+	for _, item := range v.list(n, key) {
+		if !v.scalar(item, key+" entry") {
+			continue
+		}
+		if e, ok := v.network(item, key, false); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (v *validator) allowedNetworks(n *yaml.Node) []networkEntry {
+	var entries []networkEntry
+	for _, item := range v.list(n, v.name(KeyAllowedNetworks)) {
+		switch item.Kind {
+		case yaml.ScalarNode:
+			if e, ok := v.network(item, v.name(KeyAllowedNetworks), true); ok {
+				entries = append(entries, e)
+			}
+		case yaml.MappingNode:
+			// Scheduled network, not checked for overlaps since it's active only temporarily
+			v.scheduledNetwork(item)
+		default:
+			v.addf(item, "'%s' entry must be a network or an object", v.name(KeyAllowedNetworks))
+		}
+	}
+	return entries
+}
+
+func (v *validator) scheduledNetwork(n *yaml.Node) {
+	section := v.name(KeyAllowedNetworks) + " entry"
+	for _, val := range v.object(n, section, KeyNetwork, KeyNotBefore, KeyNotAfter, KeySchedule) {
+		v.scalar(val, section+" field")
+	}
+}
+
+func (v *validator) sources(n *yaml.Node) {
+	section := v.name(KeyAllowedNetworkSources) + " entry"
+	for _, item := range v.list(n, v.name(KeyAllowedNetworkSources)) {
+		fields := v.object(item, section, KeySourceUrl, KeySourceFile, KeySourceFormat, KeySourcePath,
+			KeySourceRefreshInterval)
+		for key, val := range fields {
+			v.scalar(val, key)
+		}
+	}
+}
+
+// Check list entries are scalar values
+func (v *validator) scalars(n *yaml.Node, key string) {
+	for _, item := range v.list(n, key) {
+		v.scalar(item, key+" entry")
+	}
+}
+
+// Report duplicate and overlapping networks in the list
+func (v *validator) overlaps(entries []networkEntry, key string) {
+	hosts := map[string]int{}
+	for j, e := range entries {
+		if e.net == nil {
+			host := strings.ToLower(e.value)
+			if line, ok := hosts[host]; ok {
+				v.problems = append(v.problems, Problem{File: v.file, Line: e.line,
+					Message: fmt.Sprintf("duplicate '%s' entry %s (first defined at line %d)", key, e.value, line)})
+			} else {
+				hosts[host] = e.line
+			}
+			continue
+		}
+		for _, prev := range entries[:j] {
+			if prev.net == nil {
+				continue
+			}
+			var msg string
+			switch {
+			case prev.net.String() == e.net.String():
+				msg = fmt.Sprintf("duplicate '%s' entry %s (first defined at line %d)", key, e.value, prev.line)
+			case util.ContainsNetwork(prev.net, e.net):
+				msg = fmt.Sprintf("'%s' entry %s is covered by entry %s (line %d)", key, e.value, prev.value, prev.line)
+			case util.ContainsNetwork(e.net, prev.net):
+				msg = fmt.Sprintf("'%s' entry %s covers entry %s (line %d)", key, e.value, prev.value, prev.line)
+			default:
+				continue
+			}
+			v.problems = append(v.problems, Problem{File: v.file, Line: e.line, Message: msg})
+			break
+		}
+	}
+}
+
+// Report allowed networks which rules can never match since they are covered by denied networks
+func (v *validator) shadowed(denied, allowed []networkEntry) {
+	for _, a := range allowed {
+		if a.net == nil {
+			continue
+		}
+		for _, d := range denied {
+			if d.net != nil && util.ContainsNetwork(d.net, a.net) {
+				v.problems = append(v.problems, Problem{File: v.file, Line: a.line,
+					Message: fmt.Sprintf("'%s' entry %s is never matched: covered by '%s' entry %s (line %d)",
+						v.name(KeyAllowedNetworks), a.value, v.name(KeyDeniedNetworks), d.value, d.line)})
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	type args struct {
+		data     string
+		partial  bool
+		instance string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
+	}{
+		{
+			name: "valid",
+			args: args{data: `
+checkInterval: 30s
+restrictedPorts: [10250, 10255]
+allowedNetworks:
+  - 10.0.0.0/8
+  - 192.168.1.1
+  - example.com
+  - network: 172.16.0.0/12
+    schedule: "* 9-17 * * 1-5"
+deniedNetworks: [192.168.2.0/24]
+action: REJECT
+rejectWith: tcp-reset
+verify:
+  sources: [10.0.0.1]
+  endpoints: ["10.0.0.1:6443"]
+`},
+		},
+		{
+			name: "v1",
+			args: args{data: `
+apiVersion: kube-restrict-ip/v1
+restrictedPorts: [22]
+networks:
+  allowed: [10.0.0.1/8]
+  denid: [192.168.0.0/16]
+action:
+  target: DROP
+  rejectWith: tcp-reset
+chain: [TEST]
+`},
+			want: []string{
+				"cfg.yaml:5: 'networks.allowed' entry 10.0.0.1/8 has host bits set (network address is 10.0.0.0/8)",
+				"cfg.yaml:6: unknown key 'denid' in 'networks', did you mean 'denied'?",
+				"cfg.yaml:9: reject type can't be used with action target DROP",
+				"cfg.yaml:10: 'chain' must be a scalar value",
+			},
+		},
+		{
+			name: "unsupported version",
+			args: args{data: "apiVersion: kube-restrict-ip/v2\n"},
+			want: []string{
+				"cfg.yaml:1: unsupported config 'apiVersion': kube-restrict-ip/v2 (must be kube-restrict-ip/v1 or kube-restrict-ip/v1alpha1)",
+			},
+		},
+		{
+			name: "syntax error",
+			args: args{data: "restrictedPorts: [1\nallowedNetworks: ]\n"},
+			want: []string{"cfg.yaml:1: did not find expected ',' or ']'"},
+		},
+		{
+			name: "missing required keys",
+			args: args{data: "checkInterval: 30s\n"},
+			want: []string{
+				"cfg.yaml: no restricted ports defined (add 'restrictedPorts' section)",
+				"cfg.yaml: no allowed networks defined (add 'allowedNetworks' or 'allowedNetworkSources' section)",
+			},
+		},
+		{
+			name: "partial",
+			args: args{data: "checkInterval: 30s\n", partial: true},
+		},
+		{
+			name: "unknown keys",
+			args: args{data: `
+restrictedPorts: [22]
+allowdNetworks: [10.0.0.0/8]
+allowedNetworkSources:
+  - url: https://example.com/nets.txt
+    refresh: 1h
+foo: bar
+`, partial: true},
+			want: []string{
+				"cfg.yaml:3: unknown key 'allowdNetworks', did you mean 'allowedNetworks'?",
+				"cfg.yaml:6: unknown key 'refresh' in 'allowedNetworkSources entry'",
+				"cfg.yaml:7: unknown key 'foo'",
+			},
+		},
+		{
+			name: "unknown key with invalid values",
+			args: args{data: `
+restrictedPorts: [0]
+allowedNetworks: [bad!!, 10.0.0.0/33]
+allowedNetwork: [10.0.0.0/8]
+`},
+			want: []string{
+				"cfg.yaml:2: invalid port: 0",
+				"cfg.yaml:3: invalid 'allowedNetworks' entry: bad!!",
+				"cfg.yaml:3: invalid 'allowedNetworks' entry: 10.0.0.0/33",
+				"cfg.yaml:4: unknown key 'allowedNetwork', did you mean 'allowedNetworks'?",
+			},
+		},
+		{
+			name: "duplicates",
+			args: args{data: `
+restrictedPorts: [22, 80, 22]
+allowedNetworks:
+  - 10.0.0.0/8
+  - example.com
+  - 10.0.0.0/8
+  - example.com
+restrictedPorts: [443]
+`},
+			want: []string{
+				"cfg.yaml:2: duplicate 'restrictedPorts' entry 22 (first defined at line 2)",
+				"cfg.yaml:6: duplicate 'allowedNetworks' entry 10.0.0.0/8 (first defined at line 4)",
+				"cfg.yaml:7: duplicate 'allowedNetworks' entry example.com (first defined at line 5)",
+				"cfg.yaml:8: duplicate key 'restrictedPorts' (first defined at line 2)",
+			},
+		},
+		{
+			name: "overlapping networks and host bits",
+			args: args{data: `
+restrictedPorts: [22]
+allowedNetworks:
+  - 10.1.0.0/16
+  - 10.0.0.1/8
+  - 192.168.0.0/16
+  - 192.168.1.0/24
+deniedNetworks:
+  - 192.168.0.0/16
+`},
+			want: []string{
+				"cfg.yaml:5: 'allowedNetworks' entry 10.0.0.1/8 has host bits set (network address is 10.0.0.0/8)",
+				"cfg.yaml:5: 'allowedNetworks' entry 10.0.0.1/8 covers entry 10.1.0.0/16 (line 4)",
+				"cfg.yaml:6: 'allowedNetworks' entry 192.168.0.0/16 is never matched: covered by 'deniedNetworks' entry 192.168.0.0/16 (line 9)",
+				"cfg.yaml:7: 'allowedNetworks' entry 192.168.1.0/24 is covered by entry 192.168.0.0/16 (line 6)",
+				"cfg.yaml:7: 'allowedNetworks' entry 192.168.1.0/24 is never matched: covered by 'deniedNetworks' entry 192.168.0.0/16 (line 9)",
+			},
+		},
+		{
+			name: "invalid duration",
+			args: args{data: `
+checkInterval: soon
+restrictedPorts: [22]
+allowedNetworks: [10.0.0.0/8]
+`},
+			want: []string{"cfg.yaml:2: cannot unmarshal !!str `soon` into time.Duration"},
+		},
+		{
+			name: "invalid values",
+			args: args{data: `
+checkInterval: 1m
+restrictedPorts: [0]
+allowedNetworks:
+  - 10.0.0.0/33
+  - network: 10.0.0.1
+    notBefore: 2019-02-01
+    notAfter: 2019-01-01
+deniedNetworks: [example.com]
+action: DROP
+rejectWith: tcp-reset
+safety: maybe
+`},
+			want: []string{
+				"cfg.yaml:3: invalid port: 0",
+				"cfg.yaml:5: invalid 'allowedNetworks' entry: 10.0.0.0/33",
+				"cfg.yaml:8: invalid allowed network entry 10.0.0.1: 'notBefore' is not before 'notAfter'",
+				"cfg.yaml:9: invalid 'deniedNetworks' entry: example.com",
+				"cfg.yaml:11: reject type can't be used with action target DROP",
+				"cfg.yaml:12: invalid safety mode: maybe (must be allow, refuse or off)",
+			},
+		},
+		{
+			name: "invalid values in partial config",
+			args: args{data: `
+apiVersion: kube-restrict-ip/v1
+networks:
+  allowed:
+    - network: 10.0.0.0/8
+      schedule: "* 25 * * *"
+safety:
+  criticalSources: [api.example.com]
+`, partial: true},
+			want: []string{
+				`cfg.yaml:6: invalid allowed network entry 10.0.0.0/8: invalid schedule "* 25 * * *" hour field: value out of range 0-23: 25`,
+				"cfg.yaml:8: invalid critical source address: api.example.com",
+			},
+		},
+		{
+			name: "instance chain name",
+			args: args{data: `
+ipChain: KUBE-RESTRICT-IP
+restrictedPorts: [22]
+allowedNetworks: [10.0.0.0/8]
+`, instance: "team-a"},
+		},
+		{
+			name: "instance chain name too long",
+			args: args{data: `
+ipChain: KUBE-RESTRICT-IP
+restrictedPorts: [22]
+allowedNetworks: [10.0.0.0/8]
+`, instance: "team-a-long"},
+			want: []string{
+				"cfg.yaml:2: instance ID team-a-long is too long for chain KUBE-RESTRICT-IP: " +
+					"instance chain name KUBE-RESTRICT-IP-team-a-long is 28 characters (must be up to 24)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, p := range Validate("cfg.yaml", []byte(tt.args.data), tt.args.partial, tt.args.instance) {
+				got = append(got, p.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
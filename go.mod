@@ -9,6 +9,7 @@ require (
 	github.com/magiconair/properties v1.8.0
 	github.com/mitchellh/mapstructure v1.1.2
 	github.com/pelletier/go-toml v1.2.0
+	github.com/prometheus/client_golang v0.9.2
 	github.com/spf13/afero v1.2.0
 	github.com/spf13/cast v1.3.0
 	github.com/spf13/cobra v0.0.3
@@ -18,6 +19,7 @@ require (
 	golang.org/x/sys v0.0.0-20190116161447-11f53e031339
 	golang.org/x/text v0.3.0
 	gopkg.in/yaml.v2 v2.2.2
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/apimachinery v0.0.0-20190111195121-fa6ddc151d63
 	k8s.io/apiserver v0.0.0-20190117055948-c688f42695b9
 	k8s.io/klog v0.1.0
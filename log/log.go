@@ -26,18 +26,6 @@ import (
 
 var logFlushFreq = pflag.Duration("log-flush-frequency", 5*time.Second, "maximum number of seconds between log flushes")
 
-func init() {
-	// Don't steal command line arguments from `go test`
-	if flag.Lookup("test.v") != nil {
-		return
-	}
-	// Trick to avoid 'logging before flag.Parse' warning
-	if err := flag.CommandLine.Parse([]string{}); err != nil {
-		return
-	}
-	_ = flag.Set("logtostderr", "true")
-}
-
 // GlogWriter serves as a bridge between the standard log package and the glog package.
 type GlogWriter struct{}
 
@@ -47,8 +35,13 @@ func (writer GlogWriter) Write(data []byte) (n int, err error) {
 	return len(data), nil
 }
 
-// Initialize logging
+// Initialize logging. Should be called by the command only, as go flags are marked parsed
+// (command line flags are parsed by pflag), so the test flags would not be parsed by `go test`
 func Init() {
+	// Trick to avoid 'logging before flag.Parse' warning
+	if !flag.Parsed() {
+		_ = flag.CommandLine.Parse([]string{})
+	}
 	log.SetOutput(GlogWriter{})
 	log.SetFlags(0)
 	// The default glog flush interval is too long (30 seconds)
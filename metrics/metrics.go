@@ -0,0 +1,220 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	MetricsPath = "/metrics"
+
+	namespace = "kube_restrict_ip"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+var (
+	// Hash of the applied config, as the label of the metric with constant value 1
+	configInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_info",
+		Help:      "Applied config hash.",
+	}, []string{"hash"})
+
+	// Number of config updates by result: applied, unchanged or error
+	configUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_updates_total",
+		Help:      "Number of config updates by result.",
+	}, []string{"result"})
+
+	// Traffic matched by network rules chain rules, by rule network, restricted ports and rule kind
+	rulePackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rule_packets_total",
+		Help:      "Number of packets matched by network rules chain rule.",
+	}, ruleLabels)
+	ruleBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rule_bytes_total",
+		Help:      "Number of bytes matched by network rules chain rule.",
+	}, ruleLabels)
+
+	// Startup policy in effect due to invalid config file, as the label of the metric with value 1
+	startupPolicyInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "startup_policy_info",
+		Help:      "Startup policy in effect due to invalid config file.",
+	}, []string{"policy"})
+
+	// Allowed networks config entries without hits over the stale window, as the label of the metric with value 1
+	staleEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stale_allowed_entry",
+		Help:      "Allowed networks config entry without hits over the stale window.",
+	}, []string{"entry"})
+)
+
+var ruleLabels = []string{"network", "ports", "kind"}
+
+// Last seen iptables rules counters values, by rule labels
+var lastRuleCounters = struct {
+	sync.Mutex
+	values map[ruleKey]RuleCounters
+}{values: map[ruleKey]RuleCounters{}}
+
+type ruleKey struct {
+	network, ports, kind string
+}
+
+// Network rules chain rule iptables counters
+type RuleCounters struct {
+	// Rule source network, empty for the default rule
+	Network string
+	// Restricted ports, comma separated
+	Ports   string
+	Kind    string
+	Packets uint64
+	Bytes   uint64
+}
+
+const (
+	ConfigUpdateApplied   = "applied"
+	ConfigUpdateUnchanged = "unchanged"
+	ConfigUpdateError     = "error"
+)
+
+func init() {
+	prometheus.MustRegister(configInfo, configUpdates, rulePackets, ruleBytes, startupPolicyInfo, staleEntries)
+}
+
+// Set applied config hash
+func SetConfigHash(hash string) {
+	configInfo.Reset()
+	configInfo.WithLabelValues(hash).Set(1)
+}
+
+// Set startup policy in effect due to invalid config file, empty if config file is valid
+func SetStartupPolicy(policy string) {
+	startupPolicyInfo.Reset()
+	if policy != "" {
+		startupPolicyInfo.WithLabelValues(policy).Set(1)
+	}
+}
+
+// Count config update with given result
+func CountConfigUpdate(result string) {
+	configUpdates.WithLabelValues(result).Inc()
+}
+
+// Update rules traffic metrics from the current iptables rules counters values. Counters lower
+// than the last seen ones are considered reset. Metrics of the rules not present anymore are removed
+func UpdateRuleCounters(rules []RuleCounters) {
+	lastRuleCounters.Lock()
+	defer lastRuleCounters.Unlock()
+
+	seen := map[ruleKey]bool{}
+	for _, r := range rules {
+		k := ruleKey{network: r.Network, ports: r.Ports, kind: r.Kind}
+		seen[k] = true
+
+		packets, bytes := r.Packets, r.Bytes
+		if last, ok := lastRuleCounters.values[k]; ok && packets >= last.Packets && bytes >= last.Bytes {
+			packets -= last.Packets
+			bytes -= last.Bytes
+		}
+		rulePackets.WithLabelValues(k.network, k.ports, k.kind).Add(float64(packets))
+		ruleBytes.WithLabelValues(k.network, k.ports, k.kind).Add(float64(bytes))
+		lastRuleCounters.values[k] = r
+	}
+
+	for k := range lastRuleCounters.values {
+		if !seen[k] {
+			rulePackets.DeleteLabelValues(k.network, k.ports, k.kind)
+			ruleBytes.DeleteLabelValues(k.network, k.ports, k.kind)
+			delete(lastRuleCounters.values, k)
+		}
+	}
+}
+
+// Mark iptables rules counters as reset (e.g. by rules re-applying), so next counters
+// values are counted in full, even if they're not lower than the last seen ones
+func ResetRuleCounters() {
+	lastRuleCounters.Lock()
+	defer lastRuleCounters.Unlock()
+
+	for k, r := range lastRuleCounters.values {
+		r.Packets, r.Bytes = 0, 0
+		lastRuleCounters.values[k] = r
+	}
+}
+
+// Set allowed networks config entries without hits over the stale window
+func SetStaleEntries(entries []string) {
+	staleEntries.Reset()
+	for _, e := range entries {
+		staleEntries.WithLabelValues(e).Set(1)
+	}
+}
+
+// Metrics HTTP server
+type Server struct {
+	server  *http.Server
+	address string
+}
+
+// Start serving metrics on the address
+func Start(address string) (*Server, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.Handler())
+
+	s := &Server{server: &http.Server{Handler: mux}, address: l.Addr().String()}
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			glog.Errorf("metrics server error: %v", err)
+		}
+	}()
+	glog.Infof("metrics server listening on %s", l.Addr())
+
+	return s, nil
+}
+
+// Get address metrics are served on
+func (s *Server) Address() string {
+	return s.address
+}
+
+// Stop serving metrics
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		glog.Errorf("metrics server shutdown error: %v", err)
+	}
+}
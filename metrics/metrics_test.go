@@ -0,0 +1,97 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	s, err := Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	SetConfigHash("old")
+	SetConfigHash("new")
+	CountConfigUpdate(ConfigUpdateApplied)
+	CountConfigUpdate(ConfigUpdateUnchanged)
+	CountConfigUpdate(ConfigUpdateUnchanged)
+
+	UpdateRuleCounters([]RuleCounters{
+		{Network: "10.0.0.0/8", Ports: "10250", Kind: "allowed", Packets: 10, Bytes: 1000},
+		{Network: "192.168.0.0/16", Ports: "10250", Kind: "allowed", Packets: 1, Bytes: 100},
+		{Ports: "10250", Kind: "default", Packets: 5, Bytes: 500},
+	})
+	// Counters increased
+	UpdateRuleCounters([]RuleCounters{
+		{Network: "10.0.0.0/8", Ports: "10250", Kind: "allowed", Packets: 15, Bytes: 1500},
+		{Network: "192.168.0.0/16", Ports: "10250", Kind: "allowed", Packets: 1, Bytes: 100},
+		{Ports: "10250", Kind: "default", Packets: 7, Bytes: 700},
+	})
+	SetStaleEntries([]string{"192.168.0.0/16", "example.com"})
+	SetStaleEntries([]string{"example.com"})
+	SetStartupPolicy("failOpen")
+	SetStartupPolicy("failClosed")
+
+	// Counters reset by resync, network removed
+	ResetRuleCounters()
+	UpdateRuleCounters([]RuleCounters{
+		{Network: "10.0.0.0/8", Ports: "10250", Kind: "allowed", Packets: 20, Bytes: 2000},
+		{Ports: "10250", Kind: "default", Packets: 1, Bytes: 100},
+	})
+
+	resp, err := http.Get("http://" + s.Address() + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(body)
+
+	for _, want := range []string{
+		`kube_restrict_ip_config_info{hash="new"} 1`,
+		`kube_restrict_ip_config_updates_total{result="applied"} 1`,
+		`kube_restrict_ip_config_updates_total{result="unchanged"} 2`,
+		`kube_restrict_ip_rule_packets_total{kind="allowed",network="10.0.0.0/8",ports="10250"} 35`,
+		`kube_restrict_ip_rule_bytes_total{kind="allowed",network="10.0.0.0/8",ports="10250"} 3500`,
+		`kube_restrict_ip_rule_packets_total{kind="default",network="",ports="10250"} 8`,
+		`kube_restrict_ip_stale_allowed_entry{entry="example.com"} 1`,
+		`kube_restrict_ip_startup_policy_info{policy="failClosed"} 1`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics have no '%s'", want)
+		}
+	}
+	if strings.Contains(got, `hash="old"`) {
+		t.Errorf("metrics have stale config hash")
+	}
+	if strings.Contains(got, `network="192.168.0.0/16"`) {
+		t.Errorf("metrics have removed rule counters")
+	}
+	if strings.Contains(got, `entry="192.168.0.0/16"`) {
+		t.Errorf("metrics have stale entry not stale anymore")
+	}
+	if strings.Contains(got, `policy="failOpen"`) {
+		t.Errorf("metrics have startup policy not in effect anymore")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONPath expression step: object member name, array index or wildcard
+type pathStep struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Parse JSONPath expression subset: root ($), dot-notation members (.name),
+// bracket-notation members (['name']), array indexes ([0]) and wildcards (.* or [*])
+func parsePath(path string) ([]pathStep, error) {
+	p := strings.TrimSpace(path)
+	if !strings.HasPrefix(p, "$") {
+		return nil, errors.New(fmt.Sprintf("invalid JSONPath %q: must start with '$'", path))
+	}
+	p = p[1:]
+
+	var steps []pathStep
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			name := p[:end]
+			if name == "" {
+				return nil, errors.New(fmt.Sprintf("invalid JSONPath %q: empty member name", path))
+			}
+			if name == "*" {
+				steps = append(steps, pathStep{wildcard: true})
+			} else {
+				steps = append(steps, pathStep{name: name})
+			}
+			p = p[end:]
+		case '[':
+			end := strings.Index(p, "]")
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid JSONPath %q: unclosed bracket", path))
+			}
+			sel := strings.TrimSpace(p[1:end])
+			p = p[end+1:]
+			if sel == "*" {
+				steps = append(steps, pathStep{wildcard: true})
+			} else if len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0] {
+				steps = append(steps, pathStep{name: sel[1 : len(sel)-1]})
+			} else if n, err := strconv.Atoi(sel); err == nil && n >= 0 {
+				steps = append(steps, pathStep{index: n, isIndex: true})
+			} else {
+				return nil, errors.New(fmt.Sprintf("invalid JSONPath %q: unsupported selector [%s]", path, sel))
+			}
+		default:
+			return nil, errors.New(fmt.Sprintf("invalid JSONPath %q: unexpected character %q", path, p[0]))
+		}
+	}
+	return steps, nil
+}
+
+// Select values from decoded JSON document by the path steps
+func selectPath(doc interface{}, steps []pathStep) []interface{} {
+	values := []interface{}{doc}
+	for _, s := range steps {
+		var next []interface{}
+		for _, v := range values {
+			switch t := v.(type) {
+			case map[string]interface{}:
+				if s.wildcard {
+					for _, e := range t {
+						next = append(next, e)
+					}
+				} else if e, ok := t[s.name]; ok && !s.isIndex {
+					next = append(next, e)
+				}
+			case []interface{}:
+				if s.wildcard {
+					next = append(next, t...)
+				} else if s.isIndex && s.index < len(t) {
+					next = append(next, t[s.index])
+				}
+			}
+		}
+		values = next
+	}
+	return values
+}
@@ -0,0 +1,71 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSelectPath(t *testing.T) {
+	doc := `{
+  "prefixes": [
+    {"ip_prefix": "10.1.0.0/16", "service": "A"},
+    {"ip_prefix": "10.2.0.0/16", "service": "B"}
+  ],
+  "egress": {"eu": ["10.3.0.1"], "us": ["10.4.0.1"]},
+  "dashed-key": "10.5.0.1"
+}`
+	tests := []struct {
+		name    string
+		path    string
+		want    []interface{}
+		wantErr bool
+	}{
+		{name: "wildcard array", path: "$.prefixes[*].ip_prefix",
+			want: []interface{}{"10.1.0.0/16", "10.2.0.0/16"}},
+		{name: "array index", path: "$.prefixes[1].ip_prefix", want: []interface{}{"10.2.0.0/16"}},
+		{name: "wildcard object", path: "$.egress.*[*]", want: []interface{}{"10.3.0.1", "10.4.0.1"}},
+		{name: "bracket member", path: "$['dashed-key']", want: []interface{}{"10.5.0.1"}},
+		{name: "missing member", path: "$.missing[*]", want: nil},
+		{name: "index out of range", path: "$.prefixes[5]", want: nil},
+		{name: "no root", path: "prefixes", wantErr: true},
+		{name: "unclosed bracket", path: "$.prefixes[*", wantErr: true},
+		{name: "unsupported selector", path: "$.prefixes[?(@.service)]", wantErr: true},
+		{name: "empty member", path: "$..prefixes", wantErr: true},
+	}
+	var d interface{}
+	if err := json.Unmarshal([]byte(doc), &d); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, err := parsePath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := selectPath(d, steps)
+			sort.Slice(got, func(i, j int) bool { return got[i].(string) < got[j].(string) })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/util"
+	"github.com/golang/glog"
+)
+
+const (
+	FormatText     = "text"
+	FormatJson     = "json"
+	FormatJsonPath = "jsonpath"
+
+	DefaultRefreshInterval = time.Hour
+
+	// Initial interval to retry failed source fetch, doubled on every failure up to the refresh interval
+	minRetryInterval = 30 * time.Second
+
+	fetchTimeout = 30 * time.Second
+	maxDataSize  = 16 << 20
+)
+
+// Source of allowed networks: HTTP(S) URL or local file
+type Source struct {
+	Url             string        `mapstructure:"url"`
+	File            string        `mapstructure:"file"`
+	Format          string        `mapstructure:"format"`
+	Path            string        `mapstructure:"path"`
+	RefreshInterval time.Duration `mapstructure:"refreshInterval"`
+}
+
+// Get source location (URL or file name)
+func (s Source) Location() string {
+	if s.Url != "" {
+		return s.Url
+	}
+	return s.File
+}
+
+func (s Source) format() string {
+	if s.Format == "" {
+		return FormatText
+	}
+	return s.Format
+}
+
+func (s Source) refreshInterval() time.Duration {
+	if s.RefreshInterval <= 0 {
+		return DefaultRefreshInterval
+	}
+	return s.RefreshInterval
+}
+
+// Validate source definition
+func (s Source) Validate() error {
+	if (s.Url == "") == (s.File == "") {
+		return errors.New("exactly one of 'url' or 'file' must be defined for allowed networks source")
+	}
+	if s.Url != "" && !strings.HasPrefix(s.Url, "http://") && !strings.HasPrefix(s.Url, "https://") {
+		return errors.New(fmt.Sprintf("unsupported allowed networks source URL: %s", s.Url))
+	}
+	switch s.format() {
+	case FormatText, FormatJson:
+		if s.Path != "" {
+			return errors.New(fmt.Sprintf("'path' can't be used with %s format (source %s)", s.format(), s.Location()))
+		}
+	case FormatJsonPath:
+		if _, err := parsePath(s.Path); err != nil {
+			return err
+		}
+	default:
+		return errors.New(fmt.Sprintf("unsupported allowed networks source format: %s", s.Format))
+	}
+	return nil
+}
+
+// Parse networks from the source data according to the source format.
+// Only IPv4 networks are returned, IPv6 ones are skipped.
+func (s Source) parse(data []byte) ([]string, error) {
+	var values []string
+
+	switch s.format() {
+	case FormatText:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			values = append(values, strings.Fields(line)...)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	case FormatJson:
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+	case FormatJsonPath:
+		steps, err := parsePath(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		for _, v := range selectPath(doc, steps) {
+			str, ok := v.(string)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("JSONPath %s selected non-string value: %v", s.Path, v))
+			}
+			values = append(values, str)
+		}
+	}
+
+	var nets []string
+	for _, v := range values {
+		n, err := util.ParseNetwork(v)
+		if err != nil {
+			return nil, err
+		}
+		if n.IP.To4() == nil {
+			glog.V(4).Infof("skipped IPv6 network %s from source %s", v, s.Location())
+			continue
+		}
+		nets = append(nets, v)
+	}
+	if len(nets) == 0 {
+		return nil, errors.New("no networks found")
+	}
+	sort.Strings(nets)
+
+	return nets, nil
+}
+
+type cacheEntry struct {
+	Networks []string  `json:"networks"`
+	Fetched  time.Time `json:"fetched"`
+	next     time.Time
+	source   Source
+	// Consecutive fetch failures and the last fetch error, if any
+	failures int
+	err      error
+}
+
+// Fetcher of allowed networks from sources, with last known good data caching
+type Fetcher struct {
+	sync.Mutex
+
+	client   *http.Client
+	cacheDir string
+	cache    map[string]*cacheEntry
+	now      func() time.Time
+}
+
+// Create sources fetcher, last known good data is persisted to cache directory, if not empty
+func NewFetcher(cacheDir string) *Fetcher {
+	return &Fetcher{
+		client:   &http.Client{Timeout: fetchTimeout},
+		cacheDir: cacheDir,
+		cache:    map[string]*cacheEntry{},
+		now:      time.Now,
+	}
+}
+
+// Get networks from the source. Cached networks are returned until source refresh interval
+// is elapsed. Last known good networks are returned if source can't be fetched.
+func (f *Fetcher) Networks(s Source) ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	key := s.Location()
+
+	e := f.cache[key]
+	if e == nil || e.source != s || !f.now().Before(e.next) {
+		e = f.refresh(s, e)
+	}
+	if len(e.Networks) == 0 {
+		return nil, errors.New(fmt.Sprintf("can't fetch allowed networks source %s: %v", key, e.err))
+	}
+
+	return e.Networks, nil
+}
+
+// Fetch networks from all sources due to refresh. Returns true if networks of any source are changed
+func (f *Fetcher) Refresh() bool {
+	f.Lock()
+	defer f.Unlock()
+
+	changed := false
+	now := f.now()
+	for _, e := range f.cache {
+		if now.Before(e.next) {
+			continue
+		}
+		if r := f.refresh(e.source, e); !reflect.DeepEqual(r.Networks, e.Networks) {
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Fetch networks from the source and update cache entry. On fetch error, last known good
+// networks are kept and the fetch is retried with backoff up to the source refresh interval
+func (f *Fetcher) refresh(s Source, e *cacheEntry) *cacheEntry {
+	key := s.Location()
+	now := f.now()
+
+	nets, err := f.fetch(s)
+	if err == nil {
+		glog.V(2).Infof("fetched %d networks from source %s", len(nets), key)
+		e = &cacheEntry{Networks: nets, Fetched: now, source: s}
+		f.saveCacheEntry(key, e)
+		e.next = now.Add(s.refreshInterval())
+		f.cache[key] = e
+		return e
+	}
+
+	r := &cacheEntry{source: s, err: err}
+	if e != nil {
+		r.Networks, r.Fetched, r.failures = e.Networks, e.Fetched, e.failures
+	} else if c := f.loadCacheEntry(key); c != nil {
+		r.Networks, r.Fetched = c.Networks, c.Fetched
+	}
+	r.failures++
+
+	retry := s.refreshInterval()
+	if d := minRetryInterval << uint(r.failures-1); r.failures <= 16 && d < retry {
+		retry = d
+	}
+	r.next = now.Add(retry)
+	f.cache[key] = r
+
+	if len(r.Networks) > 0 {
+		glog.Errorf("can't fetch allowed networks source %s, using data fetched at %v, retry in %v: %v",
+			key, r.Fetched, retry, err)
+	} else {
+		glog.Errorf("can't fetch allowed networks source %s, retry in %v: %v", key, retry, err)
+	}
+
+	return r
+}
+
+// Get time until the earliest refresh of fetched sources, false if no sources fetched
+func (f *Fetcher) NextRefresh() (time.Duration, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	var next time.Time
+	for _, e := range f.cache {
+		if next.IsZero() || e.next.Before(next) {
+			next = e.next
+		}
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+	if d := next.Sub(f.now()); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// Remove cached data for sources not in the list
+func (f *Fetcher) Retain(sources []Source) {
+	f.Lock()
+	defer f.Unlock()
+
+	keys := map[string]bool{}
+	for _, s := range sources {
+		keys[s.Location()] = true
+	}
+	for k := range f.cache {
+		if !keys[k] {
+			delete(f.cache, k)
+		}
+	}
+}
+
+func (f *Fetcher) fetch(s Source) ([]string, error) {
+	var data []byte
+	var err error
+
+	if s.Url != "" {
+		data, err = f.fetchUrl(s.Url)
+	} else {
+		data, err = ioutil.ReadFile(s.File)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.parse(data)
+}
+
+func (f *Fetcher) fetchUrl(url string) ([]byte, error) {
+	resp, err := f.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("unexpected HTTP status: %s", resp.Status))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDataSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxDataSize {
+		return nil, errors.New("data size limit exceeded")
+	}
+	return data, nil
+}
+
+func (f *Fetcher) cacheFileName(key string) string {
+	h := sha1.Sum([]byte(key))
+	return filepath.Join(f.cacheDir, "source-"+hex.EncodeToString(h[:])+".json")
+}
+
+func (f *Fetcher) saveCacheEntry(key string, e *cacheEntry) {
+	if f.cacheDir == "" {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err == nil {
+		err = util.WriteFileAtomic(f.cacheFileName(key), data, 0644)
+	}
+	if err != nil {
+		glog.Errorf("can't save cached allowed networks source %s: %v", key, err)
+	}
+}
+
+func (f *Fetcher) loadCacheEntry(key string) *cacheEntry {
+	if f.cacheDir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.cacheFileName(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Errorf("can't read cached allowed networks source %s: %v", key, err)
+		}
+		return nil
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(data, e); err != nil || len(e.Networks) == 0 {
+		glog.Errorf("invalid cached allowed networks source %s", key)
+		return nil
+	}
+	return e
+}
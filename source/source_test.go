@@ -0,0 +1,226 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSource_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  Source
+		wantErr bool
+	}{
+		{name: "url", source: Source{Url: "https://example.com/nets.txt"}, wantErr: false},
+		{name: "file", source: Source{File: "/etc/nets.json", Format: FormatJson}, wantErr: false},
+		{name: "jsonpath", source: Source{Url: "https://example.com/ip-ranges.json", Format: FormatJsonPath,
+			Path: "$.prefixes[*].ip_prefix"}, wantErr: false},
+		{name: "no location", source: Source{}, wantErr: true},
+		{name: "url and file", source: Source{Url: "https://example.com/nets.txt", File: "/etc/nets.txt"}, wantErr: true},
+		{name: "unsupported scheme", source: Source{Url: "ftp://example.com/nets.txt"}, wantErr: true},
+		{name: "unsupported format", source: Source{File: "/etc/nets.xml", Format: "xml"}, wantErr: true},
+		{name: "path for text", source: Source{File: "/etc/nets.txt", Path: "$.nets"}, wantErr: true},
+		{name: "invalid path", source: Source{File: "/etc/nets.json", Format: FormatJsonPath, Path: "nets"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.source.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Source.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSource_parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  Source
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "text", source: Source{},
+			data: "# VPN egress\n10.1.0.0/16\n\n192.168.1.1 # gateway\n10.2.0.0/16 10.3.0.0/16\n",
+			want: []string{"10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16", "192.168.1.1"}},
+		{name: "text invalid network", source: Source{}, data: "10.1.0.0/16\nfoo\n", wantErr: true},
+		{name: "text empty", source: Source{}, data: "# nothing here\n", wantErr: true},
+		{name: "json", source: Source{Format: FormatJson}, data: `["10.1.0.0/16", "fd00::/8"]`,
+			want: []string{"10.1.0.0/16"}},
+		{name: "json invalid", source: Source{Format: FormatJson}, data: `{"nets": []}`, wantErr: true},
+		{name: "jsonpath", source: Source{Format: FormatJsonPath, Path: "$.prefixes[*].ip_prefix"},
+			data: `{"prefixes": [{"ip_prefix": "10.2.0.0/16"}, {"ip_prefix": "10.1.0.0/16"}, {"ipv6_prefix": "fd00::/8"}]}`,
+			want: []string{"10.1.0.0/16", "10.2.0.0/16"}},
+		{name: "jsonpath non-string", source: Source{Format: FormatJsonPath, Path: "$.prefixes[*]"},
+			data: `{"prefixes": [{"ip_prefix": "10.2.0.0/16"}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.source.parse([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Source.parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Source.parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetcher_Networks(t *testing.T) {
+	data := "10.1.0.0/16\n"
+	status := http.StatusOK
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(data))
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFetcher(cacheDir)
+	f.now = func() time.Time { return now }
+
+	s := Source{Url: server.URL, RefreshInterval: time.Minute}
+
+	check := func(step string, want []string, wantRequests int) {
+		t.Helper()
+		got, err := f.Networks(s)
+		if err != nil {
+			t.Fatalf("%s: Fetcher.Networks() error = %v", step, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Fetcher.Networks() = %v, want %v", step, got, want)
+		}
+		if requests != wantRequests {
+			t.Errorf("%s: requests = %d, want %d", step, requests, wantRequests)
+		}
+	}
+
+	check("initial fetch", []string{"10.1.0.0/16"}, 1)
+
+	// Cached data is used until refresh interval is elapsed
+	data = "10.2.0.0/16\n"
+	check("cached", []string{"10.1.0.0/16"}, 1)
+	if d, ok := f.NextRefresh(); !ok || d != time.Minute {
+		t.Errorf("Fetcher.NextRefresh() = %v, %v, want %v, true", d, ok, time.Minute)
+	}
+
+	now = now.Add(time.Minute)
+	check("refreshed", []string{"10.2.0.0/16"}, 2)
+
+	// Last known good data is used on fetch errors
+	status = http.StatusInternalServerError
+	now = now.Add(time.Minute)
+	check("server error", []string{"10.2.0.0/16"}, 3)
+
+	// Last known good data is loaded from cache directory by new fetcher
+	f = NewFetcher(cacheDir)
+	f.now = func() time.Time { return now }
+	check("cache directory", []string{"10.2.0.0/16"}, 4)
+
+	// No last known good data available
+	f = NewFetcher("")
+	if _, err := f.Networks(s); err == nil {
+		t.Errorf("Fetcher.Networks() error = nil for failed fetch without cached data")
+	}
+}
+
+func TestFetcher_NetworksFromFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(`["10.1.0.0/16", "10.2.0.1"]`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	got, err := NewFetcher("").Networks(Source{File: file.Name(), Format: FormatJson})
+	if err != nil {
+		t.Fatalf("Fetcher.Networks() error = %v", err)
+	}
+	if want := []string{"10.1.0.0/16", "10.2.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fetcher.Networks() = %v, want %v", got, want)
+	}
+}
+
+func TestFetcher_Refresh(t *testing.T) {
+	data := "10.1.0.0/16\n"
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(data))
+	}))
+	defer server.Close()
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFetcher("")
+	f.now = func() time.Time { return now }
+
+	s := Source{Url: server.URL, RefreshInterval: 2 * time.Minute}
+
+	// Failed fetch without last known good data is retried with backoff
+	if _, err := f.Networks(s); err == nil {
+		t.Fatalf("Fetcher.Networks() error = nil for failed fetch")
+	}
+	for _, want := range []time.Duration{minRetryInterval, 2 * minRetryInterval, 4 * minRetryInterval, 2 * time.Minute} {
+		if d, ok := f.NextRefresh(); !ok || d != want {
+			t.Errorf("Fetcher.NextRefresh() = %v, %v, want %v, true", d, ok, want)
+		}
+		now = now.Add(want)
+		if f.Refresh() {
+			t.Errorf("Fetcher.Refresh() = true for failed fetch")
+		}
+	}
+
+	// Source is fetched: networks are changed
+	status = http.StatusOK
+	now = now.Add(2 * time.Minute)
+	if !f.Refresh() {
+		t.Errorf("Fetcher.Refresh() = false for fetched source")
+	}
+	if d, ok := f.NextRefresh(); !ok || d != 2*time.Minute {
+		t.Errorf("Fetcher.NextRefresh() = %v, %v, want %v, true", d, ok, 2*time.Minute)
+	}
+
+	// Source is not due to refresh
+	if f.Refresh() {
+		t.Errorf("Fetcher.Refresh() = true for not due source")
+	}
+
+	// Source is refreshed with the same data: networks are not changed
+	now = now.Add(2 * time.Minute)
+	if f.Refresh() {
+		t.Errorf("Fetcher.Refresh() = true for unchanged source data")
+	}
+	if got, err := f.Networks(s); err != nil || !reflect.DeepEqual(got, []string{"10.1.0.0/16"}) {
+		t.Errorf("Fetcher.Networks() = %v, %v, want [10.1.0.0/16]", got, err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3cky/kube-restrict-ip/util"
+)
+
+// Current state file format version
+const Version = 1
+
+// Last applied state, persisted to the host to survive restarts and upgrades
+type State struct {
+	Version         int       `json:"version"`
+	BuildVersion    string    `json:"buildVersion"`
+	AppliedAt       time.Time `json:"appliedAt"`
+	ChainName       string    `json:"chainName"`
+	RestrictedPorts []string  `json:"restrictedPorts"`
+	AllowedNetworks []string  `json:"allowedNetworks"`
+	DeniedNetworks  []string  `json:"deniedNetworks,omitempty"`
+	Action          string    `json:"action"`
+	RejectWith      string    `json:"rejectWith,omitempty"`
+	// Startup policy the applied config is created by due to invalid config file, if any
+	StartupPolicy string `json:"startupPolicy,omitempty"`
+	// SHA-256 hash of the applied iptables-restore data
+	PayloadHash string `json:"payloadHash"`
+	// SHA-256 hash of the applied rules, as read back from iptables
+	RulesHash string `json:"rulesHash"`
+	// Allowed networks config entries hits, by config entry
+	Hits map[string]*EntryHits `json:"hits,omitempty"`
+	// App instance ID, empty for default instance
+	Instance string `json:"instance,omitempty"`
+}
+
+// Allowed networks config entry hits tracking
+type EntryHits struct {
+	// The time the entry is tracked since
+	FirstSeen time.Time `json:"firstSeen"`
+	// The time of the last traffic matched by the entry rule, nil if none
+	LastHit *time.Time `json:"lastHit,omitempty"`
+	// The entry rule matches other entries as well (e.g. networks aggregated to the rule network),
+	// so the rule hits can't be attributed to the entry
+	Ambiguous bool `json:"ambiguous,omitempty"`
+}
+
+// Load state from the file, nil is returned if there is no state file
+func Load(fileName string) (*State, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid state file %s: %v", fileName, err))
+	}
+	if s.Version > Version {
+		return nil, errors.New(fmt.Sprintf("unsupported state file %s version: %d", fileName, s.Version))
+	}
+
+	return s, nil
+}
+
+// Save state to the file atomically, creating file directory if needed
+func (s *State) Save(fileName string) error {
+	s.Version = Version
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(fileName, data, 0644)
+}
+
+// Get SHA-256 hash of the data in hex form
+func Hash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// Get SHA-256 hash of the lines in hex form
+func HashLines(lines []string) string {
+	return Hash([]byte(strings.Join(lines, "\n")))
+}
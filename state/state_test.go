@@ -0,0 +1,71 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestState_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "state", "state.json")
+
+	if s, err := Load(fileName); s != nil || err != nil {
+		t.Fatalf("Load() = %v, %v for missing file", s, err)
+	}
+
+	lastHit := time.Date(2019, 1, 7, 9, 0, 0, 0, time.UTC)
+	s := &State{
+		AppliedAt:       time.Date(2019, 1, 7, 10, 0, 0, 0, time.UTC),
+		ChainName:       "KUBE-RESTRICT-IP",
+		RestrictedPorts: []string{"9100", "10254"},
+		AllowedNetworks: []string{"10.0.0.0/8"},
+		Action:          "REJECT",
+		RejectWith:      "tcp-reset",
+		PayloadHash:     Hash([]byte("payload")),
+		RulesHash:       HashLines([]string{"-A KUBE-RESTRICT-IP -j DROP"}),
+		Hits: map[string]*EntryHits{
+			"10.0.0.0/8": {FirstSeen: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), LastHit: &lastHit},
+		},
+		Instance: "team-a",
+	}
+	if err := s.Save(fileName); err != nil {
+		t.Fatalf("State.Save() error = %v", err)
+	}
+
+	got, err := Load(fileName)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("Load() = %v, want %v", got, s)
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte(`{"version": 100}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(fileName); err == nil {
+		t.Errorf("Load() error = nil for unsupported version")
+	}
+}
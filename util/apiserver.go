@@ -0,0 +1,92 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// In-cluster Pod service account directory with API access token and API server CA certificate
+const ServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+const apiServerEndpointsPath = "/api/v1/namespaces/default/endpoints/kubernetes"
+
+const apiServerTimeout = 10 * time.Second
+
+// Endpoints object parts needed to get endpoint addresses
+type endpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+	} `json:"subsets"`
+}
+
+// Get API server endpoint addresses ('kubernetes' service endpoints in 'default' namespace), i.e. the
+// addresses API server actually runs on, unlike the service address. API server is accessed at the
+// address (host:port) with the token and CA certificate of the service account directory
+func APIServerEndpoints(address, serviceAccountDir string) ([]string, error) {
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	certs := x509.NewCertPool()
+	if !certs.AppendCertsFromPEM(ca) {
+		return nil, errors.New(fmt.Sprintf("no certificates found in %s", filepath.Join(serviceAccountDir, "ca.crt")))
+	}
+
+	client := &http.Client{
+		Timeout:   apiServerTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certs}},
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+address+apiServerEndpointsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("can't get API server endpoints: %s", resp.Status))
+	}
+
+	var e endpoints
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid API server endpoints: %v", err))
+	}
+	var addrs []string
+	for _, s := range e.Subsets {
+		for _, a := range s.Addresses {
+			addrs = append(addrs, a.IP)
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,81 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAPIServerEndpoints(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != apiServerEndpointsPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"kind":"Endpoints","subsets":[{"addresses":[{"ip":"192.0.2.10"},{"ip":"192.0.2.11"}],` +
+			`"ports":[{"port":6443}]}]}`))
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "https://")
+
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	type args struct {
+		token string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []string
+		wantErr bool
+	}{
+		{name: "endpoints", args: args{token: "test-token\n"}, want: []string{"192.0.2.10", "192.0.2.11"}},
+		{name: "unauthorized", args: args{token: "other-token"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte(tt.args.token), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := APIServerEndpoints(address, dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("APIServerEndpoints() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("APIServerEndpoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+// Line diff operations
+const (
+	DiffEqual  = " "
+	DiffDelete = "-"
+	DiffInsert = "+"
+)
+
+// Line of the diff between two slices of lines
+type DiffLine struct {
+	Op   string
+	Line string
+}
+
+func (l DiffLine) String() string {
+	return l.Op + " " + l.Line
+}
+
+// Get line diff between old and new slices of lines, based on their longest common subsequence
+func DiffLines(old, new []string) []DiffLine {
+	// lcs[i][j] is the length of the longest common subsequence of old[i:] and new[j:]
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []DiffLine
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		switch {
+		case old[i] == new[j]:
+			diff = append(diff, DiffLine{Op: DiffEqual, Line: old[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{Op: DiffDelete, Line: old[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{Op: DiffInsert, Line: new[j]})
+			j++
+		}
+	}
+	for ; i < len(old); i++ {
+		diff = append(diff, DiffLine{Op: DiffDelete, Line: old[i]})
+	}
+	for ; j < len(new); j++ {
+		diff = append(diff, DiffLine{Op: DiffInsert, Line: new[j]})
+	}
+
+	return diff
+}
+
+// Checks line diff has any changes
+func HasChanges(diff []DiffLine) bool {
+	for _, l := range diff {
+		if l.Op != DiffEqual {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	type args struct {
+		old []string
+		new []string
+	}
+	tests := []struct {
+		name        string
+		args        args
+		want        []string
+		wantChanges bool
+	}{
+		{name: "empty", args: args{}},
+		{
+			name: "equal",
+			args: args{old: []string{"a", "b"}, new: []string{"a", "b"}},
+			want: []string{"  a", "  b"},
+		},
+		{
+			name:        "added",
+			args:        args{new: []string{"a"}},
+			want:        []string{"+ a"},
+			wantChanges: true,
+		},
+		{
+			name:        "deleted",
+			args:        args{old: []string{"a"}},
+			want:        []string{"- a"},
+			wantChanges: true,
+		},
+		{
+			name:        "changed",
+			args:        args{old: []string{"a", "b", "c", "d"}, new: []string{"a", "x", "c", "d", "e"}},
+			want:        []string{"  a", "- b", "+ x", "  c", "  d", "+ e"},
+			wantChanges: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := DiffLines(tt.args.old, tt.args.new)
+			var got []string
+			for _, l := range diff {
+				got = append(got, l.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffLines() = %q, want %q", got, tt.want)
+			}
+			if changes := HasChanges(diff); changes != tt.wantChanges {
+				t.Errorf("HasChanges() = %v, want %v", changes, tt.wantChanges)
+			}
+		})
+	}
+}
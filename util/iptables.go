@@ -15,9 +15,9 @@
 package util
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"net"
 	"regexp"
 	"strconv"
 	"strings"
@@ -26,34 +26,185 @@ import (
 const (
 	restrictedPortsInputRuleId = "kube-restrict-ip"
 
-	restrictedPortsInputRuleRegexTemplate = "^-A INPUT -p tcp -m multiport --dports ([0-9,]+) -m comment --comment \"?" +
-		restrictedPortsInputRuleId + "\"? -j %s$"
+	// Protocol of restricted ports traffic redirected to network rules chain
+	RestrictedPortsProtocol = "tcp"
+
+	RejectTargetDrop   = "DROP"
+	RejectTargetReject = "REJECT"
+
+	defaultRejectWith = "icmp-port-unreachable"
+
+	// INPUT rule redirecting restricted ports to network rules chain is identified by the comment,
+	// regardless of the other matches order
+	restrictedPortsInputRuleRegex = "^-A INPUT (?:.* )?-m comment --comment \"?" +
+		restrictedPortsInputRuleId + "(?::([A-Za-z0-9_.-]+))?\"?(?: .*)? -j (\\S+)$"
+
+	restrictedPortsRegex = "(?:^| )--(?:dports|dport|destination-ports?) ([0-9,:]+)(?: |$)"
+
+	rejectActionRuleRegexTemplate = "^-A %s (?:-p \\S+ )?-j (\\S+)(?: --reject-with (\\S+))?$"
+
+	networkRuleRegexTemplate = "^-A %s -s (\\S+) (?:-p \\S+ )?-j (\\S+)(?: --reject-with (\\S+))?$"
+
+	ruleCountersRegex = "^\\[([0-9]+):([0-9]+)\\] (.*)$"
 )
 
+// Default reject types for REJECT target without explicitly defined reject type, by protocol
+var protocolRejectWith = map[string]string{
+	"tcp": "tcp-reset",
+	"udp": "icmp-port-unreachable",
+}
+
+// Valid reject types for REJECT target
+var rejectWithTypes = ToSet([]string{
+	"icmp-net-unreachable",
+	"icmp-host-unreachable",
+	"icmp-port-unreachable",
+	"icmp-proto-unreachable",
+	"icmp-net-prohibited",
+	"icmp-host-prohibited",
+	"icmp-admin-prohibited",
+	"tcp-reset",
+})
+
+var chainTargetRegex = regexp.MustCompile("^[A-Za-z0-9_.-]{1,28}$")
+
+var restrictedPortsInputRuleRe = regexp.MustCompile(restrictedPortsInputRuleRegex)
+
+var restrictedPortsRe = regexp.MustCompile(restrictedPortsRegex)
+
+// Suffix of the chain new rules are built in before replacing the running chain
+const stagingChainSuffix = "-NEW"
+
+// Maximum chain name length, leaving room for the staging chain suffix
+var maxChainNameLength = 28 - len(stagingChainSuffix)
+
+var instanceRegex = regexp.MustCompile("^[A-Za-z0-9_.-]{1,16}$")
+
+// Rule with its packet and byte counters, as saved by iptables-save with counters
+type RuleCounters struct {
+	// Source network, empty for the rules without source match
+	Network string
+	Target  string
+	Packets uint64
+	Bytes   uint64
+}
+
+// Action applied to restricted ports traffic from not allowed networks
+type RejectAction struct {
+	Target     string
+	RejectWith string
+}
+
+// Create reject action for given target and reject type, filling in defaults.
+// Empty target means REJECT with 'icmp-port-unreachable' reject type,
+// REJECT target without reject type uses the default one for given protocol.
+func NewRejectAction(target, rejectWith, protocol string) RejectAction {
+	target = strings.TrimSpace(target)
+	rejectWith = strings.TrimSpace(rejectWith)
+
+	switch {
+	case target == "":
+		target = RejectTargetReject
+		if rejectWith == "" {
+			rejectWith = defaultRejectWith
+		}
+	case strings.EqualFold(target, RejectTargetDrop):
+		target = RejectTargetDrop
+	case strings.EqualFold(target, RejectTargetReject):
+		target = RejectTargetReject
+		if rejectWith == "" {
+			if rejectWith = protocolRejectWith[protocol]; rejectWith == "" {
+				rejectWith = defaultRejectWith
+			}
+		}
+	}
+
+	return RejectAction{Target: target, RejectWith: rejectWith}
+}
+
+// Get rule arguments for jumping to the action target
+func (a RejectAction) RuleArgs() []string {
+	if a.Target == "" {
+		a = NewRejectAction("", a.RejectWith, RestrictedPortsProtocol)
+	}
+
+	if a.Target != RejectTargetReject {
+		return []string{"-j", a.Target}
+	}
+
+	var args []string
+	if a.RejectWith == "tcp-reset" {
+		// tcp-reset reject type is valid for TCP protocol rules only
+		args = append(args, "-p", "tcp")
+	}
+	return append(args, "-j", a.Target, "--reject-with", a.RejectWith)
+}
+
+func (a RejectAction) String() string {
+	if a.RejectWith == "" {
+		return a.Target
+	}
+	return a.Target + " (" + a.RejectWith + ")"
+}
+
 func CreateEmptyChainRule(chainName string) string {
 	return fmt.Sprintf(":%s - [0:0]", chainName)
 }
 
-func CreateRestrictedPortsAddRule(chain string, ports []string) string {
-	return JoinWords("-I", "INPUT", "1", CreateRestrictedPortsMatchRule(chain, ports))
+func CreateDeleteChainRule(chain string) string {
+	return JoinWords("-X", chain)
+}
+
+func CreateRenameChainRule(chain, newName string) string {
+	return JoinWords("-E", chain, newName)
+}
+
+// Get name of the chain new rules are built in before replacing the running chain
+func StagingChainName(chain string) string {
+	return chain + stagingChainSuffix
 }
 
-func CreateRestrictedPortsDeleteRule(chain string, ports []string) string {
-	return JoinWords("-D", "INPUT", CreateRestrictedPortsMatchRule(chain, ports))
+// Get name of the chain with app instance ID embedded, chain name is not changed for default instance
+func InstanceChainName(chain, instance string) string {
+	if instance == "" {
+		return chain
+	}
+	return chain + "-" + instance
+}
+
+func CreateRestrictedPortsAddRule(instance, chain string, ports []string) string {
+	return JoinWords("-I", "INPUT", "1", CreateRestrictedPortsMatchRule(instance, chain, ports))
 }
 
-func CreateRestrictedPortsMatchRule(chain string, ports []string) string {
+// Create rule deleting the rule in iptables-save format by exact match
+func CreateDeleteRule(rule string) string {
+	return "-D" + strings.TrimPrefix(rule, "-A")
+}
+
+func CreateRestrictedPortsMatchRule(instance, chain string, ports []string) string {
 	p := strings.Join(ports, ",")
 	return JoinWords("-p", "tcp", "-m", "multiport", "--dports", p,
-		"-m", "comment", "--comment", "\""+restrictedPortsInputRuleId+"\"", "-j", chain)
+		"-m", "comment", "--comment", "\""+restrictedPortsRuleComment(instance)+"\"", "-j", chain)
+}
+
+// Get comment identifying INPUT rule redirecting restricted ports of app instance
+func restrictedPortsRuleComment(instance string) string {
+	if instance == "" {
+		return restrictedPortsInputRuleId
+	}
+	return restrictedPortsInputRuleId + ":" + instance
 }
 
 func CreateAllowedNetworkChainRule(chain string, net string) string {
 	return JoinWords("-A", chain, "-s", net, "-j", "RETURN")
 }
 
-func CreateDefaultNetworkChainRule(chain string) string {
-	return JoinWords("-A", chain, "-j", "REJECT", "--reject-with", "icmp-port-unreachable")
+func CreateDeniedNetworkChainRule(chain string, net string, action RejectAction) string {
+	return JoinWords(append([]string{"-A", chain, "-s", net}, action.RuleArgs()...)...)
+}
+
+func CreateDefaultNetworkChainRule(chain string, action RejectAction) string {
+	return JoinWords(append([]string{"-A", chain}, action.RuleArgs()...)...)
 }
 
 // Validate slice of IP port numbers in string form
@@ -66,29 +217,320 @@ func ValidatePorts(ports []string) error {
 	return nil
 }
 
+// Validate app instance ID for the network rules chain name
+func ValidateInstance(chain, instance string) error {
+	if instance == "" {
+		return nil
+	}
+	if !instanceRegex.MatchString(instance) {
+		return errors.New(fmt.Sprintf("invalid instance ID: %s (must be up to 16 letters, digits, '_', '.' or '-')",
+			instance))
+	}
+	// Instance chain must not be the staging chain of other instance, e.g. chain-a-NEW of instance a
+	if strings.HasSuffix("-"+instance, stagingChainSuffix) {
+		return errors.New(fmt.Sprintf("invalid instance ID: %s (must not end with '%s' reserved for staging chains)",
+			instance, stagingChainSuffix))
+	}
+	if n := len(InstanceChainName(chain, instance)); n > maxChainNameLength {
+		return errors.New(fmt.Sprintf("instance ID %s is too long for chain %s: instance chain name %s is %d characters "+
+			"(must be up to %d)", instance, chain, InstanceChainName(chain, instance), n, maxChainNameLength))
+	}
+	return nil
+}
+
+// Validate network rules chain name
+func ValidateChainName(chain string) error {
+	if !chainTargetRegex.MatchString(chain) || len(chain) > maxChainNameLength {
+		return errors.New(fmt.Sprintf("invalid chain name: %s (must be up to %d letters, digits, '_', '.' or '-')",
+			chain, maxChainNameLength))
+	}
+	// Chain must not be the staging chain of other chain, e.g. CHAIN-NEW of CHAIN
+	if strings.HasSuffix(chain, stagingChainSuffix) {
+		return errors.New(fmt.Sprintf("invalid chain name: %s (must not end with '%s' reserved for staging chains)",
+			chain, stagingChainSuffix))
+	}
+	return nil
+}
+
 // Validate slice of IP networks (addresses or CIDRs)
 func ValidateNetworks(nets []string) error {
 	for _, n := range nets {
-		if _, _, err := net.ParseCIDR(n); err != nil && net.ParseIP(n) == nil {
-			return errors.New(fmt.Sprintf("invalid network: %s", n))
+		if _, err := ParseNetwork(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate slice of IPv4 networks (addresses or CIDRs), the rules are created for IPv4 only
+func ValidateIPv4Networks(nets []string) error {
+	for _, n := range nets {
+		ipNet, err := ParseNetwork(n)
+		if err != nil {
+			return err
+		}
+		if ipNet.IP.To4() == nil {
+			return errors.New(fmt.Sprintf("unsupported IPv6 network: %s", n))
+		}
+	}
+	return nil
+}
+
+// Targets letting the traffic through, so can't be used as reject action
+var acceptTargets = []string{"ACCEPT", "RETURN"}
+
+// Validate reject action target for network rules chain: it must not let the traffic through
+// or jump to the chain itself (or its staging chain)
+func ValidateRejectTarget(target, chain string) error {
+	if !chainTargetRegex.MatchString(target) {
+		return errors.New(fmt.Sprintf("invalid action target: %s", target))
+	}
+	for _, t := range acceptTargets {
+		if strings.EqualFold(target, t) {
+			return errors.New(fmt.Sprintf("invalid action target: %s (would let not allowed networks through)",
+				target))
+		}
+	}
+	if target == chain || target == StagingChainName(chain) {
+		return errors.New(fmt.Sprintf("invalid action target: %s (can't be the network rules chain)", target))
+	}
+	return nil
+}
+
+// Validate reject action for network rules chain
+func ValidateRejectAction(a RejectAction, chain string) error {
+	if err := ValidateRejectTarget(a.Target, chain); err != nil {
+		return err
+	}
+	if a.Target != RejectTargetReject {
+		if a.RejectWith != "" {
+			return errors.New(fmt.Sprintf("reject type can't be used with action target %s", a.Target))
+		}
+		return nil
+	}
+	if !rejectWithTypes[a.RejectWith] {
+		return errors.New(fmt.Sprintf("invalid reject type: %s", a.RejectWith))
+	}
+	return nil
+}
+
+// Validate slice of allowed networks (addresses, CIDRs or host names)
+func ValidateAllowedNetworks(nets []string) error {
+	for _, n := range nets {
+		if IsHostname(n) {
+			continue
+		}
+		if _, err := ParseNetwork(n); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 func GetRestrictedPortsFromTablesData(data []byte, chain string) []string {
+	for _, line := range strings.Split(string(data), "\n") {
+		if _, c, ports := parseRestrictedPortsRule(line); c == chain {
+			return ports
+		}
+	}
+
+	return nil
+}
+
+// Get INPUT rules redirecting restricted ports to network rules chain, in iptables-save format
+func GetRestrictedPortsRulesFromTablesData(data []byte, chain string) []string {
+	var rules []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if _, c, _ := parseRestrictedPortsRule(line); c == chain {
+			rules = append(rules, line)
+		}
+	}
+
+	return rules
+}
+
+// Parse INPUT rule redirecting restricted ports to network rules chain, identified by the rule comment
+// with app instance ID embedded. Returns empty chain name if the rule is not matched
+func parseRestrictedPortsRule(rule string) (instance, chain string, ports []string) {
+	m := restrictedPortsInputRuleRe.FindStringSubmatch(strings.TrimSpace(rule))
+	if m == nil {
+		return "", "", nil
+	}
+	if p := restrictedPortsRe.FindStringSubmatch(rule); p != nil {
+		ports = strings.Split(p[1], ",")
+	}
+	return m[1], m[2], ports
+}
+
+// Get reject action from default (last) rule of network rules chain
+func GetRejectActionFromTablesData(data []byte, chain string) *RejectAction {
 	if data == nil || len(data) == 0 {
 		return nil
 	}
 
-	lines := string(data)
-	re := regexp.MustCompile(fmt.Sprintf(restrictedPortsInputRuleRegexTemplate, chain))
-	for _, line := range strings.Split(lines, "\n") {
-		m := re.FindStringSubmatch(line)
-		if m != nil {
-			return strings.Split(m[1], ",")
+	var action *RejectAction
+
+	re := regexp.MustCompile(fmt.Sprintf(rejectActionRuleRegexTemplate, regexp.QuoteMeta(chain)))
+	for _, line := range strings.Split(string(data), "\n") {
+		m := re.FindStringSubmatch(strings.TrimSpace(line))
+		if m != nil && m[1] != "RETURN" {
+			action = &RejectAction{Target: m[1], RejectWith: m[2]}
 		}
 	}
 
-	return nil
+	return action
+}
+
+// Get restricted ports of app instance INPUT rules redirecting to network rules chains, by chain name
+func GetRestrictedPortsChainsFromTablesData(data []byte, instance string) map[string][]string {
+	chains := map[string][]string{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if i, c, ports := parseRestrictedPortsRule(line); c != "" && i == instance {
+			chains[c] = ports
+		}
+	}
+
+	return chains
+}
+
+// Get app instance IDs of INPUT rules redirecting restricted ports to network rules chains
+// for all instances except the given one, by restricted port
+func GetOtherInstancesPortsFromTablesData(data []byte, instance string) map[string]string {
+	instances := map[string]string{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if i, c, ports := parseRestrictedPortsRule(line); c != "" && i != instance {
+			for _, p := range ports {
+				instances[p] = i
+			}
+		}
+	}
+
+	return instances
+}
+
+// Get rules of network rules chain and INPUT rules redirecting restricted ports to it
+func GetChainRulesFromTablesData(data []byte, chain string) []string {
+	var rules []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if _, c, _ := parseRestrictedPortsRule(line); c == chain || strings.HasPrefix(line, "-A "+chain+" ") {
+			rules = append(rules, line)
+		}
+	}
+
+	return rules
+}
+
+// Checks network rules chain exists
+func HasChain(data []byte, chain string) bool {
+	prefix := ":" + chain + " "
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get allowed and denied networks of network rules chain, in the chain rules order
+func GetNetworksFromTablesData(data []byte, chain string) (allowed, denied []string) {
+	re := regexp.MustCompile(fmt.Sprintf(networkRuleRegexTemplate, regexp.QuoteMeta(chain)))
+	for _, line := range strings.Split(string(data), "\n") {
+		m := re.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		if m[2] == "RETURN" {
+			allowed = append(allowed, m[1])
+		} else {
+			denied = append(denied, m[1])
+		}
+	}
+	return allowed, denied
+}
+
+// Convert rule created by the app to the form it's printed by iptables-save: INPUT rule
+// is appended, comment is not quoted and single addresses have explicit /32 mask
+func NormalizeRule(rule string) string {
+	words := strings.Fields(rule)
+	if len(words) > 2 && words[0] == "-I" && words[2] == "1" {
+		words = append([]string{"-A", words[1]}, words[3:]...)
+	}
+	for i, w := range words {
+		if i > 0 && words[i-1] == "-s" && !strings.Contains(w, "/") {
+			words[i] = w + "/32"
+		}
+		words[i] = strings.Trim(words[i], "\"")
+	}
+	return JoinWords(words...)
+}
+
+// Get network rules chain rules with their counters, in the chain rules order,
+// from iptables-save data with counters
+func GetChainRuleCountersFromTablesData(data []byte, chain string) []RuleCounters {
+	var rules []RuleCounters
+
+	networkRe := regexp.MustCompile(fmt.Sprintf(networkRuleRegexTemplate, regexp.QuoteMeta(chain)))
+	defaultRe := regexp.MustCompile(fmt.Sprintf(rejectActionRuleRegexTemplate, regexp.QuoteMeta(chain)))
+	forEachRuleCounters(data, func(rule string, packets, bytes uint64) {
+		if m := networkRe.FindStringSubmatch(rule); m != nil {
+			rules = append(rules, RuleCounters{Network: m[1], Target: m[2], Packets: packets, Bytes: bytes})
+		} else if m := defaultRe.FindStringSubmatch(rule); m != nil {
+			rules = append(rules, RuleCounters{Target: m[1], Packets: packets, Bytes: bytes})
+		}
+	})
+
+	return rules
+}
+
+// Get counters of INPUT rule redirecting restricted ports to network rules chain
+// from iptables-save data with counters, nil if rule not found
+func GetRestrictedPortsCountersFromTablesData(data []byte, chain string) *RuleCounters {
+	var counters *RuleCounters
+
+	forEachRuleCounters(data, func(rule string, packets, bytes uint64) {
+		if _, c, _ := parseRestrictedPortsRule(rule); counters == nil && c == chain {
+			counters = &RuleCounters{Target: chain, Packets: packets, Bytes: bytes}
+		}
+	})
+
+	return counters
+}
+
+// Remove rules counters from iptables-save data with counters
+func RemoveCountersFromTablesData(data []byte) []byte {
+	lines := bytes.NewBuffer(nil)
+	re := regexp.MustCompile(ruleCountersRegex)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if m := re.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			line = m[3]
+		}
+		WriteLine(lines, line)
+	}
+	return lines.Bytes()
+}
+
+// Call function for every rule with counters in iptables-save data with counters
+func forEachRuleCounters(data []byte, f func(rule string, packets, bytes uint64)) {
+	re := regexp.MustCompile(ruleCountersRegex)
+	for _, line := range strings.Split(string(data), "\n") {
+		m := re.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		packets, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		bytes, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		f(m[3], packets, bytes)
+	}
 }
@@ -42,6 +42,54 @@ func TestValidatePorts(t *testing.T) {
 	}
 }
 
+func TestValidateChainName(t *testing.T) {
+	tests := []struct {
+		name    string
+		chain   string
+		wantErr bool
+	}{
+		{name: "default", chain: "KUBE-RESTRICT-IP", wantErr: false},
+		{name: "max length", chain: "KUBE-RESTRICT-IP-1234567", wantErr: false},
+		{name: "too long", chain: "KUBE-RESTRICT-IP-12345678", wantErr: true},
+		{name: "empty", chain: "", wantErr: true},
+		{name: "invalid chars", chain: "KUBE RESTRICT IP", wantErr: true},
+		{name: "staging suffix", chain: "KUBE-RESTRICT-IP-NEW", wantErr: true},
+		{name: "staging suffix part", chain: "KUBE-RESTRICT-IP-NEWS", wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateChainName(tt.chain); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateChainName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateInstance(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance string
+		wantErr  bool
+	}{
+		{name: "default", instance: "", wantErr: false},
+		{name: "valid", instance: "team-a", wantErr: false},
+		{name: "max length", instance: "1234567", wantErr: false},
+		{name: "chain too long", instance: "12345678", wantErr: true},
+		{name: "too long", instance: "team-a-1234567890", wantErr: true},
+		{name: "invalid chars", instance: "team:a", wantErr: true},
+		{name: "staging chain", instance: "NEW", wantErr: true},
+		{name: "other instance staging chain", instance: "a-NEW", wantErr: true},
+		{name: "staging suffix part", instance: "a-NEWS", wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateInstance("KUBE-RESTRICT-IP", tt.instance); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateInstance() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestValidateNetworks(t *testing.T) {
 	type args struct {
 		nets []string
@@ -68,6 +116,47 @@ func TestValidateNetworks(t *testing.T) {
 	}
 }
 
+func TestValidateIPv4Networks(t *testing.T) {
+	tests := []struct {
+		name    string
+		nets    []string
+		wantErr bool
+	}{
+		{name: "address", nets: []string{"192.168.1.1"}, wantErr: false},
+		{name: "cidr", nets: []string{"192.168.1.0/24"}, wantErr: false},
+		{name: "ipv6 address", nets: []string{"2001:db8::1"}, wantErr: true},
+		{name: "ipv6 cidr", nets: []string{"192.168.1.0/24", "2001:db8::/32"}, wantErr: true},
+		{name: "invalid", nets: []string{"192.168.1.260"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateIPv4Networks(tt.nets); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateIPv4Networks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateAllowedNetworks(t *testing.T) {
+	tests := []struct {
+		name    string
+		nets    []string
+		wantErr bool
+	}{
+		{name: "cidr", nets: []string{"192.168.1.0/24"}, wantErr: false},
+		{name: "host name", nets: []string{"bastion.example.com"}, wantErr: false},
+		{name: "invalid host name", nets: []string{"bastion_1.example.com"}, wantErr: true},
+		{name: "octet out of range", nets: []string{"192.168.1.260"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateAllowedNetworks(tt.nets); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateAllowedNetworks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestGetRestrictedPortsFromTablesData(t *testing.T) {
 	type args struct {
 		data  []byte
@@ -92,6 +181,12 @@ func TestGetRestrictedPortsFromTablesData(t *testing.T) {
 			want: []string{"80", "8080"}},
 		{name: "not matched chain name", args: args{data: []byte("-A INPUT -p tcp -m multiport --dports 80,8080 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP-1"), chain: "KUBE-RESTRICT-IP"},
 			want: nil},
+		{name: "reordered matches", args: args{data: []byte("-A INPUT -p tcp -m comment --comment \"kube-restrict-ip\" -m multiport --dports 8080,80 -j KUBE-RESTRICT-IP"), chain: "KUBE-RESTRICT-IP"},
+			want: []string{"8080", "80"}},
+		{name: "other comment", args: args{data: []byte("-A INPUT -p tcp -m multiport --dports 80 -m comment --comment kube-restrict-ip-1 -j KUBE-RESTRICT-IP"), chain: "KUBE-RESTRICT-IP"},
+			want: nil},
+		{name: "instance", args: args{data: []byte("-A INPUT -p tcp -m multiport --dports 80 -m comment --comment kube-restrict-ip:team-a -j KUBE-RESTRICT-IP-team-a"), chain: "KUBE-RESTRICT-IP-team-a"},
+			want: []string{"80"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -101,3 +196,291 @@ func TestGetRestrictedPortsFromTablesData(t *testing.T) {
 		})
 	}
 }
+
+func TestGetRestrictedPortsRulesFromTablesData(t *testing.T) {
+	data := []byte(`:INPUT ACCEPT [0:0]
+:KUBE-RESTRICT-IP - [0:0]
+-A INPUT -p tcp -m multiport --dports 80,8080 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP
+-A INPUT -p tcp -m comment --comment "kube-restrict-ip" -m multiport --dports 8080,80 -j KUBE-RESTRICT-IP
+-A INPUT -p tcp -m multiport --dports 443 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP-1
+-A INPUT -p tcp -m multiport --dports 80 -j KUBE-RESTRICT-IP
+-A KUBE-RESTRICT-IP -j REJECT --reject-with icmp-port-unreachable
+`)
+	type args struct {
+		data  []byte
+		chain string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
+	}{
+		{name: "nil", args: args{data: nil, chain: "KUBE-RESTRICT-IP"}, want: nil},
+		{name: "edited rules", args: args{data: data, chain: "KUBE-RESTRICT-IP"},
+			want: []string{
+				"-A INPUT -p tcp -m multiport --dports 80,8080 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP",
+				"-A INPUT -p tcp -m comment --comment \"kube-restrict-ip\" -m multiport --dports 8080,80 -j KUBE-RESTRICT-IP",
+			}},
+		{name: "other chain", args: args{data: data, chain: "KUBE-RESTRICT-IP-1"},
+			want: []string{"-A INPUT -p tcp -m multiport --dports 443 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP-1"}},
+		{name: "no rules", args: args{data: data, chain: "KUBE-RESTRICT-IP-2"}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetRestrictedPortsRulesFromTablesData(tt.args.data, tt.args.chain); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetRestrictedPortsRulesFromTablesData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRestrictedPortsChainsFromTablesData(t *testing.T) {
+	data := []byte(`-A INPUT -p tcp -m multiport --dports 80,8080 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP
+-A INPUT -p tcp -m multiport --dports 443 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP-OLD
+-A INPUT -p tcp -m multiport --dports 9100 -m comment --comment kube-restrict-ip:team-a -j KUBE-RESTRICT-IP-team-a
+`)
+	type args struct {
+		data     []byte
+		instance string
+	}
+	tests := []struct {
+		name string
+		args args
+		want map[string][]string
+	}{
+		{name: "default instance", args: args{data: data, instance: ""},
+			want: map[string][]string{"KUBE-RESTRICT-IP": {"80", "8080"}, "KUBE-RESTRICT-IP-OLD": {"443"}}},
+		{name: "instance", args: args{data: data, instance: "team-a"},
+			want: map[string][]string{"KUBE-RESTRICT-IP-team-a": {"9100"}}},
+		{name: "no rules", args: args{data: data, instance: "team-b"}, want: map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetRestrictedPortsChainsFromTablesData(tt.args.data, tt.args.instance); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetRestrictedPortsChainsFromTablesData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOtherInstancesPortsFromTablesData(t *testing.T) {
+	data := []byte(`-A INPUT -p tcp -m multiport --dports 80,8080 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP
+-A INPUT -p tcp -m multiport --dports 9100 -m comment --comment "kube-restrict-ip:team-a" -j KUBE-RESTRICT-IP-team-a
+`)
+	type args struct {
+		data     []byte
+		instance string
+	}
+	tests := []struct {
+		name string
+		args args
+		want map[string]string
+	}{
+		{name: "default instance", args: args{data: data, instance: ""}, want: map[string]string{"9100": "team-a"}},
+		{name: "instance", args: args{data: data, instance: "team-a"}, want: map[string]string{"80": "", "8080": ""}},
+		{name: "other instance", args: args{data: data, instance: "team-b"},
+			want: map[string]string{"80": "", "8080": "", "9100": "team-a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetOtherInstancesPortsFromTablesData(tt.args.data, tt.args.instance); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetOtherInstancesPortsFromTablesData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateDeleteRule(t *testing.T) {
+	rule := "-A INPUT -p tcp -m multiport --dports 80 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP"
+	want := "-D INPUT -p tcp -m multiport --dports 80 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP"
+	if got := CreateDeleteRule(rule); got != want {
+		t.Errorf("CreateDeleteRule() = %v, want %v", got, want)
+	}
+}
+
+func TestNewRejectAction(t *testing.T) {
+	type args struct {
+		target     string
+		rejectWith string
+		protocol   string
+	}
+	tests := []struct {
+		name string
+		args args
+		want RejectAction
+	}{
+		{name: "default", args: args{protocol: "tcp"},
+			want: RejectAction{Target: "REJECT", RejectWith: "icmp-port-unreachable"}},
+		{name: "reject tcp", args: args{target: "REJECT", protocol: "tcp"},
+			want: RejectAction{Target: "REJECT", RejectWith: "tcp-reset"}},
+		{name: "reject udp", args: args{target: "reject", protocol: "udp"},
+			want: RejectAction{Target: "REJECT", RejectWith: "icmp-port-unreachable"}},
+		{name: "reject explicit type", args: args{target: "REJECT", rejectWith: "icmp-host-prohibited", protocol: "tcp"},
+			want: RejectAction{Target: "REJECT", RejectWith: "icmp-host-prohibited"}},
+		{name: "drop", args: args{target: "drop", protocol: "tcp"},
+			want: RejectAction{Target: "DROP"}},
+		{name: "custom", args: args{target: "LOG-AND-DROP", protocol: "tcp"},
+			want: RejectAction{Target: "LOG-AND-DROP"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewRejectAction(tt.args.target, tt.args.rejectWith, tt.args.protocol); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewRejectAction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRejectAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  RejectAction
+		wantErr bool
+	}{
+		{name: "reject", action: RejectAction{Target: "REJECT", RejectWith: "tcp-reset"}, wantErr: false},
+		{name: "drop", action: RejectAction{Target: "DROP"}, wantErr: false},
+		{name: "custom", action: RejectAction{Target: "LOG-AND-DROP"}, wantErr: false},
+		{name: "invalid reject type", action: RejectAction{Target: "REJECT", RejectWith: "foo"}, wantErr: true},
+		{name: "reject type for drop", action: RejectAction{Target: "DROP", RejectWith: "tcp-reset"}, wantErr: true},
+		{name: "invalid target", action: RejectAction{Target: "LOG AND DROP"}, wantErr: true},
+		{name: "empty target", action: RejectAction{}, wantErr: true},
+		{name: "accept", action: RejectAction{Target: "ACCEPT"}, wantErr: true},
+		{name: "accept lowercase", action: RejectAction{Target: "accept"}, wantErr: true},
+		{name: "return", action: RejectAction{Target: "RETURN"}, wantErr: true},
+		{name: "own chain", action: RejectAction{Target: "TEST-CHAIN"}, wantErr: true},
+		{name: "own staging chain", action: RejectAction{Target: "TEST-CHAIN-NEW"}, wantErr: true},
+		{name: "other chain", action: RejectAction{Target: "TEST-CHAIN-LOG"}, wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateRejectAction(tt.action, "TEST-CHAIN"); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRejectAction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateDefaultNetworkChainRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		action RejectAction
+		want   string
+	}{
+		{name: "zero value", action: RejectAction{},
+			want: "-A TEST-CHAIN -j REJECT --reject-with icmp-port-unreachable"},
+		{name: "tcp reset", action: RejectAction{Target: "REJECT", RejectWith: "tcp-reset"},
+			want: "-A TEST-CHAIN -p tcp -j REJECT --reject-with tcp-reset"},
+		{name: "drop", action: RejectAction{Target: "DROP"},
+			want: "-A TEST-CHAIN -j DROP"},
+		{name: "custom", action: RejectAction{Target: "LOG-AND-DROP"},
+			want: "-A TEST-CHAIN -j LOG-AND-DROP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CreateDefaultNetworkChainRule("TEST-CHAIN", tt.action); got != tt.want {
+				t.Errorf("CreateDefaultNetworkChainRule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRejectActionFromTablesData(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want *RejectAction
+	}{
+		{name: "empty", data: "", want: nil},
+		{name: "no default rule", data: "-A KUBE-RESTRICT-IP -s 10.0.0.0/8 -j RETURN", want: nil},
+		{name: "icmp port unreachable",
+			data: "-A KUBE-RESTRICT-IP -s 10.0.0.0/8 -j RETURN\n-A KUBE-RESTRICT-IP -j REJECT --reject-with icmp-port-unreachable",
+			want: &RejectAction{Target: "REJECT", RejectWith: "icmp-port-unreachable"}},
+		{name: "tcp reset", data: "-A KUBE-RESTRICT-IP -p tcp -j REJECT --reject-with tcp-reset",
+			want: &RejectAction{Target: "REJECT", RejectWith: "tcp-reset"}},
+		{name: "drop", data: "-A KUBE-RESTRICT-IP -j DROP", want: &RejectAction{Target: "DROP"}},
+		{name: "other chain", data: "-A KUBE-RESTRICT-IP-1 -j DROP", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetRejectActionFromTablesData([]byte(tt.data), "KUBE-RESTRICT-IP"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetRejectActionFromTablesData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetNetworksFromTablesData(t *testing.T) {
+	data := `:KUBE-RESTRICT-IP - [0:0]
+-A INPUT -p tcp -m multiport --dports 80 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP
+-A KUBE-RESTRICT-IP -s 127.0.0.0/8 -j RETURN
+-A KUBE-RESTRICT-IP -s 10.1.0.0/16 -p tcp -j REJECT --reject-with tcp-reset
+-A KUBE-RESTRICT-IP -s 10.0.0.0/8 -j RETURN
+-A KUBE-RESTRICT-IP-1 -s 192.168.0.0/16 -j RETURN
+-A KUBE-RESTRICT-IP -p tcp -j REJECT --reject-with tcp-reset
+`
+	allowed, denied := GetNetworksFromTablesData([]byte(data), "KUBE-RESTRICT-IP")
+	if want := []string{"127.0.0.0/8", "10.0.0.0/8"}; !reflect.DeepEqual(allowed, want) {
+		t.Errorf("GetNetworksFromTablesData() allowed = %v, want %v", allowed, want)
+	}
+	if want := []string{"10.1.0.0/16"}; !reflect.DeepEqual(denied, want) {
+		t.Errorf("GetNetworksFromTablesData() denied = %v, want %v", denied, want)
+	}
+}
+
+func TestNormalizeRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{name: "input rule", rule: CreateRestrictedPortsAddRule("", "TEST-CHAIN", []string{"80", "443"}),
+			want: "-A INPUT -p tcp -m multiport --dports 80,443 -m comment --comment kube-restrict-ip -j TEST-CHAIN"},
+		{name: "address", rule: CreateAllowedNetworkChainRule("TEST-CHAIN", "10.0.0.1"),
+			want: "-A TEST-CHAIN -s 10.0.0.1/32 -j RETURN"},
+		{name: "network", rule: CreateAllowedNetworkChainRule("TEST-CHAIN", "10.0.0.0/8"),
+			want: "-A TEST-CHAIN -s 10.0.0.0/8 -j RETURN"},
+		{name: "default rule", rule: CreateDefaultNetworkChainRule("TEST-CHAIN", RejectAction{Target: "DROP"}),
+			want: "-A TEST-CHAIN -j DROP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeRule(tt.rule); got != tt.want {
+				t.Errorf("NormalizeRule() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetChainRuleCountersFromTablesData(t *testing.T) {
+	data := `*filter
+:INPUT ACCEPT [100:10000]
+:KUBE-RESTRICT-IP - [0:0]
+[42:4200] -A INPUT -p tcp -m multiport --dports 80 -m comment --comment kube-restrict-ip -j KUBE-RESTRICT-IP
+[1:60] -A KUBE-RESTRICT-IP -s 10.1.0.0/16 -p tcp -j REJECT --reject-with tcp-reset
+[30:3000] -A KUBE-RESTRICT-IP -s 10.0.0.0/8 -j RETURN
+[5:500] -A KUBE-RESTRICT-IP-1 -s 192.168.0.0/16 -j RETURN
+[11:1140] -A KUBE-RESTRICT-IP -p tcp -j REJECT --reject-with tcp-reset
+COMMIT
+`
+	want := []RuleCounters{
+		{Network: "10.1.0.0/16", Target: "REJECT", Packets: 1, Bytes: 60},
+		{Network: "10.0.0.0/8", Target: "RETURN", Packets: 30, Bytes: 3000},
+		{Target: "REJECT", Packets: 11, Bytes: 1140},
+	}
+	if got := GetChainRuleCountersFromTablesData([]byte(data), "KUBE-RESTRICT-IP"); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetChainRuleCountersFromTablesData() = %+v, want %+v", got, want)
+	}
+
+	wantInput := &RuleCounters{Target: "KUBE-RESTRICT-IP", Packets: 42, Bytes: 4200}
+	if got := GetRestrictedPortsCountersFromTablesData([]byte(data), "KUBE-RESTRICT-IP"); !reflect.DeepEqual(got, wantInput) {
+		t.Errorf("GetRestrictedPortsCountersFromTablesData() = %+v, want %+v", got, wantInput)
+	}
+	if got := GetRestrictedPortsCountersFromTablesData([]byte(data), "KUBE-RESTRICT-IP-1"); got != nil {
+		t.Errorf("GetRestrictedPortsCountersFromTablesData() = %+v, want nil", got)
+	}
+
+	stripped := RemoveCountersFromTablesData([]byte(data))
+	if got := GetRestrictedPortsFromTablesData(stripped, "KUBE-RESTRICT-IP"); !reflect.DeepEqual(got, []string{"80"}) {
+		t.Errorf("GetRestrictedPortsFromTablesData(RemoveCountersFromTablesData()) = %v, want [80]", got)
+	}
+}
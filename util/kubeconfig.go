@@ -0,0 +1,78 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kubeconfig file parts needed to find API server of the current context
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server string `yaml:"server"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+}
+
+// Get API server host (address or name) of the kubeconfig file current context
+func KubeconfigServerHost(fileName string) (string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	var c kubeconfig
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return "", errors.New(fmt.Sprintf("invalid kubeconfig file %s: %v", fileName, err))
+	}
+
+	cluster := ""
+	for _, ctx := range c.Contexts {
+		if ctx.Name == c.CurrentContext {
+			cluster = ctx.Context.Cluster
+		}
+	}
+	if cluster == "" {
+		return "", errors.New(fmt.Sprintf("kubeconfig file %s has no current context cluster", fileName))
+	}
+
+	for _, cl := range c.Clusters {
+		if cl.Name != cluster {
+			continue
+		}
+		u, err := url.Parse(cl.Cluster.Server)
+		if err != nil || u.Hostname() == "" {
+			return "", errors.New(fmt.Sprintf("invalid kubeconfig file %s cluster %s server: %s",
+				fileName, cluster, cl.Cluster.Server))
+		}
+		return u.Hostname(), nil
+	}
+
+	return "", errors.New(fmt.Sprintf("kubeconfig file %s has no cluster %s", fileName, cluster))
+}
@@ -0,0 +1,119 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKubeconfigServerHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type args struct {
+		data string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "current context server",
+			args: args{data: `
+clusters:
+- name: other
+  cluster:
+    server: https://10.0.0.2:6443
+- name: kubernetes
+  cluster:
+    server: https://10.0.0.1:6443
+contexts:
+- name: other@other
+  context:
+    cluster: other
+- name: admin@kubernetes
+  context:
+    cluster: kubernetes
+current-context: admin@kubernetes
+`},
+			want: "10.0.0.1",
+		},
+		{
+			name: "server host name",
+			args: args{data: `
+clusters:
+- name: kubernetes
+  cluster:
+    server: https://api.example.com
+contexts:
+- name: default
+  context:
+    cluster: kubernetes
+current-context: default
+`},
+			want: "api.example.com",
+		},
+		{
+			name: "no current context",
+			args: args{data: `
+clusters:
+- name: kubernetes
+  cluster:
+    server: https://10.0.0.1:6443
+`},
+			wantErr: true,
+		},
+		{
+			name: "no cluster",
+			args: args{data: `
+contexts:
+- name: default
+  context:
+    cluster: kubernetes
+current-context: default
+`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid",
+			args:    args{data: "clusters: {"},
+			wantErr: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(dir, string(rune('a'+i)))
+			if err := ioutil.WriteFile(fileName, []byte(tt.args.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := KubeconfigServerHost(fileName)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("KubeconfigServerHost() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("KubeconfigServerHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
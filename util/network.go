@@ -0,0 +1,258 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var hostnameLabelRegex = regexp.MustCompile("^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$")
+var numericRegex = regexp.MustCompile("^[0-9]+$")
+
+// Parse IP network (address or CIDR), single address is converted to host network
+func ParseNetwork(n string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(n); err == nil {
+		return ipNet, nil
+	}
+	ip := net.ParseIP(n)
+	if ip == nil {
+		return nil, errors.New(fmt.Sprintf("invalid network: %s", n))
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Checks string is a valid DNS host name (and not an IP address)
+func IsHostname(s string) bool {
+	if len(s) == 0 || len(s) > 253 || net.ParseIP(s) != nil {
+		return false
+	}
+	labels := strings.Split(strings.TrimSuffix(s, "."), ".")
+	for _, l := range labels {
+		if !hostnameLabelRegex.MatchString(l) {
+			return false
+		}
+	}
+	// Top level domain can't be all-numeric
+	return !numericRegex.MatchString(labels[len(labels)-1])
+}
+
+// Checks network n1 contains all addresses of network n2
+func ContainsNetwork(n1, n2 *net.IPNet) bool {
+	ones1, bits1 := n1.Mask.Size()
+	ones2, bits2 := n2.Mask.Size()
+	return bits1 == bits2 && ones1 <= ones2 && n1.Contains(n2.IP)
+}
+
+// Find the first network containing the address, empty string if not found
+func FindNetwork(ip net.IP, nets []string) string {
+	for _, n := range nets {
+		if ipNet, err := ParseNetwork(n); err == nil && ipNet.Contains(ip) {
+			return n
+		}
+	}
+	return ""
+}
+
+// Find denied and allowed networks which rules can never match since all their
+// addresses are covered by rules evaluated before: denied networks rules are
+// evaluated first, in order of definition, then allowed networks ones.
+// Returns warning message for every such network.
+func GetShadowedNetworks(denied, allowed []string) []string {
+	var warnings []string
+
+	type rule struct {
+		kind string
+		net  string
+		n    *net.IPNet
+	}
+	var rules []rule
+
+	check := func(kind string, nets []string) {
+		for _, s := range nets {
+			n, err := ParseNetwork(s)
+			if err != nil {
+				continue
+			}
+			for _, r := range rules {
+				if ContainsNetwork(r.n, n) {
+					warnings = append(warnings, fmt.Sprintf("%s network %s is never matched: covered by %s network %s",
+						kind, s, r.kind, r.net))
+					break
+				}
+			}
+			rules = append(rules, rule{kind: kind, net: s, n: n})
+		}
+	}
+
+	check("denied", denied)
+	check("allowed", allowed)
+
+	return warnings
+}
+
+const (
+	RedundancyDuplicate  = "duplicate of"
+	RedundancyCovered    = "covered by"
+	RedundancyAggregated = "aggregated to"
+)
+
+// Network removed from networks list by aggregation
+type Redundancy struct {
+	Network     string
+	Reason      string
+	Replacement string
+}
+
+func (r Redundancy) String() string {
+	return fmt.Sprintf("network %s is %s %s", r.Network, r.Reason, r.Replacement)
+}
+
+// Network with its address range start and origin networks
+type aggregatedNetwork struct {
+	net     *net.IPNet
+	ones    int
+	bits    int
+	start   *big.Int
+	origins []string
+}
+
+func newAggregatedNetwork(n *net.IPNet, origins []string) *aggregatedNetwork {
+	ones, bits := n.Mask.Size()
+	ip := n.IP.To4()
+	if bits == 128 {
+		ip = n.IP.To16()
+	}
+	return &aggregatedNetwork{
+		net:     n,
+		ones:    ones,
+		bits:    bits,
+		start:   new(big.Int).SetBytes(ip),
+		origins: origins,
+	}
+}
+
+func (n *aggregatedNetwork) size() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(n.bits-n.ones))
+}
+
+// Get parent network if this network and the next one are two halves of it
+func (n *aggregatedNetwork) merge(next *aggregatedNetwork) *aggregatedNetwork {
+	if n.bits != next.bits || n.ones != next.ones || n.ones == 0 {
+		return nil
+	}
+	// This network must be the lower half of the parent network
+	parentSize := new(big.Int).Lsh(n.size(), 1)
+	if new(big.Int).Mod(n.start, parentSize).Sign() != 0 {
+		return nil
+	}
+	if new(big.Int).Add(n.start, n.size()).Cmp(next.start) != 0 {
+		return nil
+	}
+	parent := &net.IPNet{IP: n.net.IP, Mask: net.CIDRMask(n.ones-1, n.bits)}
+	return newAggregatedNetwork(parent, append(append([]string{}, n.origins...), next.origins...))
+}
+
+// Format network as an address for single host networks and in CIDR notation otherwise
+func FormatNetwork(n *net.IPNet) string {
+	if ones, bits := n.Mask.Size(); ones == bits {
+		return n.IP.String()
+	}
+	return n.String()
+}
+
+// Aggregate networks list to the minimal set of networks covering the same addresses.
+// Duplicate networks and networks covered by other ones are removed, adjacent networks
+// are merged. Resulting networks are sorted by address, IPv4 ones first. Entries which
+// are not valid networks are kept as is at the end of the list. Returns aggregated networks
+// and the list of removed redundant networks.
+func AggregateNetworks(nets []string) ([]string, []Redundancy) {
+	var parsed []*aggregatedNetwork
+	var invalid []string
+	for _, s := range nets {
+		n, err := ParseNetwork(s)
+		if err != nil {
+			invalid = append(invalid, s)
+			continue
+		}
+		parsed = append(parsed, newAggregatedNetwork(n, []string{s}))
+	}
+
+	sort.SliceStable(parsed, func(i, j int) bool {
+		a, b := parsed[i], parsed[j]
+		if a.bits != b.bits {
+			return a.bits < b.bits
+		}
+		if c := a.start.Cmp(b.start); c != 0 {
+			return c < 0
+		}
+		return a.ones < b.ones
+	})
+
+	var redundancies []Redundancy
+
+	// Remove duplicate and covered networks: since networks are sorted by range start
+	// and kept ones are disjoint, only the last kept network could cover the next one
+	var kept []*aggregatedNetwork
+	for _, n := range parsed {
+		if len(kept) > 0 {
+			last := kept[len(kept)-1]
+			if ContainsNetwork(last.net, n.net) {
+				reason := RedundancyCovered
+				if last.ones == n.ones {
+					reason = RedundancyDuplicate
+				}
+				redundancies = append(redundancies, Redundancy{Network: n.origins[0], Reason: reason,
+					Replacement: last.origins[0]})
+				continue
+			}
+		}
+		kept = append(kept, n)
+	}
+
+	// Merge adjacent networks
+	var merged []*aggregatedNetwork
+	for _, n := range kept {
+		merged = append(merged, n)
+		for len(merged) > 1 {
+			parent := merged[len(merged)-2].merge(merged[len(merged)-1])
+			if parent == nil {
+				break
+			}
+			merged = append(merged[:len(merged)-2], parent)
+		}
+	}
+
+	var res []string
+	for _, n := range merged {
+		s := FormatNetwork(n.net)
+		res = append(res, s)
+		if len(n.origins) > 1 {
+			for _, o := range n.origins {
+				redundancies = append(redundancies, Redundancy{Network: o, Reason: RedundancyAggregated, Replacement: s})
+			}
+		}
+	}
+
+	return append(res, invalid...), redundancies
+}
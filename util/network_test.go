@@ -0,0 +1,229 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		net     string
+		want    string
+		wantErr bool
+	}{
+		{name: "ipv4 address", net: "192.168.1.1", want: "192.168.1.1/32"},
+		{name: "ipv4 cidr", net: "192.168.1.1/24", want: "192.168.1.0/24"},
+		{name: "ipv6 address", net: "fd00::1", want: "fd00::1/128"},
+		{name: "ipv6 cidr", net: "fd00::1/64", want: "fd00::/64"},
+		{name: "invalid", net: "192.168.1.abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNetwork(tt.net)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNetwork() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseNetwork() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindNetwork(t *testing.T) {
+	type args struct {
+		ip   string
+		nets []string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{name: "first matched", args: args{ip: "10.1.2.3", nets: []string{"192.168.0.0/16", "10.1.0.0/16", "10.0.0.0/8"}},
+			want: "10.1.0.0/16"},
+		{name: "host network", args: args{ip: "10.1.2.3", nets: []string{"10.1.2.3"}}, want: "10.1.2.3"},
+		{name: "not matched", args: args{ip: "10.1.2.3", nets: []string{"10.1.2.4", "192.168.0.0/16"}}, want: ""},
+		{name: "invalid skipped", args: args{ip: "10.1.2.3", nets: []string{"example.com", "0.0.0.0/0"}},
+			want: "0.0.0.0/0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FindNetwork(net.ParseIP(tt.args.ip), tt.args.nets); got != tt.want {
+				t.Errorf("FindNetwork() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetShadowedNetworks(t *testing.T) {
+	type args struct {
+		denied  []string
+		allowed []string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
+	}{
+		{name: "no shadowing", args: args{denied: []string{"10.1.0.0/16"}, allowed: []string{"10.0.0.0/8"}},
+			want: nil},
+		{name: "allowed covered by denied", args: args{denied: []string{"10.1.0.0/16"}, allowed: []string{"10.1.2.0/24", "10.0.0.0/8"}},
+			want: []string{"allowed network 10.1.2.0/24 is never matched: covered by denied network 10.1.0.0/16"}},
+		{name: "denied covered by denied", args: args{denied: []string{"10.1.0.0/16", "10.1.2.3"}},
+			want: []string{"denied network 10.1.2.3 is never matched: covered by denied network 10.1.0.0/16"}},
+		{name: "allowed covered by allowed", args: args{allowed: []string{"10.0.0.0/8", "10.1.2.3"}},
+			want: []string{"allowed network 10.1.2.3 is never matched: covered by allowed network 10.0.0.0/8"}},
+		{name: "different families", args: args{denied: []string{"::/0"}, allowed: []string{"10.0.0.0/8"}},
+			want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetShadowedNetworks(tt.args.denied, tt.args.allowed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetShadowedNetworks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{name: "fqdn", s: "bastion.example.com", want: true},
+		{name: "fqdn with trailing dot", s: "bastion.example.com.", want: true},
+		{name: "single label", s: "localhost", want: true},
+		{name: "ipv4 address", s: "192.168.1.1", want: false},
+		{name: "ipv6 address", s: "fd00::1", want: false},
+		{name: "cidr", s: "192.168.1.0/24", want: false},
+		{name: "numeric tld", s: "192.168.1.260", want: false},
+		{name: "invalid chars", s: "bastion_1.example.com", want: false},
+		{name: "empty label", s: "bastion..example.com", want: false},
+		{name: "empty", s: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsHostname(tt.s); got != tt.want {
+				t.Errorf("IsHostname() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregateNetworks(t *testing.T) {
+	tests := []struct {
+		name             string
+		nets             []string
+		want             []string
+		wantRedundancies []Redundancy
+	}{
+		{name: "empty", nets: nil, want: nil, wantRedundancies: nil},
+		{name: "ipv4 disjoint sorted", nets: []string{"10.2.0.0/16", "127.0.0.1", "10.1.0.0/16"},
+			want: []string{"10.1.0.0/16", "10.2.0.0/16", "127.0.0.1"}},
+		{name: "ipv4 host bits normalized", nets: []string{"192.168.1.1/24", "10.0.0.1/32"},
+			want: []string{"10.0.0.1", "192.168.1.0/24"}},
+		{name: "ipv4 duplicate", nets: []string{"10.0.0.1", "10.0.0.1/32"},
+			want:             []string{"10.0.0.1"},
+			wantRedundancies: []Redundancy{{Network: "10.0.0.1/32", Reason: RedundancyDuplicate, Replacement: "10.0.0.1"}}},
+		{name: "ipv4 covered", nets: []string{"10.1.2.3", "10.0.0.0/8", "10.1.0.0/16"},
+			want: []string{"10.0.0.0/8"},
+			wantRedundancies: []Redundancy{
+				{Network: "10.1.0.0/16", Reason: RedundancyCovered, Replacement: "10.0.0.0/8"},
+				{Network: "10.1.2.3", Reason: RedundancyCovered, Replacement: "10.0.0.0/8"},
+			}},
+		{name: "ipv4 adjacent", nets: []string{"10.0.0.128/25", "10.0.0.0/25"},
+			want: []string{"10.0.0.0/24"},
+			wantRedundancies: []Redundancy{
+				{Network: "10.0.0.0/25", Reason: RedundancyAggregated, Replacement: "10.0.0.0/24"},
+				{Network: "10.0.0.128/25", Reason: RedundancyAggregated, Replacement: "10.0.0.0/24"},
+			}},
+		{name: "ipv4 adjacent not aligned", nets: []string{"10.0.1.0/24", "10.0.2.0/24"},
+			want: []string{"10.0.1.0/24", "10.0.2.0/24"}},
+		{name: "ipv4 adjacent different sizes", nets: []string{"10.0.0.0/24", "10.0.1.0/25"},
+			want: []string{"10.0.0.0/24", "10.0.1.0/25"}},
+		{name: "ipv4 cascaded merge", nets: []string{"10.0.0.0/25", "10.0.0.128/26", "10.0.0.192/26", "10.0.1.0/24"},
+			want: []string{"10.0.0.0/23"},
+			wantRedundancies: []Redundancy{
+				{Network: "10.0.0.0/25", Reason: RedundancyAggregated, Replacement: "10.0.0.0/23"},
+				{Network: "10.0.0.128/26", Reason: RedundancyAggregated, Replacement: "10.0.0.0/23"},
+				{Network: "10.0.0.192/26", Reason: RedundancyAggregated, Replacement: "10.0.0.0/23"},
+				{Network: "10.0.1.0/24", Reason: RedundancyAggregated, Replacement: "10.0.0.0/23"},
+			}},
+		{name: "ipv4 adjacent hosts", nets: []string{"10.0.0.1", "10.0.0.0"},
+			want: []string{"10.0.0.0/31"},
+			wantRedundancies: []Redundancy{
+				{Network: "10.0.0.0", Reason: RedundancyAggregated, Replacement: "10.0.0.0/31"},
+				{Network: "10.0.0.1", Reason: RedundancyAggregated, Replacement: "10.0.0.0/31"},
+			}},
+		{name: "ipv4 whole space", nets: []string{"0.0.0.0/1", "128.0.0.0/1", "10.0.0.0/8"},
+			want: []string{"0.0.0.0/0"},
+			wantRedundancies: []Redundancy{
+				{Network: "10.0.0.0/8", Reason: RedundancyCovered, Replacement: "0.0.0.0/1"},
+				{Network: "0.0.0.0/1", Reason: RedundancyAggregated, Replacement: "0.0.0.0/0"},
+				{Network: "128.0.0.0/1", Reason: RedundancyAggregated, Replacement: "0.0.0.0/0"},
+			}},
+		{name: "ipv6 covered", nets: []string{"fd00::1", "fd00::/64", "fd00:0:0:0:ffff::/80"},
+			want: []string{"fd00::/64"},
+			wantRedundancies: []Redundancy{
+				{Network: "fd00::1", Reason: RedundancyCovered, Replacement: "fd00::/64"},
+				{Network: "fd00:0:0:0:ffff::/80", Reason: RedundancyCovered, Replacement: "fd00::/64"},
+			}},
+		{name: "ipv6 duplicate", nets: []string{"fd00::1", "fd00:0::1/128"},
+			want:             []string{"fd00::1"},
+			wantRedundancies: []Redundancy{{Network: "fd00:0::1/128", Reason: RedundancyDuplicate, Replacement: "fd00::1"}}},
+		{name: "ipv6 adjacent", nets: []string{"2001:db8::/33", "2001:db8:8000::/33"},
+			want: []string{"2001:db8::/32"},
+			wantRedundancies: []Redundancy{
+				{Network: "2001:db8::/33", Reason: RedundancyAggregated, Replacement: "2001:db8::/32"},
+				{Network: "2001:db8:8000::/33", Reason: RedundancyAggregated, Replacement: "2001:db8::/32"},
+			}},
+		{name: "ipv6 adjacent not aligned", nets: []string{"2001:db8:1::/48", "2001:db8:2::/48"},
+			want: []string{"2001:db8:1::/48", "2001:db8:2::/48"}},
+		{name: "ipv6 whole space", nets: []string{"::/1", "8000::/1"},
+			want: []string{"::/0"},
+			wantRedundancies: []Redundancy{
+				{Network: "::/1", Reason: RedundancyAggregated, Replacement: "::/0"},
+				{Network: "8000::/1", Reason: RedundancyAggregated, Replacement: "::/0"},
+			}},
+		{name: "mixed families", nets: []string{"::/0", "10.0.0.0/8", "fd00::1", "0.0.0.0/0"},
+			want: []string{"0.0.0.0/0", "::/0"},
+			wantRedundancies: []Redundancy{
+				{Network: "10.0.0.0/8", Reason: RedundancyCovered, Replacement: "0.0.0.0/0"},
+				{Network: "fd00::1", Reason: RedundancyCovered, Replacement: "::/0"},
+			}},
+		{name: "ipv4-mapped ipv6 address", nets: []string{"::ffff:10.0.0.1", "10.0.0.1"},
+			want:             []string{"10.0.0.1"},
+			wantRedundancies: []Redundancy{{Network: "10.0.0.1", Reason: RedundancyDuplicate, Replacement: "::ffff:10.0.0.1"}}},
+		{name: "invalid kept", nets: []string{"bastion.example.com", "10.0.0.1"},
+			want: []string{"10.0.0.1", "bastion.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotRedundancies := AggregateNetworks(tt.nets)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AggregateNetworks() got = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(gotRedundancies, tt.wantRedundancies) {
+				t.Errorf("AggregateNetworks() gotRedundancies = %v, want %v", gotRedundancies, tt.wantRedundancies)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron-like schedule: set of minutes matched by five fields expression
+// (minute, hour, day of month, month, day of week)
+type Schedule struct {
+	expr string
+
+	minutes  map[int]bool
+	hours    map[int]bool
+	days     map[int]bool
+	months   map[int]bool
+	weekdays map[int]bool
+
+	// Day of month or day of week fields are restricted (not '*')
+	daysRestricted     bool
+	weekdaysRestricted bool
+}
+
+// Parse cron-like schedule expression. Every field could be '*', a number, a range
+// ('1-5'), a list ('1,3,5') or a stepped range or wildcard ('*/15', '0-30/10').
+// Day of week is 0-7, where both 0 and 7 are Sunday.
+func ParseSchedule(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New(fmt.Sprintf("invalid schedule %q: expected 5 fields, got %d", expr, len(fields)))
+	}
+
+	s := &Schedule{expr: strings.Join(fields, " ")}
+
+	var err error
+	if s.minutes, err = parseScheduleField(fields[0], 0, 59); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid schedule %q minute field: %v", expr, err))
+	}
+	if s.hours, err = parseScheduleField(fields[1], 0, 23); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid schedule %q hour field: %v", expr, err))
+	}
+	if s.days, err = parseScheduleField(fields[2], 1, 31); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid schedule %q day of month field: %v", expr, err))
+	}
+	if s.months, err = parseScheduleField(fields[3], 1, 12); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid schedule %q month field: %v", expr, err))
+	}
+	if s.weekdays, err = parseScheduleField(fields[4], 0, 7); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid schedule %q day of week field: %v", expr, err))
+	}
+	if s.weekdays[7] {
+		s.weekdays[0] = true
+	}
+	s.daysRestricted = fields[2] != "*"
+	s.weekdaysRestricted = fields[4] != "*"
+
+	return s, nil
+}
+
+func parseScheduleField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, errors.New(fmt.Sprintf("invalid step: %s", part))
+			}
+			step = n
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid value: %s", part))
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New(fmt.Sprintf("invalid value: %s", part))
+				}
+			} else if step > 1 {
+				// 'N/step' means range from N to max with step
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, errors.New(fmt.Sprintf("value out of range %d-%d: %s", min, max, part))
+		}
+
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+
+	return values, nil
+}
+
+// Checks the minute of given time is matched by the schedule
+func (s *Schedule) Matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+	day := s.days[t.Day()]
+	weekday := s.weekdays[int(t.Weekday())]
+	// Like in cron, if both day of month and day of week are restricted, either one should match
+	if s.daysRestricted && s.weekdaysRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+func (s *Schedule) String() string {
+	return s.expr
+}
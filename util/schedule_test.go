@@ -0,0 +1,81 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{name: "any", expr: "* * * * *", wantErr: false},
+		{name: "business hours", expr: "* 9-17 * * 1-5", wantErr: false},
+		{name: "lists and steps", expr: "0,30 */2 1-15/2 1,6 0,7", wantErr: false},
+		{name: "too few fields", expr: "* * * *", wantErr: true},
+		{name: "minute out of range", expr: "60 * * * *", wantErr: true},
+		{name: "day of month out of range", expr: "* * 0 * *", wantErr: true},
+		{name: "reversed range", expr: "* 17-9 * * *", wantErr: true},
+		{name: "invalid step", expr: "*/0 * * * *", wantErr: true},
+		{name: "invalid value", expr: "* * * * mon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseSchedule(tt.expr); (err != nil) != tt.wantErr {
+				t.Errorf("ParseSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchedule_Matches(t *testing.T) {
+	// 2019-01-07 is Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2019, 1, day, hour, minute, 30, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{name: "business hours start", expr: "* 9-17 * * 1-5", t: at(7, 9, 0), want: true},
+		{name: "business hours end", expr: "* 9-17 * * 1-5", t: at(7, 17, 59), want: true},
+		{name: "after business hours", expr: "* 9-17 * * 1-5", t: at(7, 18, 0), want: false},
+		{name: "weekend", expr: "* 9-17 * * 1-5", t: at(6, 10, 0), want: false},
+		{name: "sunday as 7", expr: "* * * * 7", t: at(6, 10, 0), want: true},
+		{name: "step matched", expr: "*/15 * * * *", t: at(7, 10, 45), want: true},
+		{name: "step not matched", expr: "*/15 * * * *", t: at(7, 10, 46), want: false},
+		{name: "start with step", expr: "5/20 * * * *", t: at(7, 10, 25), want: true},
+		{name: "day of month or day of week", expr: "* * 1 * 1", t: at(7, 10, 0), want: true},
+		{name: "day of month and any day of week", expr: "* * 1 * *", t: at(7, 10, 0), want: false},
+		{name: "month not matched", expr: "* * * 2-12 *", t: at(7, 10, 0), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseSchedule() error = %v", err)
+			}
+			if got := s.Matches(tt.t); got != tt.want {
+				t.Errorf("Schedule.Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
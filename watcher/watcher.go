@@ -0,0 +1,271 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// Delay to coalesce bursts of filesystem events (e.g. ConfigMap volume update) to single notification
+const debounceDelay = 100 * time.Millisecond
+
+// Config files watcher. Watches directories containing config files and their symlinks
+// targets for filesystem events, so files replaced by renaming or symlink swapping
+// (like ConfigMap volume `..data` symlink) are handled. Config files are also periodically
+// polled for changes of their resolved paths, sizes and modification times as a fallback
+type Watcher struct {
+	// Function returning config file names to watch
+	files func() ([]string, error)
+	// Directories to watch for filesystem events
+	dirs []string
+
+	mu       sync.Mutex
+	interval time.Duration
+	stamp    string
+
+	// Directories of resolved config files paths being watched
+	watched map[string]bool
+	// Config files known by the last stamp update
+	known map[string]bool
+
+	changes chan struct{}
+	// Notified on polling interval change
+	intervalCh chan struct{}
+}
+
+// Create watcher for config files returned by files function, located in given directories
+func New(dirs []string, files func() ([]string, error), interval time.Duration) *Watcher {
+	w := &Watcher{
+		files:    files,
+		dirs:     dirs,
+		interval: interval,
+		changes:  make(chan struct{}, 1),
+
+		intervalCh: make(chan struct{}, 1),
+	}
+	w.stamp, _ = w.currentStamp()
+	return w
+}
+
+// Create watcher for single config file
+func NewFileWatcher(fileName string, interval time.Duration) *Watcher {
+	return New([]string{filepath.Dir(fileName)}, func() ([]string, error) {
+		return []string{fileName}, nil
+	}, interval)
+}
+
+// Get channel notified on config files changes
+func (w *Watcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Set config files polling interval
+func (w *Watcher) SetInterval(interval time.Duration) {
+	w.mu.Lock()
+	w.interval = interval
+	w.mu.Unlock()
+
+	select {
+	case w.intervalCh <- struct{}{}:
+	default:
+		// Interval change is already pending
+	}
+}
+
+func (w *Watcher) pollInterval() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.interval
+}
+
+// Watch config files until stop channel is closed
+func (w *Watcher) Run(stopCh <-chan struct{}) {
+	var events chan fsnotify.Event
+	var errs chan error
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Warningf("can't watch config files, falling back to polling: %v", err)
+	} else {
+		defer fsw.Close()
+		for _, dir := range w.dirs {
+			if err := fsw.Add(dir); err != nil {
+				glog.Warningf("can't watch config directory %s, falling back to polling: %v", dir, err)
+			}
+		}
+		events, errs = fsw.Events, fsw.Errors
+		w.watchResolved(fsw)
+	}
+
+	// Single poll timer is reset only when fired or polling interval is changed,
+	// so frequent filesystem events don't postpone polling
+	poll := time.NewTimer(w.pollInterval())
+	defer poll.Stop()
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-stopCh:
+			return
+		case e := <-events:
+			if !w.relevant(e) {
+				continue
+			}
+			glog.V(4).Infof("config directory event: %v", e)
+			if debounce == nil {
+				debounce = time.After(debounceDelay)
+			}
+		case err := <-errs:
+			glog.Errorf("config files watch error: %v", err)
+		case <-debounce:
+			debounce = nil
+			// Files could be changed in place keeping stamp unchanged, so notify anyway
+			w.updateStamp()
+			w.watchResolved(fsw)
+			w.notify()
+		case <-w.intervalCh:
+			if !poll.Stop() {
+				select {
+				case <-poll.C:
+				default:
+				}
+			}
+			poll.Reset(w.pollInterval())
+		case <-poll.C:
+			poll.Reset(w.pollInterval())
+			if w.updateStamp() {
+				glog.V(2).Info("config files change detected by polling")
+				w.watchResolved(fsw)
+				w.notify()
+			}
+		}
+	}
+}
+
+// Watch directories of resolved config files paths, in addition to the watched config directories
+func (w *Watcher) watchResolved(fsw *fsnotify.Watcher) {
+	if fsw == nil {
+		return
+	}
+
+	files, err := w.files()
+	if err != nil {
+		glog.Errorf("can't get config files: %v", err)
+		return
+	}
+
+	dirs := map[string]bool{}
+	for _, dir := range w.dirs {
+		dirs[filepath.Clean(dir)] = true
+	}
+	resolved := map[string]bool{}
+	for _, f := range files {
+		if path, err := filepath.EvalSymlinks(f); err == nil && !dirs[filepath.Dir(path)] {
+			resolved[filepath.Dir(path)] = true
+		}
+	}
+
+	for dir := range w.watched {
+		if !resolved[dir] {
+			// Directory could be removed already, so ignore errors
+			fsw.Remove(dir)
+		}
+	}
+	for dir := range resolved {
+		if !w.watched[dir] {
+			if err := fsw.Add(dir); err != nil {
+				glog.Warningf("can't watch config directory %s: %v", dir, err)
+				delete(resolved, dir)
+			}
+		}
+	}
+	w.watched = resolved
+}
+
+// Checks filesystem event relates to config files: config file itself, its resolved path
+// or ConfigMap volume internal entry (named with ".." prefix)
+func (w *Watcher) relevant(e fsnotify.Event) bool {
+	name := filepath.Clean(e.Name)
+	if w.known[name] || w.watched[filepath.Dir(name)] || strings.HasPrefix(filepath.Base(name), "..") {
+		return true
+	}
+	files, err := w.files()
+	if err != nil {
+		return true
+	}
+	for _, f := range files {
+		if filepath.Clean(f) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watcher) notify() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+		// Notification is already pending
+	}
+}
+
+// Update config files stamp, returns true if stamp is changed
+func (w *Watcher) updateStamp() bool {
+	stamp, err := w.currentStamp()
+	if err != nil {
+		glog.Errorf("can't stat config files: %v", err)
+		return false
+	}
+	if stamp == w.stamp {
+		return false
+	}
+	w.stamp = stamp
+	return true
+}
+
+// Get stamp of config files: resolved paths, sizes and modification times
+func (w *Watcher) currentStamp() (string, error) {
+	files, err := w.files()
+	if err != nil {
+		return "", err
+	}
+
+	known := map[string]bool{}
+	stamp := bytes.NewBuffer(nil)
+	for _, f := range files {
+		known[filepath.Clean(f)] = true
+		path, err := filepath.EvalSymlinks(f)
+		if err != nil {
+			return "", err
+		}
+		s, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(stamp, "%s:%s:%d:%d\n", f, path, s.Size(), s.ModTime().UnixNano())
+	}
+	w.known = known
+
+	return stamp.String(), nil
+}
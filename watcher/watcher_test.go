@@ -0,0 +1,149 @@
+// Copyright © 2019 Victor Antonovich <victor@antonovich.me>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+func expectChange(t *testing.T, w *Watcher, what string) {
+	select {
+	case <-w.Changes():
+	case <-time.After(testTimeout):
+		t.Fatalf("no change notification for %s", what)
+	}
+}
+
+func writeFile(t *testing.T, fileName, data string) {
+	if err := ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcher_configMapVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Simulate ConfigMap volume layout: config.yaml -> ..data/config.yaml, ..data -> ..<timestamp>
+	mkdata := func(name, data string) {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, name, "config.yaml"), data)
+	}
+	mkdata("..2019_01_07_10_00_00.1", "restrictedPorts: [1234]\n")
+	if err := os.Symlink("..2019_01_07_10_00_00.1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewFileWatcher(fileName, time.Hour)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go w.Run(stopCh)
+	// Let watcher start
+	time.Sleep(debounceDelay)
+
+	// Atomic update: new data directory, temporary symlink renamed to ..data
+	mkdata("..2019_01_07_10_01_00.2", "restrictedPorts: [4567]\n")
+	if err := os.Symlink("..2019_01_07_10_01_00.2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, w, "..data symlink swap")
+
+	// Same size in-place update
+	writeFile(t, filepath.Join(dir, "..2019_01_07_10_01_00.2", "config.yaml"), "restrictedPorts: [7890]\n")
+	if err := os.Chtimes(fileName, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, w, "in-place update")
+}
+
+func TestWatcher_updateStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "config.yaml")
+	writeFile(t, fileName, "restrictedPorts: [1234]\n")
+
+	w := NewFileWatcher(fileName, time.Hour)
+	if w.updateStamp() {
+		t.Errorf("Watcher.updateStamp() = true for unchanged file")
+	}
+
+	writeFile(t, fileName, "restrictedPorts: [1234, 4567]\n")
+	if !w.updateStamp() {
+		t.Errorf("Watcher.updateStamp() = false for changed file")
+	}
+	if w.updateStamp() {
+		t.Errorf("Watcher.updateStamp() = true for unchanged file")
+	}
+
+	if err := os.Remove(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if w.updateStamp() {
+		t.Errorf("Watcher.updateStamp() = true for removed file")
+	}
+}
+
+func TestWatcher_unrelatedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-restrict-ip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "config.yaml")
+	writeFile(t, fileName, "restrictedPorts: [1234]\n")
+
+	w := NewFileWatcher(fileName, time.Hour)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go w.Run(stopCh)
+	time.Sleep(debounceDelay)
+
+	writeFile(t, filepath.Join(dir, "other.log"), "unrelated\n")
+	select {
+	case <-w.Changes():
+		t.Fatalf("change notification for unrelated file")
+	case <-time.After(3 * debounceDelay):
+	}
+
+	// Editor-like update: temporary file renamed to config file
+	writeFile(t, filepath.Join(dir, ".config.yaml.swp"), "restrictedPorts: [4567]\n")
+	if err := os.Rename(filepath.Join(dir, ".config.yaml.swp"), fileName); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, w, "config file replace")
+}